@@ -0,0 +1,44 @@
+package main
+
+import (
+	"regexp"
+
+	"golang.org/x/text/unicode/bidi"
+)
+
+const (
+	// firstStrongIsolate and popDirectionalIsolate set text apart so its
+	// direction doesn't affect the text around it
+	firstStrongIsolate    = "\u2068"
+	popDirectionalIsolate = "\u2069"
+)
+
+var isolateURLPattern = regexp.MustCompile(`https?://[^\s<>"\x{2068}\x{2069}]+`)
+
+// isRTL reports whether most of the strongly directional characters in
+// text are right-to-left, as in Arabic or Hebrew. URLs are left out of the
+// count, so a link doesn't outweigh a short right-to-left post.
+func isRTL(text string) bool {
+	var ltr, rtl int
+	for _, r := range isolateURLPattern.ReplaceAllString(text, "") {
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.L:
+			ltr++
+		case bidi.R, bidi.AL:
+			rtl++
+		}
+	}
+	return rtl > ltr
+}
+
+// isolate wraps text in bidi isolates
+func isolate(text string) string {
+	return firstStrongIsolate + text + popDirectionalIsolate
+}
+
+// isolateURLs wraps each URL in bidi isolates, so a left-to-right URL in
+// right-to-left text doesn't pull the punctuation around it out of order
+func isolateURLs(text string) string {
+	return isolateURLPattern.ReplaceAllStringFunc(text, isolate)
+}
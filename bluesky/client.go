@@ -4,22 +4,235 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
 	defaultPDS = "https://bsky.social"
+
+	defaultMaxAltLength = 2000
 )
 
+// ErrBlobNotFound is returned when a record references a blob the PDS no
+// longer has, usually because it was garbage-collected while unreferenced
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrRecordNotFound is returned when a record doesn't exist, usually because
+// it was deleted on Bluesky
+var ErrRecordNotFound = errors.New("record not found")
+
+// ErrUnauthorized is returned when Bluesky rejects our credentials, usually
+// because the app password was revoked
+var ErrUnauthorized = errors.New("bluesky credentials are invalid")
+
+// RateLimitError is returned when Bluesky rate limits a write. RetryAfter
+// is how long it asked us to wait, or 0 if it didn't say.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter == 0 {
+		return "rate limited"
+	}
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+// rateLimitError reads how long to wait from a 429 response, from
+// Retry-After in seconds or the RateLimit-Reset time that Bluesky sends
+func rateLimitError(resp *http.Response) *RateLimitError {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return &RateLimitError{RetryAfter: time.Duration(seconds) * time.Second}
+	}
+	if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+			return &RateLimitError{RetryAfter: wait.Round(time.Second)}
+		}
+	}
+	return &RateLimitError{}
+}
+
+// StrongRef points at a specific version of a record
+type StrongRef struct {
+	URI string `json:"uri"`
+	CID string `json:"cid"`
+}
+
+// ParseStrongRef parses a reference stored as "uri|cid", checking that the
+// URI names a record and that there is a CID
+func ParseStrongRef(id string) (StrongRef, error) {
+	uri, cid, ok := strings.Cut(id, "|")
+	if !ok || cid == "" || strings.ContainsAny(cid, " |") {
+		return StrongRef{}, fmt.Errorf("invalid record ref %q: want uri|cid", id)
+	}
+	if repo, collection, rkey, err := parseATURI(uri); err != nil || repo == "" || collection == "" || rkey == "" {
+		return StrongRef{}, fmt.Errorf("invalid record ref %q: bad URI", id)
+	}
+	return StrongRef{URI: uri, CID: cid}, nil
+}
+
+// ReplyRef is the reply field of a post record
+type ReplyRef struct {
+	Root   StrongRef `json:"root"`
+	Parent StrongRef `json:"parent"`
+}
+
+// Image is an uploaded blob attached to a post with its alt text
+type Image struct {
+	Alt  string
+	Blob json.RawMessage
+}
+
+// PostMeta holds optional fields for new post records
+type PostMeta struct {
+	// Labels are self-label values such as "graphic-media"
+	Labels []string
+
+	// NoFacets posts the text without any rich text facets
+	NoFacets bool
+
+	// CreatedAt overrides the record's creation time when set
+	CreatedAt time.Time
+
+	// TagFacets also makes the hashtags in the text searchable tags
+	TagFacets bool
+
+	// External is shown as a link card on records that have no other embed
+	External *External
+
+	// Langs are the languages the text is in, as BCP 47 tags
+	Langs []string
+
+	// Quote embeds another post, alongside any images. It takes the place
+	// of External.
+	Quote *StrongRef
+
+	// markerTag is the client's feed marker, appended to the text as a
+	// hashtag
+	markerTag string
+}
+
+// apply sets the optional fields on a post record, along with facets for
+// the links (and with TagFacets, hashtags) in its text unless NoFacets is set.
+// The feed marker tag, if any, is appended to the text and always faceted.
+func (m PostMeta) apply(record map[string]interface{}, limit facetLimit) error {
+	marker := addMarkerTag(record, m.markerTag)
+
+	if text, _ := record["text"].(string); text != "" && (!m.NoFacets || marker != nil) {
+		var facets []Facet
+		if !m.NoFacets {
+			facets = linkFacets(text)
+			if m.TagFacets {
+				facets = append(facets, tagFacets(text)...)
+			}
+		}
+		if marker != nil {
+			facets = withMarkerFacet(facets, *marker, limit)
+		} else {
+			facets = limit.trim(facets)
+		}
+		if err := validateFacets(text, facets); err != nil {
+			return err
+		}
+		if len(facets) > 0 {
+			record["facets"] = facets
+		}
+	}
+
+	if m.Quote != nil {
+		quote := map[string]interface{}{
+			"$type":  "app.bsky.embed.record",
+			"record": m.Quote,
+		}
+		if media, ok := record["embed"]; ok {
+			record["embed"] = map[string]interface{}{
+				"$type":  "app.bsky.embed.recordWithMedia",
+				"record": quote,
+				"media":  media,
+			}
+		} else {
+			record["embed"] = quote
+		}
+	}
+
+	if _, ok := record["embed"]; !ok && m.External != nil {
+		record["embed"] = externalEmbed(m.External)
+	}
+
+	if len(m.Labels) > 0 {
+		record["labels"] = SelfLabels(m.Labels)
+	}
+
+	if len(m.Langs) > 0 {
+		record["langs"] = m.Langs
+	}
+
+	if !m.CreatedAt.IsZero() {
+		record["createdAt"] = m.CreatedAt.Format(time.RFC3339)
+	}
+
+	return nil
+}
+
+// SelfLabels builds the labels field of a record from label values
+func SelfLabels(values []string) map[string]interface{} {
+	var labels []map[string]string
+	for _, v := range values {
+		labels = append(labels, map[string]string{"val": v})
+	}
+
+	return map[string]interface{}{
+		"$type":  "com.atproto.label.defs#selfLabels",
+		"values": labels,
+	}
+}
+
+// External is a link preview card
+type External struct {
+	URI         string
+	Title       string
+	Description string
+
+	// Thumb is an uploaded blob, or nil for a card without an image
+	Thumb json.RawMessage
+}
+
 type ClientConfig struct {
 	PDS        string // Default: https://bsky.social
 	Identifier string // Username or email
 	Password   string // App password
+
+	// FeedMarkerTag is appended as a hashtag to every bridged post that has
+	// room for it, so custom feed generators can select them
+	FeedMarkerTag string `toml:"feed_marker_tag"`
+
+	// MaxFacets caps the facets on a record. Past it, the facets of the
+	// kinds last in FacetPriority ("link" and "tag", links first by
+	// default) are dropped first. Defaults to 100.
+	MaxFacets     int      `toml:"max_facets"`
+	FacetPriority []string `toml:"facet_priority"`
+
+	// MaxAltLength is the most graphemes of alt text kept for an image.
+	// Longer descriptions are cut at a word boundary and end with an
+	// ellipsis. Defaults to 2000, the most the Bluesky app accepts.
+	MaxAltLength int `toml:"max_alt_length"`
+
+	// BridgeDisplaySuffix is stripped from the end of display names before
+	// they are compared when looking up a reply's parent, on top of the
+	// markers Bridgy Fed and similar bridges commonly add
+	BridgeDisplaySuffix string `toml:"bridge_display_suffix"`
+
+	// MinSimilarity is how alike, from 0 to 1, a post found by searching
+	// for a reply parent's text has to be to it. Defaults to 0.8.
+	MinSimilarity float64 `toml:"min_similarity"`
 }
 
 type Client struct {
@@ -31,6 +244,15 @@ type Client struct {
 	did        string
 	expiresAt  time.Time
 	httpClient *http.Client
+	markerTag  string
+	facets     facetLimit
+
+	maxAltLength int
+
+	// displaySuffixes are stripped from display names before matching
+	displaySuffixes []string
+
+	minSimilarity float64
 }
 
 func NewClient(config ClientConfig) (*Client, error) {
@@ -48,6 +270,31 @@ func NewClient(config ClientConfig) (*Client, error) {
 		},
 	}
 
+	c.markerTag = strings.TrimPrefix(config.FeedMarkerTag, "#")
+
+	c.facets = facetLimit{max: config.MaxFacets, priority: config.FacetPriority}
+	if c.facets.max <= 0 {
+		c.facets.max = defaultMaxFacets
+	}
+	if len(c.facets.priority) == 0 {
+		c.facets.priority = []string{"link", "tag"}
+	}
+
+	c.maxAltLength = config.MaxAltLength
+	if c.maxAltLength <= 0 {
+		c.maxAltLength = defaultMaxAltLength
+	}
+
+	c.displaySuffixes = bridgeDisplaySuffixes
+	if suffix := strings.TrimSpace(config.BridgeDisplaySuffix); suffix != "" {
+		c.displaySuffixes = append([]string{suffix}, bridgeDisplaySuffixes...)
+	}
+
+	c.minSimilarity = config.MinSimilarity
+	if c.minSimilarity <= 0 {
+		c.minSimilarity = defaultMinSimilarity
+	}
+
 	// We'll authenticate on first use
 	return c, nil
 }
@@ -85,6 +332,9 @@ func (c *Client) ensureAuth(ctx context.Context) error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("authentication failed: %s: %w", body, ErrUnauthorized)
+		}
 		return fmt.Errorf("authentication failed with status %d: %s", resp.StatusCode, body)
 	}
 
@@ -106,7 +356,9 @@ func (c *Client) ensureAuth(ctx context.Context) error {
 
 	return nil
 }
-func (c *Client) CreateReply(ctx context.Context, text string, parentCid string, parentUri string) (string, error) {
+
+// CreateReply creates a post replying to parent in the thread started by root
+func (c *Client) CreateReply(ctx context.Context, text string, root StrongRef, parent StrongRef, meta PostMeta, images ...Image) (string, error) {
 	if err := c.ensureAuth(ctx); err != nil {
 		return "", fmt.Errorf("authentication failed: %w", err)
 	}
@@ -116,18 +368,21 @@ func (c *Client) CreateReply(ctx context.Context, text string, parentCid string,
 		"$type":     "app.bsky.feed.post",
 		"text":      text,
 		"createdAt": time.Now().Format(time.RFC3339),
-		"reply": map[string]interface{}{
-			"root": map[string]interface{}{
-				"cid": parentCid,
-				"uri": parentUri,
-			},
-			"parent": map[string]interface{}{
-				"cid": parentCid,
-				"uri": parentUri,
-			},
+		"reply": ReplyRef{
+			Root:   root,
+			Parent: parent,
 		},
 	}
 
+	if len(images) > 0 {
+		record["embed"] = imagesEmbed(images, c.maxAltLength)
+	}
+
+	meta.markerTag = c.markerTag
+	if err := meta.apply(record, c.facets); err != nil {
+		return "", err
+	}
+
 	req := map[string]interface{}{
 		"repo":       c.did,
 		"collection": "app.bsky.feed.post",
@@ -156,6 +411,15 @@ func (c *Client) CreateReply(ctx context.Context, text string, parentCid string,
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return "", fmt.Errorf("reply creation failed: %w", rateLimitError(resp))
+		}
+		if isBlobNotFound(body) {
+			return "", fmt.Errorf("reply creation failed: %w", ErrBlobNotFound)
+		}
+		if isInvalidFacet(body) {
+			return "", fmt.Errorf("reply creation failed: %w", &FacetError{Reason: string(body)})
+		}
 		return "", fmt.Errorf("reply creation failed with status %d: %s", resp.StatusCode, body)
 	}
 
@@ -173,7 +437,7 @@ func (c *Client) CreateReply(ctx context.Context, text string, parentCid string,
 }
 
 // Update the CreatePost method to also return the URI and CID
-func (c *Client) CreatePost(ctx context.Context, text string) (string, error) {
+func (c *Client) CreatePost(ctx context.Context, text string, meta PostMeta, images ...Image) (string, error) {
 	if err := c.ensureAuth(ctx); err != nil {
 		return "", fmt.Errorf("authentication failed: %w", err)
 	}
@@ -185,6 +449,15 @@ func (c *Client) CreatePost(ctx context.Context, text string) (string, error) {
 		"createdAt": time.Now().Format(time.RFC3339),
 	}
 
+	if len(images) > 0 {
+		record["embed"] = imagesEmbed(images, c.maxAltLength)
+	}
+
+	meta.markerTag = c.markerTag
+	if err := meta.apply(record, c.facets); err != nil {
+		return "", err
+	}
+
 	req := map[string]interface{}{
 		"repo":       c.did,
 		"collection": "app.bsky.feed.post",
@@ -213,6 +486,15 @@ func (c *Client) CreatePost(ctx context.Context, text string) (string, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return "", fmt.Errorf("post creation failed: %w", rateLimitError(resp))
+		}
+		if isBlobNotFound(body) {
+			return "", fmt.Errorf("post creation failed: %w", ErrBlobNotFound)
+		}
+		if isInvalidFacet(body) {
+			return "", fmt.Errorf("post creation failed: %w", &FacetError{Reason: string(body)})
+		}
 		return "", fmt.Errorf("post creation failed with status %d: %s", resp.StatusCode, body)
 	}
 
@@ -229,6 +511,485 @@ func (c *Client) CreatePost(ctx context.Context, text string) (string, error) {
 	return postResp.Uri + "|" + postResp.Cid, nil
 }
 
+// UploadBlob uploads media to the PDS and returns the blob reference
+func (c *Client) UploadBlob(ctx context.Context, data []byte, mimeType string) (json.RawMessage, error) {
+	if err := c.ensureAuth(ctx); err != nil {
+		return nil, fmt.Errorf("authentication failed: %w", err)
+	}
+
+	url := c.pds + "/xrpc/com.atproto.repo.uploadBlob"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("creating upload request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", mimeType)
+	httpReq.Header.Set("Authorization", "Bearer "+c.accessJwt)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("performing upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("blob upload failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var uploadResp struct {
+		Blob json.RawMessage `json:"blob"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&uploadResp); err != nil {
+		return nil, fmt.Errorf("decoding upload response: %w", err)
+	}
+
+	return uploadResp.Blob, nil
+}
+
+// imagesEmbed builds an app.bsky.embed.images object for a record
+func imagesEmbed(images []Image, maxAltLength int) map[string]interface{} {
+	var embedImages []map[string]interface{}
+	for _, image := range images {
+		embedImages = append(embedImages, map[string]interface{}{
+			"alt":   truncateAlt(image.Alt, maxAltLength),
+			"image": image.Blob,
+		})
+	}
+
+	return map[string]interface{}{
+		"$type":  "app.bsky.embed.images",
+		"images": embedImages,
+	}
+}
+
+// truncateAlt cuts alt text longer than maxLength graphemes at a word
+// boundary and ends it with an ellipsis. Combining marks, variation
+// selectors and joined emoji are never separated from the character they
+// belong to.
+func truncateAlt(alt string, maxLength int) string {
+	var starts []int
+	GraphemeStarts(alt, func(i int) bool {
+		starts = append(starts, i)
+		return true
+	})
+	if maxLength <= 0 || len(starts) <= maxLength {
+		return alt
+	}
+
+	// Leave room for the ellipsis, and prefer not to cut a word in half
+	cut := starts[maxLength-1]
+	if space := strings.LastIndexAny(alt[:cut], " \t\n"); space > cut/2 {
+		cut = space
+	}
+
+	log.Printf("Alt text is %d graphemes, cutting it to %d", len(starts), maxLength)
+	return strings.TrimSpace(alt[:cut]) + "…"
+}
+
+// isBlobNotFound checks an error response for a missing blob reference
+func isBlobNotFound(body []byte) bool {
+	return bytes.Contains(body, []byte("BlobNotFound")) ||
+		bytes.Contains(body, []byte("Could not find blob"))
+}
+
+// parseATURI splits an at:// URI into its repo, collection and record key
+func parseATURI(uri string) (string, string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(uri, "at://"), "/")
+	if !strings.HasPrefix(uri, "at://") || len(parts) != 3 {
+		return "", "", "", fmt.Errorf("invalid record URI %q", uri)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// PostURL returns the bsky.app web link for a post record URI
+func PostURL(uri string) (string, error) {
+	repo, _, rkey, err := parseATURI(uri)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://bsky.app/profile/%s/post/%s", repo, rkey), nil
+}
+
+// GetRecord fetches a record and its current CID
+func (c *Client) GetRecord(ctx context.Context, uri string) (map[string]interface{}, string, error) {
+	if err := c.ensureAuth(ctx); err != nil {
+		return nil, "", fmt.Errorf("authentication failed: %w", err)
+	}
+
+	repo, collection, rkey, err := parseATURI(uri)
+	if err != nil {
+		return nil, "", err
+	}
+
+	url := c.pds + "/xrpc/com.atproto.repo.getRecord"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("creating get record request: %w", err)
+	}
+
+	q := req.URL.Query()
+	q.Add("repo", repo)
+	q.Add("collection", collection)
+	q.Add("rkey", rkey)
+	req.URL.RawQuery = q.Encode()
+
+	req.Header.Set("Authorization", "Bearer "+c.accessJwt)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("performing get record request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if bytes.Contains(body, []byte("RecordNotFound")) {
+			return nil, "", fmt.Errorf("get record failed: %w", ErrRecordNotFound)
+		}
+		return nil, "", fmt.Errorf("get record failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var recordResp struct {
+		Cid   string                 `json:"cid"`
+		Value map[string]interface{} `json:"value"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&recordResp); err != nil {
+		return nil, "", fmt.Errorf("decoding get record response: %w", err)
+	}
+
+	return recordResp.Value, recordResp.Cid, nil
+}
+
+// GetRecordReply returns the reply refs of a post, or nil if it isn't a reply
+func (c *Client) GetRecordReply(ctx context.Context, uri string) (*ReplyRef, error) {
+	record, _, err := c.GetRecord(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := record["reply"]
+	if !ok {
+		return nil, nil
+	}
+
+	// Round-trip through JSON to get the typed form
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling reply: %w", err)
+	}
+
+	var reply ReplyRef
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("decoding reply: %w", err)
+	}
+
+	return &reply, nil
+}
+
+// RecordExists reports whether a record can be read back with the given CID
+func (c *Client) RecordExists(ctx context.Context, uri, cid string) (bool, error) {
+	_, current, err := c.GetRecord(ctx, uri)
+	if errors.Is(err, ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current == cid, nil
+}
+
+// UpdatePost replaces one of our post records in place and returns its new URI|CID
+func (c *Client) UpdatePost(ctx context.Context, uri string, record map[string]interface{}) (string, error) {
+	if err := c.ensureAuth(ctx); err != nil {
+		return "", fmt.Errorf("authentication failed: %w", err)
+	}
+
+	_, collection, rkey, err := parseATURI(uri)
+	if err != nil {
+		return "", err
+	}
+
+	req := map[string]interface{}{
+		"repo":       c.did,
+		"collection": collection,
+		"rkey":       rkey,
+		"record":     record,
+	}
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("marshaling update request: %w", err)
+	}
+
+	url := c.pds + "/xrpc/com.atproto.repo.putRecord"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("creating update request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+c.accessJwt)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("performing update request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("post update failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var putResp struct {
+		Uri string `json:"uri"`
+		Cid string `json:"cid"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&putResp); err != nil {
+		return "", fmt.Errorf("decoding update response: %w", err)
+	}
+
+	return putResp.Uri + "|" + putResp.Cid, nil
+}
+
+// GetLikes returns how many likes a post has (up to the first page of 100)
+func (c *Client) GetLikes(ctx context.Context, uri string) (int, error) {
+	if err := c.ensureAuth(ctx); err != nil {
+		return 0, fmt.Errorf("authentication failed: %w", err)
+	}
+
+	url := c.pds + "/xrpc/app.bsky.feed.getLikes"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("creating likes request: %w", err)
+	}
+
+	q := req.URL.Query()
+	q.Add("uri", uri)
+	q.Add("limit", "100")
+	req.URL.RawQuery = q.Encode()
+
+	req.Header.Set("Authorization", "Bearer "+c.accessJwt)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("performing likes request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("likes request failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var likesResp struct {
+		Likes []json.RawMessage `json:"likes"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&likesResp); err != nil {
+		return 0, fmt.Errorf("decoding likes response: %w", err)
+	}
+
+	return len(likesResp.Likes), nil
+}
+
+// threadView is a post in an app.bsky.feed.getPostThread response
+type threadView struct {
+	Post struct {
+		IndexedAt time.Time `json:"indexedAt"`
+	} `json:"post"`
+	Replies []threadView `json:"replies"`
+}
+
+// LatestReplyTime returns when the newest reply anywhere under a post was
+// made, or the zero time if it has no replies
+func (c *Client) LatestReplyTime(ctx context.Context, uri string) (time.Time, error) {
+	if err := c.ensureAuth(ctx); err != nil {
+		return time.Time{}, fmt.Errorf("authentication failed: %w", err)
+	}
+
+	url := c.pds + "/xrpc/app.bsky.feed.getPostThread"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("creating thread request: %w", err)
+	}
+
+	q := req.URL.Query()
+	q.Add("uri", uri)
+	q.Add("depth", "100")
+	q.Add("parentHeight", "0")
+	req.URL.RawQuery = q.Encode()
+
+	req.Header.Set("Authorization", "Bearer "+c.accessJwt)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("performing thread request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return time.Time{}, fmt.Errorf("thread request failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var threadResp struct {
+		Thread threadView `json:"thread"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&threadResp); err != nil {
+		return time.Time{}, fmt.Errorf("decoding thread response: %w", err)
+	}
+
+	var latest time.Time
+	var walk func(replies []threadView)
+	walk = func(replies []threadView) {
+		for _, reply := range replies {
+			if reply.Post.IndexedAt.After(latest) {
+				latest = reply.Post.IndexedAt
+			}
+			walk(reply.Replies)
+		}
+	}
+	walk(threadResp.Thread.Replies)
+
+	return latest, nil
+}
+
+// CreateLinkPost creates a post showing card as a link preview. reply may be
+// nil for a top-level post, and card may be nil to only make the links in
+// text clickable.
+func (c *Client) CreateLinkPost(ctx context.Context, text string, reply *ReplyRef, meta PostMeta, card *External) (string, error) {
+	record := map[string]interface{}{
+		"$type":     "app.bsky.feed.post",
+		"text":      text,
+		"createdAt": time.Now().Format(time.RFC3339),
+	}
+
+	if reply != nil {
+		record["reply"] = reply
+	}
+
+	if card != nil {
+		record["embed"] = externalEmbed(card)
+	}
+
+	meta.markerTag = c.markerTag
+	if err := meta.apply(record, c.facets); err != nil {
+		return "", err
+	}
+
+	return c.createRecord(ctx, "app.bsky.feed.post", record)
+}
+
+// externalEmbed builds an app.bsky.embed.external object for a record
+func externalEmbed(card *External) map[string]interface{} {
+	external := map[string]interface{}{
+		"uri":         card.URI,
+		"title":       card.Title,
+		"description": card.Description,
+	}
+	if card.Thumb != nil {
+		external["thumb"] = card.Thumb
+	}
+
+	return map[string]interface{}{
+		"$type":    "app.bsky.embed.external",
+		"external": external,
+	}
+}
+
+// CreateQuote creates a post embedding another post
+func (c *Client) CreateQuote(ctx context.Context, text string, quoted StrongRef) (string, error) {
+	record := map[string]interface{}{
+		"$type":     "app.bsky.feed.post",
+		"text":      text,
+		"createdAt": time.Now().Format(time.RFC3339),
+		"embed": map[string]interface{}{
+			"$type":  "app.bsky.embed.record",
+			"record": quoted,
+		},
+	}
+
+	if err := (PostMeta{markerTag: c.markerTag}).apply(record, c.facets); err != nil {
+		return "", err
+	}
+
+	return c.createRecord(ctx, "app.bsky.feed.post", record)
+}
+
+// createRecord creates a record in our repo and returns its URI|CID
+func (c *Client) createRecord(ctx context.Context, collection string, record map[string]interface{}) (string, error) {
+	return c.createRecordWithKey(ctx, collection, "", record)
+}
+
+// createRecordWithKey creates a record with the given record key, or one
+// the PDS picks if rkey is empty
+func (c *Client) createRecordWithKey(ctx context.Context, collection string, rkey string,
+	record map[string]interface{}) (string, error) {
+	if err := c.ensureAuth(ctx); err != nil {
+		return "", fmt.Errorf("authentication failed: %w", err)
+	}
+
+	req := map[string]interface{}{
+		"repo":       c.did,
+		"collection": collection,
+		"record":     record,
+	}
+	if rkey != "" {
+		req["rkey"] = rkey
+	}
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("marshaling create request: %w", err)
+	}
+
+	url := c.pds + "/xrpc/com.atproto.repo.createRecord"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("creating create request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+c.accessJwt)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("performing create request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return "", fmt.Errorf("record creation failed: %w", rateLimitError(resp))
+		}
+		if isBlobNotFound(body) {
+			return "", fmt.Errorf("record creation failed: %w", ErrBlobNotFound)
+		}
+		if isInvalidFacet(body) {
+			return "", fmt.Errorf("record creation failed: %w", &FacetError{Reason: string(body)})
+		}
+		return "", fmt.Errorf("record creation failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var createResp struct {
+		Uri string `json:"uri"`
+		Cid string `json:"cid"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&createResp); err != nil {
+		return "", fmt.Errorf("decoding create response: %w", err)
+	}
+
+	return createResp.Uri + "|" + createResp.Cid, nil
+}
+
 // DeletePost deletes a post on Bluesky
 func (c *Client) DeletePost(ctx context.Context, recordID string) error {
 	if err := c.ensureAuth(ctx); err != nil {
@@ -240,27 +1001,27 @@ func (c *Client) DeletePost(ctx context.Context, recordID string) error {
 	// Format 2: at://did:plc:xxx/app.bsky.feed.post/xxx
 	// Format 3: just the record ID
 
+	// Full URIs also say which collection the record is in, which matters
+	// for reposts
+	collection := "app.bsky.feed.post"
+
 	// Check if it contains a pipe (Format 1)
 	if strings.Contains(recordID, "|") {
-		parts := strings.Split(recordID, "|")
-		if len(parts) >= 1 {
-			uriParts := strings.Split(parts[0], "/")
-			if len(uriParts) >= 4 {
-				recordID = uriParts[len(uriParts)-1]
-			}
-		}
-	} else if strings.HasPrefix(recordID, "at://") {
+		recordID = strings.Split(recordID, "|")[0]
+	}
+
+	if strings.HasPrefix(recordID, "at://") {
 		// Format 2: Full URI
-		parts := strings.Split(recordID, "/")
-		if len(parts) >= 4 {
-			recordID = parts[len(parts)-1]
+		if _, uriCollection, rkey, err := parseATURI(recordID); err == nil {
+			collection = uriCollection
+			recordID = rkey
 		}
 	}
 	// Format 3: already just the record ID, no need to change
 
 	req := map[string]interface{}{
 		"repo":       c.did,
-		"collection": "app.bsky.feed.post",
+		"collection": collection,
 		"rkey":       recordID,
 	}
 
@@ -441,6 +1202,12 @@ func (c *Client) LookupBridgedMastodonPost(ctx context.Context, mastodonPostID s
 			continue
 		}
 
+		// Only trust the DID if its document claims the handle back
+		if err := c.verifyHandle(ctx, did, handle); err != nil {
+			log.Printf("Not trusting %s for handle %s: %v", did, handle, err)
+			continue
+		}
+
 		// Try to find the post in this user's feed
 		uri, cid, err := c.findPostInUserFeed(ctx, did, mastodonPostID)
 		if err == nil && uri != "" && cid != "" {
@@ -482,7 +1249,7 @@ func (c *Client) LookupBridgedMastodonPost(ctx context.Context, mastodonPostID s
 
 		log.Printf("Searching for content: '%s'", searchContent)
 
-		uri, cid, err := c.findPostByContentAndName(ctx, searchContent, displayName, postDate)
+		uri, cid, err := c.findPostByContentAndName(ctx, searchContent, postContent, displayName, postDate)
 		if err == nil && uri != "" && cid != "" {
 			return uri, cid, nil
 		}
@@ -493,7 +1260,10 @@ func (c *Client) LookupBridgedMastodonPost(ctx context.Context, mastodonPostID s
 }
 
 // Helper to find a post by content and display name
-func (c *Client) findPostByContentAndName(ctx context.Context, content string, displayName string, postDate time.Time) (string, string, error) {
+// findPostByContentAndName searches Bluesky for query and returns the first
+// result by someone with the same display name, posted around postDate, whose
+// text is at least min_similarity alike to content
+func (c *Client) findPostByContentAndName(ctx context.Context, query string, content string, displayName string, postDate time.Time) (string, string, error) {
 	url := c.pds + "/xrpc/app.bsky.feed.searchPosts"
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -501,7 +1271,7 @@ func (c *Client) findPostByContentAndName(ctx context.Context, content string, d
 	}
 
 	q := req.URL.Query()
-	q.Add("q", content)
+	q.Add("q", query)
 	q.Add("limit", "30") // Get more results to increase chances of finding a match
 	req.URL.RawQuery = q.Encode()
 
@@ -537,15 +1307,14 @@ func (c *Client) findPostByContentAndName(ctx context.Context, content string, d
 		return "", "", fmt.Errorf("decoding search response: %w", err)
 	}
 
+	displayName = stripDisplaySuffixes(displayName, c.displaySuffixes)
+
 	for _, post := range searchResp.Posts {
-		// Check if display name matches
-		if post.Author.DisplayName == displayName ||
-			strings.Contains(post.Author.DisplayName, displayName) ||
-			strings.Contains(displayName, post.Author.DisplayName) {
+		// Check if display name matches, ignoring any bridge markers
+		if sameDisplayName(stripDisplaySuffixes(post.Author.DisplayName, c.displaySuffixes), displayName) {
 
 			// Check if content is similar (might have been truncated)
-			if strings.Contains(post.Record.Text, content) ||
-				strings.Contains(content, post.Record.Text) {
+			if score := similarity(post.Record.Text, content); score >= c.minSimilarity {
 
 				// Check if the post date is close (within 1 day)
 				postCreatedAt, err := time.Parse(time.RFC3339, post.Record.CreatedAt)
@@ -556,7 +1325,8 @@ func (c *Client) findPostByContentAndName(ctx context.Context, content string, d
 
 				timeDiff := postCreatedAt.Sub(postDate)
 				if timeDiff < 24*time.Hour && timeDiff > -24*time.Hour {
-					log.Printf("Found post with matching content, display name, and timestamp: %s", post.Uri)
+					log.Printf("Found post with matching content (similarity %.2f), display name, and timestamp: %s",
+						score, post.Uri)
 					return post.Uri, post.Cid, nil
 				}
 			}
@@ -566,6 +1336,44 @@ func (c *Client) findPostByContentAndName(ctx context.Context, content string, d
 	return "", "", fmt.Errorf("no matching post found by content and display name")
 }
 
+// bridgeDisplaySuffixes are markers bridges commonly add to the end of the
+// display names of the accounts they bridge
+var bridgeDisplaySuffixes = []string{
+	"[bridged]",
+	"(bridged)",
+	"(via Bridgy Fed)",
+	"\U0001F309", // bridge at night emoji
+}
+
+// stripDisplaySuffixes removes any of suffixes from the end of a display
+// name, ignoring case, for as long as one is there
+func stripDisplaySuffixes(name string, suffixes []string) string {
+	name = strings.TrimSpace(name)
+	for {
+		stripped := name
+		for _, suffix := range suffixes {
+			if len(stripped) >= len(suffix) && strings.EqualFold(stripped[len(stripped)-len(suffix):], suffix) {
+				stripped = strings.TrimSpace(stripped[:len(stripped)-len(suffix)])
+			}
+		}
+
+		if stripped == name {
+			return name
+		}
+		name = stripped
+	}
+}
+
+// sameDisplayName reports whether two display names are equal or one
+// contains the other. An empty name, as is left of one that was only a
+// bridge marker, only matches another empty one.
+func sameDisplayName(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	return a == b || strings.Contains(a, b) || strings.Contains(b, a)
+}
+
 // Helper to resolve a handle to a DID
 func (c *Client) resolveHandle(ctx context.Context, handle string) (string, error) {
 	url := c.pds + "/xrpc/com.atproto.identity.resolveHandle"
@@ -602,6 +1410,161 @@ func (c *Client) resolveHandle(ctx context.Context, handle string) (string, erro
 	return resolveResp.Did, nil
 }
 
+// plcDirectory resolves did:plc identifiers to their DID documents
+const plcDirectory = "https://plc.directory"
+
+// didDocument is the part of a DID document we read
+type didDocument struct {
+	ID          string   `json:"id"`
+	AlsoKnownAs []string `json:"alsoKnownAs"`
+	Service     []struct {
+		ID              string `json:"id"`
+		Type            string `json:"type"`
+		ServiceEndpoint string `json:"serviceEndpoint"`
+	} `json:"service"`
+}
+
+// pds returns the endpoint of the PDS hosting the DID's repo
+func (d *didDocument) pds() string {
+	for _, svc := range d.Service {
+		if svc.ID == "#atproto_pds" || svc.ID == d.ID+"#atproto_pds" {
+			return strings.TrimRight(svc.ServiceEndpoint, "/")
+		}
+	}
+	return ""
+}
+
+// Helper to fetch the DID document of a did:plc or did:web identifier
+func (c *Client) resolveDID(ctx context.Context, did string) (*didDocument, error) {
+	var url string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		url = plcDirectory + "/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		var err error
+		if url, err = didWebURL(did); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DID method: %s", did)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating DID resolve request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing DID resolve request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("DID resolution failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var doc didDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding DID document: %w", err)
+	}
+
+	if doc.ID != did {
+		return nil, fmt.Errorf("DID document is for %s instead of %s", doc.ID, did)
+	}
+
+	return &doc, nil
+}
+
+// didWebURL returns where the DID document of a did:web identifier is
+// served. As the did:web spec has it, the identifier is the host, with any
+// port percent-encoded, optionally followed by a path with ':' in place of
+// '/'. Without a path the document is under /.well-known.
+func didWebURL(did string) (string, error) {
+	segments := strings.Split(strings.TrimPrefix(did, "did:web:"), ":")
+	for i, segment := range segments {
+		decoded, err := neturl.PathUnescape(segment)
+		if err != nil {
+			return "", fmt.Errorf("invalid did:web identifier %s: %w", did, err)
+		}
+
+		// Nothing decoded may change which host or path is fetched
+		if decoded == "" || strings.ContainsAny(decoded, "/?#@\\") {
+			return "", fmt.Errorf("invalid did:web identifier %s", did)
+		}
+		segments[i] = decoded
+	}
+
+	if len(segments) == 1 {
+		return "https://" + segments[0] + "/.well-known/did.json", nil
+	}
+	return "https://" + segments[0] + "/" + strings.Join(segments[1:], "/") + "/did.json", nil
+}
+
+// Helper to check that a DID's document lists the handle it was resolved
+// from, so a lookalike account can't be mistaken for the bridged one. The
+// document comes from the DID's own registry, and the repo is looked up on
+// the PDS the document names, since our PDS only knows about its own repos.
+func (c *Client) verifyHandle(ctx context.Context, did string, handle string) error {
+	doc, err := c.resolveDID(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	claimed := false
+	for _, aka := range doc.AlsoKnownAs {
+		if strings.EqualFold(aka, "at://"+handle) {
+			claimed = true
+			break
+		}
+	}
+	if !claimed {
+		return fmt.Errorf("DID document does not list handle %s", handle)
+	}
+
+	pds := doc.pds()
+	if pds == "" {
+		return fmt.Errorf("DID document of %s names no PDS", did)
+	}
+
+	url := pds + "/xrpc/com.atproto.repo.describeRepo"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("creating describe repo request: %w", err)
+	}
+
+	q := req.URL.Query()
+	q.Add("repo", did)
+	// Our session token is only good on our own PDS, so none is sent
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing describe repo request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("describe repo on %s failed with status %d: %s", pds, resp.StatusCode, body)
+	}
+
+	var describeResp struct {
+		Did string `json:"did"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&describeResp); err != nil {
+		return fmt.Errorf("decoding describe repo response: %w", err)
+	}
+
+	if describeResp.Did != did {
+		return fmt.Errorf("describe repo returned %s instead of %s", describeResp.Did, did)
+	}
+
+	return nil
+}
+
 // Helper to find a specific Mastodon post in a user's Bluesky feed
 func (c *Client) findPostInUserFeed(ctx context.Context, did string, mastodonPostID string) (string, string, error) {
 	url := c.pds + "/xrpc/app.bsky.feed.getAuthorFeed"
@@ -708,6 +1671,90 @@ func (c *Client) searchForPost(ctx context.Context, searchTerm, mastodonPostID s
 	return "", "", fmt.Errorf("no matching post found in search results")
 }
 
+// CreateThreadgate limits who can reply to a thread of ours. allow holds
+// "following" and "mentioned" for the accounts we follow and those the post
+// mentions; with neither, nobody can reply.
+func (c *Client) CreateThreadgate(ctx context.Context, postURI string, allow []string) error {
+	_, _, rkey, err := parseATURI(postURI)
+	if err != nil {
+		return err
+	}
+
+	rules := []map[string]interface{}{}
+	for _, rule := range allow {
+		var ruleType string
+		switch rule {
+		case "following":
+			ruleType = "app.bsky.feed.threadgate#followingRule"
+		case "mentioned":
+			ruleType = "app.bsky.feed.threadgate#mentionRule"
+		default:
+			return fmt.Errorf("unknown threadgate rule %q", rule)
+		}
+		rules = append(rules, map[string]interface{}{"$type": ruleType})
+	}
+
+	// A threadgate shares the record key of the post it gates
+	record := map[string]interface{}{
+		"$type":     "app.bsky.feed.threadgate",
+		"post":      postURI,
+		"allow":     rules,
+		"createdAt": time.Now().Format(time.RFC3339),
+	}
+
+	if _, err := c.createRecordWithKey(ctx, "app.bsky.feed.threadgate", rkey, record); err != nil {
+		return fmt.Errorf("creating threadgate: %w", err)
+	}
+	return nil
+}
+
+// PinnedPost returns the URI of the post pinned to our profile, or "" if
+// there is none
+func (c *Client) PinnedPost(ctx context.Context) (string, error) {
+	if err := c.ensureAuth(ctx); err != nil {
+		return "", fmt.Errorf("authentication failed: %w", err)
+	}
+
+	profile, _, err := c.GetRecord(ctx, "at://"+c.did+"/app.bsky.actor.profile/self")
+	if errors.Is(err, ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("getting profile: %w", err)
+	}
+
+	pinned, _ := profile["pinnedPost"].(map[string]interface{})
+	uri, _ := pinned["uri"].(string)
+	return uri, nil
+}
+
+// SetPinnedPost pins a post to our profile, or unpins the pinned post if ref
+// is nil. The rest of the profile is left as it is.
+func (c *Client) SetPinnedPost(ctx context.Context, ref *StrongRef) error {
+	if err := c.ensureAuth(ctx); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+
+	uri := "at://" + c.did + "/app.bsky.actor.profile/self"
+	profile, _, err := c.GetRecord(ctx, uri)
+	if errors.Is(err, ErrRecordNotFound) {
+		profile = map[string]interface{}{"$type": "app.bsky.actor.profile"}
+	} else if err != nil {
+		return fmt.Errorf("getting profile: %w", err)
+	}
+
+	if ref == nil {
+		delete(profile, "pinnedPost")
+	} else {
+		profile["pinnedPost"] = map[string]interface{}{"uri": ref.URI, "cid": ref.CID}
+	}
+
+	if _, err := c.UpdatePost(ctx, uri, profile); err != nil {
+		return fmt.Errorf("updating profile: %w", err)
+	}
+	return nil
+}
+
 func (c *Client) CreateRepost(ctx context.Context, uri string, cid string) (string, error) {
 	if err := c.ensureAuth(ctx); err != nil {
 		return "", fmt.Errorf("authentication failed: %w", err)
@@ -0,0 +1,210 @@
+package bluesky
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTruncateAlt(t *testing.T) {
+	tests := []struct {
+		name string
+		alt  string
+		max  int
+		want string
+	}{
+		{name: "short", alt: "A cat", max: 10, want: "A cat"},
+		{name: "exactly the limit", alt: "0123456789", max: 10, want: "0123456789"},
+		{name: "no limit", alt: strings.Repeat("x", 50), max: 0, want: strings.Repeat("x", 50)},
+		{name: "cut at a word", alt: "A cat on a windowsill", max: 12, want: "A cat on a…"},
+		{name: "one long word", alt: strings.Repeat("x", 20), max: 10, want: strings.Repeat("x", 9) + "…"},
+		{name: "emoji kept whole", alt: strings.Repeat("👍🏽", 10), max: 5, want: strings.Repeat("👍🏽", 4) + "…"},
+		{name: "flags kept whole", alt: strings.Repeat("🇳🇱", 10), max: 5, want: strings.Repeat("🇳🇱", 4) + "…"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateAlt(tt.alt, tt.max)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.max > 0 && graphemeLen(got) > tt.max {
+				t.Errorf("got %d graphemes, want at most %d", graphemeLen(got), tt.max)
+			}
+		})
+	}
+}
+
+func TestStripDisplaySuffixes(t *testing.T) {
+	suffixes := append([]string{"| mirror"}, bridgeDisplaySuffixes...)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "no marker", in: "Ada Lovelace", want: "Ada Lovelace"},
+		{name: "Bridgy Fed", in: "Ada Lovelace (via Bridgy Fed)", want: "Ada Lovelace"},
+		{name: "bridged", in: "Ada Lovelace (bridged)", want: "Ada Lovelace"},
+		{name: "any case", in: "Ada Lovelace [BRIDGED]", want: "Ada Lovelace"},
+		{name: "emoji", in: "Ada Lovelace \U0001F309", want: "Ada Lovelace"},
+		{name: "several", in: "Ada Lovelace (bridged) \U0001F309", want: "Ada Lovelace"},
+		{name: "configured", in: "Ada Lovelace | mirror", want: "Ada Lovelace"},
+		{name: "not at the end", in: "Ada (bridged) Lovelace", want: "Ada (bridged) Lovelace"},
+		{name: "only a marker", in: "(bridged)", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripDisplaySuffixes(tt.in, suffixes); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameDisplayName(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Ada Lovelace", "Ada Lovelace", true},
+		{"Ada Lovelace", "Ada", true},
+		{"Ada", "Grace Hopper", false},
+		{"", "Ada Lovelace", false},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		if got := sameDisplayName(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameDisplayName(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseStrongRef(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    StrongRef
+		wantErr bool
+	}{
+		{
+			name: "did:plc",
+			id:   "at://did:plc:abc123/app.bsky.feed.post/3kabc|bafyreib2",
+			want: StrongRef{URI: "at://did:plc:abc123/app.bsky.feed.post/3kabc", CID: "bafyreib2"},
+		},
+		{
+			name: "did:web",
+			id:   "at://did:web:example.com/app.bsky.feed.post/3kabc|bafyreib2",
+			want: StrongRef{URI: "at://did:web:example.com/app.bsky.feed.post/3kabc", CID: "bafyreib2"},
+		},
+		{name: "no CID", id: "at://did:plc:abc123/app.bsky.feed.post/3kabc", wantErr: true},
+		{name: "empty CID", id: "at://did:plc:abc123/app.bsky.feed.post/3kabc|", wantErr: true},
+		{name: "two CIDs", id: "at://did:plc:abc123/app.bsky.feed.post/3kabc|a|b", wantErr: true},
+		{name: "not an at URI", id: "https://bsky.app/profile/x/post/3kabc|bafyreib2", wantErr: true},
+		{name: "no repo", id: "at:///app.bsky.feed.post/3kabc|bafyreib2", wantErr: true},
+		{name: "no rkey", id: "at://did:plc:abc123/app.bsky.feed.post/|bafyreib2", wantErr: true},
+		{name: "empty", id: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseStrongRef(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			// A valid ref reads back as what was stored
+			if err == nil && got.URI+"|"+got.CID != tt.id {
+				t.Errorf("got %s|%s back, want %s", got.URI, got.CID, tt.id)
+			}
+		})
+	}
+}
+
+func TestDIDWebURL(t *testing.T) {
+	tests := []struct {
+		did     string
+		want    string
+		wantErr bool
+	}{
+		{did: "did:web:example.com", want: "https://example.com/.well-known/did.json"},
+		{did: "did:web:example.com%3A8443", want: "https://example.com:8443/.well-known/did.json"},
+		{did: "did:web:example.com:users:alice", want: "https://example.com/users/alice/did.json"},
+		{did: "did:web:example.com%3A8443:users:alice", want: "https://example.com:8443/users/alice/did.json"},
+		{did: "did:web:", wantErr: true},
+		{did: "did:web:example.com::alice", wantErr: true},
+		{did: "did:web:evil.example%2Fx%3F", wantErr: true},
+		{did: "did:web:me%40evil.example", wantErr: true},
+		{did: "did:web:example.com%zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.did, func(t *testing.T) {
+			got, err := didWebURL(tt.did)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyHandle(t *testing.T) {
+	var did string
+	var alsoKnownAs string
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/users/alice/did.json":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":          did,
+				"alsoKnownAs": []string{alsoKnownAs},
+				"service": []map[string]string{
+					{"id": "#atproto_pds", "type": "AtprotoPersonalDataServer", "serviceEndpoint": "https://" + r.Host},
+				},
+			})
+		case "/xrpc/com.atproto.repo.describeRepo":
+			json.NewEncoder(w).Encode(map[string]string{"did": r.URL.Query().Get("repo")})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// The test server is on a port, which did:web percent-encodes, and the
+	// document is under a path
+	host := strings.TrimPrefix(srv.URL, "https://")
+	did = "did:web:" + strings.ReplaceAll(host, ":", "%3A") + ":users:alice"
+	c := &Client{httpClient: srv.Client()}
+
+	tests := []struct {
+		name        string
+		alsoKnownAs string
+		wantErr     bool
+	}{
+		{name: "handle listed", alsoKnownAs: "at://alice.example"},
+		{name: "handle listed in other case", alsoKnownAs: "at://Alice.Example"},
+		{name: "other handle listed", alsoKnownAs: "at://mallory.example", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alsoKnownAs = tt.alsoKnownAs
+			err := c.verifyHandle(context.Background(), did, "alice.example")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want one: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package bluesky
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// URLs stop at bidi isolates, which may wrap them in right-to-left text
+	urlPattern = regexp.MustCompile(`https?://[^\s<>"\x{2068}\x{2069}]+`)
+
+	// Hashtags start the text or follow whitespace, so the fragment of a
+	// URL isn't mistaken for one
+	hashtagPattern = regexp.MustCompile(`(?:^|\s)(#[\p{L}\p{M}\p{N}_]+)`)
+
+	// facetPathPattern finds a record validation error about a facet
+	facetPathPattern = regexp.MustCompile(`(?i)\brecord/facets(?:/\d+|\b)`)
+)
+
+const (
+	// Bluesky ignores tags longer than this
+	maxTagLength = 64
+
+	defaultMaxFacets = 100
+
+	// maxPostGraphemes is the longest text Bluesky accepts on a post
+	maxPostGraphemes = 300
+)
+
+// facetLimit is how many facets a record may have, and which kinds to keep
+// when there are more
+type facetLimit struct {
+	max      int
+	priority []string
+}
+
+// trim drops facets past the limit, lowest priority kinds first and, within
+// a kind, the ones furthest into the text
+func (l facetLimit) trim(facets []Facet) []Facet {
+	if l.max <= 0 || len(facets) <= l.max {
+		return facets
+	}
+
+	rank := func(f Facet) int {
+		for i, kind := range l.priority {
+			if facetKind(f) == kind {
+				return i
+			}
+		}
+		return len(l.priority)
+	}
+
+	kept := make([]Facet, len(facets))
+	copy(kept, facets)
+	sort.SliceStable(kept, func(i, j int) bool {
+		if rank(kept[i]) != rank(kept[j]) {
+			return rank(kept[i]) < rank(kept[j])
+		}
+		return kept[i].Index.ByteStart < kept[j].Index.ByteStart
+	})
+
+	log.Printf("Post has %d facets, dropping %d past max_facets", len(facets), len(facets)-l.max)
+	kept = kept[:l.max]
+
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Index.ByteStart < kept[j].Index.ByteStart
+	})
+	return kept
+}
+
+// facetKind is the kind of a facet's first feature, such as "link" or "tag"
+func facetKind(f Facet) string {
+	if len(f.Features) == 0 {
+		return ""
+	}
+	t, _ := f.Features[0]["$type"].(string)
+	return strings.TrimPrefix(t, "app.bsky.richtext.facet#")
+}
+
+// FacetError is returned when a post's facets are invalid, either before
+// posting or because Bluesky rejected them. The post can be retried without
+// facets.
+type FacetError struct {
+	// Facet is the offending facet, or nil if Bluesky didn't say which
+	Facet  *Facet
+	Reason string
+}
+
+func (e *FacetError) Error() string {
+	if e.Facet == nil {
+		return "invalid facet: " + e.Reason
+	}
+	return fmt.Sprintf("invalid facet at bytes %d-%d: %s",
+		e.Facet.Index.ByteStart, e.Facet.Index.ByteEnd, e.Reason)
+}
+
+// Facet annotates a byte range of a post's text, such as a link
+type Facet struct {
+	Index    FacetIndex               `json:"index"`
+	Features []map[string]interface{} `json:"features"`
+}
+
+// FacetIndex is a byte range in UTF-8 post text, end exclusive
+type FacetIndex struct {
+	ByteStart int `json:"byteStart"`
+	ByteEnd   int `json:"byteEnd"`
+}
+
+// LinkFacet makes the text between start and end a link to uri
+func LinkFacet(start, end int, uri string) Facet {
+	return Facet{
+		Index: FacetIndex{ByteStart: start, ByteEnd: end},
+		Features: []map[string]interface{}{
+			{"$type": "app.bsky.richtext.facet#link", "uri": uri},
+		},
+	}
+}
+
+// linkFacets makes every URL in text clickable. Offsets are in bytes, as
+// Bluesky expects.
+func linkFacets(text string) []Facet {
+	var facets []Facet
+	for _, loc := range urlPattern.FindAllStringIndex(text, -1) {
+		// Punctuation that ends a sentence is rarely part of the URL
+		uri := strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)'")
+		facets = append(facets, LinkFacet(loc[0], loc[0]+len(uri), uri))
+	}
+	return facets
+}
+
+// TagFacet makes the text between start and end a link to a tag search
+func TagFacet(start, end int, tag string) Facet {
+	return Facet{
+		Index: FacetIndex{ByteStart: start, ByteEnd: end},
+		Features: []map[string]interface{}{
+			{"$type": "app.bsky.richtext.facet#tag", "tag": tag},
+		},
+	}
+}
+
+// tagFacets makes every hashtag in text a searchable tag. All-number tags
+// like #1 are left alone, as Bluesky doesn't treat them as tags either.
+func tagFacets(text string) []Facet {
+	var facets []Facet
+	for _, loc := range hashtagPattern.FindAllStringSubmatchIndex(text, -1) {
+		tag := text[loc[2]+1 : loc[3]]
+		if utf8.RuneCountInString(tag) > maxTagLength || strings.Trim(tag, "0123456789") == "" {
+			continue
+		}
+		facets = append(facets, TagFacet(loc[2], loc[3], tag))
+	}
+	return facets
+}
+
+// addMarkerTag appends tag to the text of record as a hashtag and returns
+// its facet. The marker is left off, returning nil, when there is no tag,
+// the text already ends with it, or it would push the text past the post
+// length limit.
+func addMarkerTag(record map[string]interface{}, tag string) *Facet {
+	if tag == "" {
+		return nil
+	}
+
+	text, _ := record["text"].(string)
+	hashtag := "#" + tag
+	if strings.HasSuffix(text, hashtag) {
+		start := len(text) - len(hashtag)
+		if start == 0 || strings.ContainsAny(text[start-1:start], " \t\n") {
+			facet := TagFacet(start, len(text), tag)
+			return &facet
+		}
+	}
+
+	sep := ""
+	if text != "" {
+		sep = "\n\n"
+	}
+	if graphemeLen(text+sep+hashtag) > maxPostGraphemes {
+		log.Printf("No room for the feed marker tag %s in a %d grapheme post", hashtag, graphemeLen(text))
+		return nil
+	}
+
+	start := len(text) + len(sep)
+	record["text"] = text + sep + hashtag
+	facet := TagFacet(start, start+len(hashtag), tag)
+	return &facet
+}
+
+// withMarkerFacet adds the feed marker facet to facets, trimming the others
+// to leave room for it under the limit. A tag facet already covering the
+// marker is replaced rather than duplicated.
+func withMarkerFacet(facets []Facet, marker Facet, limit facetLimit) []Facet {
+	kept := make([]Facet, 0, len(facets)+1)
+	for _, f := range facets {
+		if f.Index != marker.Index {
+			kept = append(kept, f)
+		}
+	}
+
+	switch {
+	case limit.max == 1:
+		return []Facet{marker}
+	case limit.max > 1:
+		limit.max--
+	}
+	return append(limit.trim(kept), marker)
+}
+
+// validateFacets checks that facets lie within text on character boundaries
+// and don't overlap
+func validateFacets(text string, facets []Facet) error {
+	sorted := make([]Facet, len(facets))
+	copy(sorted, facets)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Index.ByteStart < sorted[j].Index.ByteStart
+	})
+
+	prevEnd := 0
+	for i := range sorted {
+		f := &sorted[i]
+		start, end := f.Index.ByteStart, f.Index.ByteEnd
+
+		switch {
+		case start < 0 || end > len(text) || start >= end:
+			return &FacetError{Facet: f, Reason: fmt.Sprintf("out of range for %d bytes of text", len(text))}
+		case !utf8.RuneStart(text[start]) || (end < len(text) && !utf8.RuneStart(text[end])):
+			return &FacetError{Facet: f, Reason: "splits a character"}
+		case start < prevEnd:
+			return &FacetError{Facet: f, Reason: "overlaps the previous facet"}
+		}
+
+		prevEnd = end
+	}
+
+	return nil
+}
+
+// isInvalidFacet checks an error response for a rejected facet. The PDS
+// reports these as an InvalidRequest whose message points into the record's
+// facets, like "Invalid app.bsky.feed.post record: Record/facets/0/index
+// must have the property "byteEnd"".
+func isInvalidFacet(body []byte) bool {
+	var xrpcErr struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &xrpcErr); err != nil {
+		return false
+	}
+	return xrpcErr.Error == "InvalidRequest" && facetPathPattern.MatchString(xrpcErr.Message)
+}
+
+// GraphemeStarts calls fn with the byte offset of each grapheme in s until
+// it returns false. It approximates how Bluesky counts graphemes: combining
+// marks, variation selectors, skin tone modifiers and joined emoji belong
+// to the character before them, and a pair of regional indicators is one
+// flag.
+func GraphemeStarts(s string, fn func(i int) bool) {
+	joined := false
+	flagHalf := false
+	for i, r := range s {
+		switch {
+		case r == '\u200d':
+			joined = true
+			continue
+		case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r), unicode.Is(unicode.Variation_Selector, r),
+			r >= 0x1f3fb && r <= 0x1f3ff:
+			continue
+		case joined:
+			joined = false
+			continue
+		case r >= 0x1f1e6 && r <= 0x1f1ff:
+			flagHalf = !flagHalf
+			if !flagHalf {
+				continue
+			}
+		default:
+			flagHalf = false
+		}
+		if !fn(i) {
+			return
+		}
+	}
+}
+
+// graphemeLen counts the graphemes of s as GraphemeStarts finds them
+func graphemeLen(s string) int {
+	count := 0
+	GraphemeStarts(s, func(int) bool {
+		count++
+		return true
+	})
+	return count
+}
@@ -0,0 +1,184 @@
+package bluesky
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAddMarkerTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		wantText string
+		wantTag  bool
+	}{
+		{
+			name:     "appended after the text",
+			text:     "Hello world",
+			wantText: "Hello world\n\n#truss",
+			wantTag:  true,
+		},
+		{
+			name:     "empty text",
+			text:     "",
+			wantText: "#truss",
+			wantTag:  true,
+		},
+		{
+			name:     "already ends with the marker",
+			text:     "Hello #truss",
+			wantText: "Hello #truss",
+			wantTag:  true,
+		},
+		{
+			name:     "room counted in graphemes",
+			text:     strings.Repeat("👍🏽", 290),
+			wantText: strings.Repeat("👍🏽", 290) + "\n\n#truss",
+			wantTag:  true,
+		},
+		{
+			name:     "no room left",
+			text:     strings.Repeat("a", 295),
+			wantText: strings.Repeat("a", 295),
+			wantTag:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := map[string]interface{}{"text": tt.text}
+			if err := (PostMeta{markerTag: "truss"}).apply(record, facetLimit{max: defaultMaxFacets}); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			text := record["text"].(string)
+			if text != tt.wantText {
+				t.Errorf("got text %q, want %q", text, tt.wantText)
+			}
+
+			facets, _ := record["facets"].([]Facet)
+			if !tt.wantTag {
+				if len(facets) != 0 {
+					t.Errorf("got %d facets, want none", len(facets))
+				}
+				return
+			}
+			if len(facets) != 1 {
+				t.Fatalf("got %d facets, want 1", len(facets))
+			}
+			f := facets[0]
+			if got := text[f.Index.ByteStart:f.Index.ByteEnd]; got != "#truss" {
+				t.Errorf("facet covers %q, want #truss", got)
+			}
+			if f.Features[0]["$type"] != "app.bsky.richtext.facet#tag" || f.Features[0]["tag"] != "truss" {
+				t.Errorf("got feature %v, want a truss tag", f.Features[0])
+			}
+		})
+	}
+}
+
+func TestMarkerTagWithTagFacets(t *testing.T) {
+	record := map[string]interface{}{"text": "Posting about #go"}
+	meta := PostMeta{TagFacets: true, markerTag: "truss"}
+	if err := meta.apply(record, facetLimit{max: 1, priority: []string{"link", "tag"}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	facets := record["facets"].([]Facet)
+	if len(facets) != 1 || facets[0].Features[0]["tag"] != "truss" {
+		t.Errorf("got facets %v, want only the marker kept", facets)
+	}
+}
+
+func TestIsInvalidFacet(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{
+			name: "facet validation error",
+			body: `{"error":"InvalidRequest","message":"Invalid app.bsky.feed.post record: Record/facets/0/index must have the property \"byteEnd\""}`,
+			want: true,
+		},
+		{
+			name: "other validation error",
+			body: `{"error":"InvalidRequest","message":"Invalid app.bsky.feed.post record: Record/text must not be longer than 300 graphemes"}`,
+			want: false,
+		},
+		{
+			name: "unrelated error mentioning facets",
+			body: `{"error":"InternalServerError","message":"failed to index facets"}`,
+			want: false,
+		},
+		{
+			name: "post text mentioning facets",
+			body: `{"error":"RateLimitExceeded","message":"Rate Limit Exceeded"} facet`,
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isInvalidFacet([]byte(tt.body)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFacetLimitTrim(t *testing.T) {
+	facets := []Facet{
+		TagFacet(0, 4, "one"),
+		LinkFacet(5, 10, "https://a.example"),
+		TagFacet(11, 15, "two"),
+		LinkFacet(16, 21, "https://b.example"),
+		TagFacet(22, 26, "six"),
+	}
+
+	tests := []struct {
+		name  string
+		limit facetLimit
+		want  []int
+	}{
+		{
+			name:  "under the limit",
+			limit: facetLimit{max: 5, priority: []string{"link", "tag"}},
+			want:  []int{0, 5, 11, 16, 22},
+		},
+		{
+			name:  "no limit",
+			limit: facetLimit{priority: []string{"link", "tag"}},
+			want:  []int{0, 5, 11, 16, 22},
+		},
+		{
+			name:  "links first keeps the earliest tag",
+			limit: facetLimit{max: 3, priority: []string{"link", "tag"}},
+			want:  []int{0, 5, 16},
+		},
+		{
+			name:  "tags first drops the links",
+			limit: facetLimit{max: 3, priority: []string{"tag", "link"}},
+			want:  []int{0, 11, 22},
+		},
+		{
+			name:  "unranked kinds go last",
+			limit: facetLimit{max: 2, priority: []string{"tag"}},
+			want:  []int{0, 11},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.limit.trim(facets)
+			var starts []int
+			for _, f := range got {
+				starts = append(starts, f.Index.ByteStart)
+			}
+			if fmt.Sprint(starts) != fmt.Sprint(tt.want) {
+				t.Errorf("got facets at %v, want %v", starts, tt.want)
+			}
+		})
+	}
+}
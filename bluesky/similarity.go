@@ -0,0 +1,48 @@
+package bluesky
+
+import (
+	"strings"
+	"unicode"
+)
+
+// defaultMinSimilarity is how similar a found post's text has to be to the
+// Mastodon post for the content search to accept it
+const defaultMinSimilarity = 0.8
+
+// similarity scores how alike two posts' texts are from 0 to 1, as the Dice
+// coefficient of their words. Bridges cut long posts short, so the longer
+// text is compared only as far as the shorter one goes.
+func similarity(a, b string) float64 {
+	wordsA, wordsB := words(a), words(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	if len(wordsA) > len(wordsB) {
+		wordsA = wordsA[:len(wordsB)]
+	} else {
+		wordsB = wordsB[:len(wordsA)]
+	}
+
+	counts := make(map[string]int)
+	for _, w := range wordsA {
+		counts[w]++
+	}
+
+	shared := 0
+	for _, w := range wordsB {
+		if counts[w] > 0 {
+			counts[w]--
+			shared++
+		}
+	}
+
+	return float64(2*shared) / float64(len(wordsA)+len(wordsB))
+}
+
+// words splits text into lowercase words, dropping punctuation
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,34 @@
+package bluesky
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want float64
+	}{
+		{name: "identical", a: "Off to the shops", b: "Off to the shops", want: 1},
+		{name: "case and punctuation", a: "Off to the shops!", b: "off, to the SHOPS", want: 1},
+		{name: "cut short by a bridge", a: "Off to the shops for some bread and milk", b: "Off to the shops…", want: 1},
+		{name: "one word differs", a: "off to the shops", b: "off to the park", want: 0.75},
+		{name: "word order", a: "shops the to off", b: "off to the shops", want: 1},
+		{name: "nothing shared", a: "off to the shops", b: "good morning everyone", want: 0},
+		{name: "empty", a: "", b: "off to the shops", want: 0},
+		{name: "only punctuation", a: "!!!", b: "...", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := similarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if got := similarity(tt.b, tt.a); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("reversed: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
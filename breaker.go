@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// blueskyError marks a failure to write to Bluesky. Only these count
+// towards the circuit breaker, so a Mastodon or database problem doesn't
+// pause posting.
+type blueskyError struct {
+	err error
+}
+
+func (e *blueskyError) Error() string { return e.err.Error() }
+func (e *blueskyError) Unwrap() error { return e.err }
+
+// isBlueskyError reports whether err is, or wraps, a failure to write to
+// Bluesky
+func isBlueskyError(err error) bool {
+	var bskyErr *blueskyError
+	return errors.As(err, &bskyErr)
+}
+
+// circuitBreaker pauses posting to Bluesky after repeated failures so an
+// outage doesn't burn through every post in a batch
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	state     breakerState
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a Bluesky call should be attempted
+func (cb *circuitBreaker) Allow() bool {
+	if cb.state != breakerOpen {
+		return true
+	}
+
+	if time.Since(cb.openedAt) < cb.cooldown {
+		return false
+	}
+
+	log.Printf("Circuit breaker half-open, trying Bluesky again")
+	cb.state = breakerHalfOpen
+	return true
+}
+
+func (cb *circuitBreaker) RecordSuccess() {
+	if cb.state != breakerClosed {
+		log.Printf("Circuit breaker closed, Bluesky is reachable again")
+	}
+	cb.state = breakerClosed
+	cb.failures = 0
+}
+
+func (cb *circuitBreaker) RecordFailure() {
+	cb.failures++
+
+	switch {
+	case cb.state == breakerHalfOpen:
+		log.Printf("Circuit breaker re-opened, Bluesky is still failing (pausing for %s)", cb.cooldown)
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+	case cb.state == breakerClosed && cb.failures >= cb.threshold:
+		log.Printf("Circuit breaker opened after %d consecutive Bluesky failures (pausing for %s)",
+			cb.failures, cb.cooldown)
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"truss/bluesky"
+	"truss/config"
+	"truss/mastodon"
+)
+
+// runCommand runs a one-off maintenance command instead of the bridge
+func runCommand(cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "diff":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: truss diff <mastodon_id>")
+		}
+		return runDiff(cfg, args[1])
+	case "explain":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: truss explain <mastodon_id>")
+		}
+		return runExplain(cfg, args[1])
+	case "inspect":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: truss inspect <mastodon_id>")
+		}
+		return runInspect(cfg, args[1])
+	case "purge":
+		return runPurge(cfg, args[1:])
+	case "verify-threads":
+		return runVerifyThreads(cfg, args[1:])
+	case "stats":
+		return runStats(cfg, args[1:])
+	case "repair-refs":
+		return runRepairRefs(cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runDiff shows what reprocessing a post would do to its Bluesky thread
+// without touching Bluesky
+func runDiff(cfg *config.Config, mastodonID string) error {
+	ctx := context.Background()
+
+	masto, err := mastodon.NewClient(cfg.Mastodon)
+	if err != nil {
+		return fmt.Errorf("creating Mastodon client: %w", err)
+	}
+
+	account, err := masto.GetAccount(ctx)
+	if err != nil {
+		return fmt.Errorf("getting Mastodon account: %w", err)
+	}
+
+	// Only read from, to look up the parents of replies
+	bsky, err := bluesky.NewClient(cfg.Bluesky)
+	if err != nil {
+		return fmt.Errorf("creating Bluesky client: %w", err)
+	}
+
+	db, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	post, err := masto.GetPostWithEdits(ctx, mastodonID)
+	if err != nil {
+		return fmt.Errorf("fetching post: %w", err)
+	}
+
+	b := &Bridge{
+		mastodon:     masto,
+		bluesky:      bsky,
+		config:       cfg,
+		db:           db,
+		accountID:    string(account.ID),
+		parentMisses: make(map[string]time.Time),
+		parentWaits:  make(map[string]parentWait),
+		dryRun:       true,
+	}
+	return b.diff(ctx, post, os.Stdout)
+}
+
+// diff runs a post through the stages that decide what is posted, and
+// writes out what posting it would do
+func (b *Bridge) diff(ctx context.Context, post *mastodon.Post, w io.Writer) error {
+	pc := &PostContext{
+		Post:        post,
+		Content:     post.Content,
+		ParentDepth: -1,
+	}
+
+	for _, stage := range b.prepareStages() {
+		err := stage(ctx, pc)
+		if errors.Is(err, errParentPending) {
+			fmt.Fprintf(w, "Post %s would wait for our own post %s to be bridged first\n", post.ID, post.InReplyToID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if pc.SkipReason != "" {
+			fmt.Fprintf(w, "Post %s would be skipped (%s): %s\n", post.ID, pc.SkipKind, pc.SkipReason)
+			return nil
+		}
+	}
+
+	if pc.ExistingHash == "" {
+		fmt.Fprintf(w, "Post %s has not been bridged yet\n", post.ID)
+	} else {
+		fmt.Fprintf(w, "Post %s content changed (hash: %s -> %s)\n", post.ID, pc.ExistingHash[:8], pc.ContentHash[:8])
+
+		// A missing mapping just means there is nothing to delete
+		bskyIDs, _ := bridgedRecords(b.db, post.ID)
+		if len(bskyIDs) > 0 {
+			fmt.Fprintf(w, "\nWould delete %d Bluesky records:\n", len(bskyIDs))
+			for _, id := range bskyIDs {
+				fmt.Fprintf(w, "  - %s\n", id)
+			}
+		}
+	}
+
+	if pc.ParentUri != "" {
+		fmt.Fprintf(w, "\nReplying to %s\n", pc.ParentUri)
+	}
+
+	fmt.Fprintf(w, "\nWould create %d Bluesky records:\n", len(pc.Parts))
+	for i, part := range pc.Parts {
+		images := ""
+		if i < len(pc.PartAttachments) && len(pc.PartAttachments[i]) > 0 {
+			images = fmt.Sprintf(", %d images", len(pc.PartAttachments[i]))
+		}
+		fmt.Fprintf(w, "  + [%d/%d, %d chars%s] %s\n", i+1, len(pc.Parts), graphemeLen(part), images, part)
+	}
+	if pc.HashtagReply != "" {
+		fmt.Fprintf(w, "  + [hashtag reply] %s\n", pc.HashtagReply)
+	}
+
+	if pc.Meta.External != nil {
+		fmt.Fprintf(w, "\nWith a link card to %s\n", pc.Meta.External.URI)
+	}
+	if pc.Meta.Quote != nil {
+		fmt.Fprintf(w, "\nQuoting %s\n", pc.Meta.Quote.URI)
+	}
+
+	return nil
+}
+
+// runExplain shows which filter rules a post matches and whether they let
+// it through. Only the rules are evaluated: the later pipeline checks, which
+// need Bluesky or the bridge's state, can still skip a post that passes.
+func runExplain(cfg *config.Config, mastodonID string) error {
+	ctx := context.Background()
+
+	masto, err := mastodon.NewClient(cfg.Mastodon)
+	if err != nil {
+		return fmt.Errorf("creating Mastodon client: %w", err)
+	}
+
+	db, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	post, err := masto.GetPostWithEdits(ctx, mastodonID)
+	if err != nil {
+		return fmt.Errorf("fetching post: %w", err)
+	}
+
+	b := &Bridge{config: cfg, db: db}
+	d := b.evaluateRules(post, post.Content)
+
+	fmt.Printf("Filter rules for post %s:\n", mastodonID)
+	for _, r := range d.Trace {
+		verdict := "pass"
+		if r.Blocked {
+			verdict = "SKIP"
+		}
+		fmt.Printf("  [%s] %-15s %s\n", verdict, r.Rule, r.Detail)
+	}
+
+	if d.Bridge {
+		fmt.Println("\nFilter decision: bridge")
+	} else {
+		fmt.Printf("\nFilter decision: skip (%s)\n", d.Reason)
+	}
+
+	fmt.Println("\nNote: only the filter rules are evaluated here. The pipeline can still skip")
+	fmt.Println("the post later (unchanged or duplicate content, missing reply parent,")
+	fmt.Println("leak guard, empty after cleanup).")
+
+	return nil
+}
+
+// runInspect prints the Bluesky records a post was bridged to, checking
+// each one against what is actually on Bluesky
+func runInspect(cfg *config.Config, mastodonID string) error {
+	ctx := context.Background()
+
+	db, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	bskyIDs, err := db.GetBlueskyIDsForMastodonPost(mastodonID)
+	if err != nil {
+		return fmt.Errorf("post %s has not been bridged: %w", mastodonID, err)
+	}
+
+	bsky, err := bluesky.NewClient(cfg.Bluesky)
+	if err != nil {
+		return fmt.Errorf("creating Bluesky client: %w", err)
+	}
+
+	fmt.Printf("Mastodon post %s -> %d Bluesky records\n", mastodonID, len(bskyIDs))
+
+	var missing int
+	for i, id := range bskyIDs {
+		uri, cid, _ := strings.Cut(id, "|")
+		fmt.Printf("\n[%d/%d] %s\n", i+1, len(bskyIDs), uri)
+		fmt.Printf("  cid:    %s\n", cid)
+
+		record, liveCid, err := bsky.GetRecord(ctx, uri)
+		if errors.Is(err, bluesky.ErrRecordNotFound) {
+			fmt.Println("  status: MISSING on Bluesky")
+			missing++
+			continue
+		}
+		if err != nil {
+			fmt.Printf("  status: error fetching record: %v\n", err)
+			continue
+		}
+
+		if liveCid != cid {
+			fmt.Printf("  status: live, but the CID is now %s\n", liveCid)
+		} else {
+			fmt.Println("  status: live")
+		}
+
+		if reply, ok := record["reply"].(map[string]interface{}); ok {
+			root, _ := reply["root"].(map[string]interface{})
+			parent, _ := reply["parent"].(map[string]interface{})
+			fmt.Printf("  reply:  root %v, parent %v\n", root["uri"], parent["uri"])
+		} else {
+			fmt.Println("  reply:  none (thread root)")
+		}
+
+		text, _ := record["text"].(string)
+		fmt.Printf("  text:   %s\n", truncateForLog(text))
+	}
+
+	if missing > 0 {
+		return fmt.Errorf("%d of %d records are missing on Bluesky", missing, len(bskyIDs))
+	}
+
+	return nil
+}
+
+// runPurge deletes every record truss has posted to Bluesky and forgets
+// the mappings, for when bridging is being shut down for good
+func runPurge(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	db, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	ids, err := db.GetBridgedPostIDs()
+	if err != nil {
+		return fmt.Errorf("listing bridged posts: %w", err)
+	}
+
+	if len(ids) == 0 {
+		fmt.Println("Nothing has been bridged, nothing to purge")
+		return nil
+	}
+
+	if !*yes {
+		fmt.Printf("This deletes the Bluesky posts for %d bridged Mastodon posts. Type \"yes\" to continue: ", len(ids))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			return fmt.Errorf("purge cancelled")
+		}
+	}
+
+	bsky, err := bluesky.NewClient(cfg.Bluesky)
+	if err != nil {
+		return fmt.Errorf("creating Bluesky client: %w", err)
+	}
+
+	var deleted, failed, purged int
+	for _, id := range ids {
+		bskyIDs, err := bridgedRecords(db, id)
+		if err != nil {
+			fmt.Printf("%s: error reading mapping: %v\n", id, err)
+			failed++
+			continue
+		}
+
+		ok := true
+		for _, bskyID := range bskyIDs {
+			// Deleting a record that's already gone succeeds, so only
+			// real failures end up here
+			if err := bsky.DeletePost(ctx, bskyID); err != nil {
+				fmt.Printf("%s: error deleting %s: %v\n", id, bskyID, err)
+				failed++
+				ok = false
+				continue
+			}
+			deleted++
+		}
+
+		// Keep the mapping of anything that failed so purge can be rerun
+		if !ok {
+			continue
+		}
+
+		if err := db.DeletePostMapping(id); err != nil {
+			fmt.Printf("%s: error deleting mapping: %v\n", id, err)
+			continue
+		}
+		purged++
+	}
+
+	fmt.Printf("\nDeleted %d Bluesky records for %d of %d posts, %d failures\n",
+		deleted, purged, len(ids), failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d records could not be deleted, run purge again to retry", failed)
+	}
+
+	return nil
+}
+
+// runVerifyThreads checks that every bridged thread has consistent reply
+// refs, optionally rewriting the broken records in place
+func runVerifyThreads(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("verify-threads", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "Rewrite records with inconsistent reply refs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	bsky, err := bluesky.NewClient(cfg.Bluesky)
+	if err != nil {
+		return fmt.Errorf("creating Bluesky client: %w", err)
+	}
+
+	db, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	ids, err := db.GetBridgedPostIDs()
+	if err != nil {
+		return fmt.Errorf("listing bridged posts: %w", err)
+	}
+
+	var broken, fixed int
+	for _, id := range ids {
+		bskyIDs, err := db.GetBlueskyIDsForMastodonPost(id)
+		if err != nil {
+			fmt.Printf("%s: error reading mapping: %v\n", id, err)
+			continue
+		}
+
+		b, f, changed := verifyThread(ctx, bsky, id, bskyIDs, *fix)
+		broken += b
+		fixed += f
+
+		if changed {
+			if err := db.UpdatePostMapping(id, bskyIDs); err != nil {
+				fmt.Printf("%s: error saving fixed mapping: %v\n", id, err)
+			}
+		}
+	}
+
+	fmt.Printf("\nChecked %d bridged posts: %d inconsistent records, %d fixed\n", len(ids), broken, fixed)
+	return nil
+}
+
+// verifyThread checks the reply refs of one bridged post's records. Fixed
+// records get new CIDs, which are written back into bskyIDs.
+func verifyThread(ctx context.Context, bsky *bluesky.Client, mastodonID string, bskyIDs []string, fix bool) (int, int, bool) {
+	var broken, fixed int
+	var changed bool
+	var root bluesky.StrongRef
+	var prev bluesky.StrongRef
+
+	for i, id := range bskyIDs {
+		parts := strings.Split(id, "|")
+		if len(parts) != 2 {
+			fmt.Printf("%s: malformed record ref %q\n", mastodonID, id)
+			return broken, fixed, changed
+		}
+		ref := bluesky.StrongRef{URI: parts[0], CID: parts[1]}
+
+		// Reposts don't have reply refs
+		if !strings.Contains(ref.URI, "/app.bsky.feed.post/") {
+			return broken, fixed, changed
+		}
+
+		reply, err := bsky.GetRecordReply(ctx, ref.URI)
+		if err != nil {
+			fmt.Printf("%s: error fetching %s: %v\n", mastodonID, ref.URI, err)
+			return broken, fixed, changed
+		}
+
+		var want bluesky.ReplyRef
+		if i == 0 {
+			if reply == nil {
+				// The first record starts a new thread
+				root = ref
+				prev = ref
+				continue
+			}
+
+			rootURI, rootCID := threadRoot(ctx, bsky, reply.Parent.URI, reply.Parent.CID)
+			root = bluesky.StrongRef{URI: rootURI, CID: rootCID}
+			want = bluesky.ReplyRef{Root: root, Parent: reply.Parent}
+		} else {
+			want = bluesky.ReplyRef{Root: root, Parent: prev}
+		}
+
+		if reply != nil && *reply == want {
+			prev = ref
+			continue
+		}
+
+		broken++
+		fmt.Printf("%s: record %d (%s) has inconsistent reply refs\n", mastodonID, i+1, ref.URI)
+		if reply != nil {
+			fmt.Printf("    root:   %s (want %s)\n", reply.Root.URI, want.Root.URI)
+			fmt.Printf("    parent: %s (want %s)\n", reply.Parent.URI, want.Parent.URI)
+		}
+
+		if fix {
+			record, _, err := bsky.GetRecord(ctx, ref.URI)
+			if err != nil {
+				fmt.Printf("    error fetching record to fix: %v\n", err)
+				return broken, fixed, changed
+			}
+
+			record["reply"] = want
+			result, err := bsky.UpdatePost(ctx, ref.URI, record)
+			if err != nil {
+				fmt.Printf("    error fixing record: %v\n", err)
+				return broken, fixed, changed
+			}
+
+			fmt.Printf("    fixed\n")
+			fixed++
+			changed = true
+			bskyIDs[i] = result
+
+			// Later records must point at the new CID
+			if resultParts := strings.Split(result, "|"); len(resultParts) == 2 {
+				ref = bluesky.StrongRef{URI: resultParts[0], CID: resultParts[1]}
+			}
+		}
+
+		prev = ref
+	}
+
+	return broken, fixed, changed
+}
+
+// runRepairRefs checks that every stored Bluesky ref is a well-formed
+// uri|cid. With --fix, a ref missing its CID gets the record's current one
+// from Bluesky, and refs to records that are gone or that can't be parsed
+// at all are dropped.
+func runRepairRefs(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("repair-refs", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "Repair or drop the malformed refs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	bsky, err := bluesky.NewClient(cfg.Bluesky)
+	if err != nil {
+		return fmt.Errorf("creating Bluesky client: %w", err)
+	}
+
+	db, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	ids, err := db.GetBridgedPostIDs()
+	if err != nil {
+		return fmt.Errorf("listing bridged posts: %w", err)
+	}
+
+	var malformed, repaired, dropped int
+	for _, id := range ids {
+		bskyIDs, err := db.GetBlueskyIDsForMastodonPost(id)
+		if err != nil {
+			fmt.Printf("%s: error reading mapping: %v\n", id, err)
+			continue
+		}
+
+		var kept []string
+		changed, pending := false, false
+		for _, ref := range bskyIDs {
+			if _, err := bluesky.ParseStrongRef(ref); err == nil {
+				kept = append(kept, ref)
+				continue
+			}
+
+			malformed++
+			fmt.Printf("%s: malformed ref %q\n", id, ref)
+			if !*fix {
+				continue
+			}
+
+			uri, _, _ := strings.Cut(ref, "|")
+			if _, err := bluesky.PostURL(uri); err != nil {
+				changed = true
+				dropped++
+				fmt.Printf("%s: dropped, the URI can't be parsed\n", id)
+				continue
+			}
+
+			_, cid, err := bsky.GetRecord(ctx, uri)
+			switch {
+			case err == nil && cid != "":
+				changed = true
+				kept = append(kept, uri+"|"+cid)
+				repaired++
+				fmt.Printf("%s: repaired as %s|%s\n", id, uri, cid)
+			case errors.Is(err, bluesky.ErrRecordNotFound):
+				changed = true
+				dropped++
+				fmt.Printf("%s: dropped, the record is gone\n", id)
+			default:
+				// Leave the mapping for the next run rather than lose the
+				// ref to a passing error
+				pending = true
+				fmt.Printf("%s: error looking up %s: %v\n", id, uri, err)
+			}
+		}
+
+		if changed && !pending {
+			if err := db.UpdatePostMapping(id, kept); err != nil {
+				fmt.Printf("%s: error saving repaired mapping: %v\n", id, err)
+			}
+		}
+	}
+
+	fmt.Printf("\nChecked %d bridged posts: %d malformed refs, %d repaired, %d dropped\n",
+		len(ids), malformed, repaired, dropped)
+	return nil
+}
+
+// runStats reports how the most recently bridged posts are doing on
+// Mastodon
+func runStats(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	count := fs.Int("n", 20, "How many of the most recently bridged posts to report on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	masto, err := mastodon.NewClient(cfg.Mastodon)
+	if err != nil {
+		return fmt.Errorf("creating Mastodon client: %w", err)
+	}
+
+	db, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	ids, err := db.GetRecentPostsToCheckForEdits(*count, time.Time{})
+	if err != nil {
+		return fmt.Errorf("listing bridged posts: %w", err)
+	}
+
+	var favourites, reblogs int64
+	for _, id := range ids {
+		post, err := masto.GetPostWithEdits(ctx, id)
+		if err != nil {
+			fmt.Printf("%s: error getting post: %v\n", id, err)
+			continue
+		}
+
+		fmt.Printf("%s: %d favourites, %d boosts  %s\n", id, post.FavouritesCount, post.ReblogsCount,
+			truncateForLog(post.Content))
+		favourites += post.FavouritesCount
+		reblogs += post.ReblogsCount
+	}
+
+	fmt.Printf("\n%d bridged posts: %d favourites, %d boosts\n", len(ids), favourites, reblogs)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"truss/config"
+	"truss/mastodon"
+)
+
+func TestDiffRunsThePipeline(t *testing.T) {
+	b := newTestBridge(t, &config.Config{
+		StripControlChars:   true,
+		TrailingHashtagMode: "reply",
+		PrefixByType:        config.PrefixByType{Original: "🤖"},
+	})
+	pds := newFakePDS(t, b)
+	b.dryRun = true
+
+	pds.records["1"] = map[string]interface{}{"text": "hello"}
+	if err := b.db.SavePostMapping("1", []string{"at://did:plc:me/app.bsky.feed.post/1|cid0"}, time.Now()); err != nil {
+		t.Fatalf("saving mapping: %v", err)
+	}
+	oldHash := postHash("hello", "", nil, "")
+	if err := b.db.SaveContentHash("1", oldHash); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "edited",
+			content: "hello\u200b world\n\n#tag",
+			want: []string{
+				"Would delete 1 Bluesky records",
+				"at://did:plc:me/app.bsky.feed.post/1|cid0",
+				"Would create 1 Bluesky records",
+				"] 🤖 hello world\n",
+				"[hashtag reply] #tag",
+			},
+		},
+		{
+			name:    "unchanged",
+			content: "hello",
+			want:    []string{"would be skipped (unchanged)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			post := &mastodon.Post{ID: "1", Content: tt.content, Visibility: "public"}
+			if err := b.diff(context.Background(), post, &out); err != nil {
+				t.Fatalf("diff: %v", err)
+			}
+
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("got output:\n%s\nwant it to contain %q", out.String(), want)
+				}
+			}
+		})
+	}
+
+	// Nothing is actually changed
+	if pds.writes != 0 {
+		t.Errorf("made %d Bluesky writes, want none", pds.writes)
+	}
+	if hash, err := b.db.GetContentHash("1"); err != nil || hash != oldHash {
+		t.Errorf("got hash %q (%v), want it left alone", hash, err)
+	}
+}
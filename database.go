@@ -2,24 +2,92 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
 	"strings"
 	"time"
 
+	"truss/bluesky"
+
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Database is a Store on SQLite or Postgres. Queries are written with ?
+// placeholders and in the SQL both understand, and rebound for Postgres.
 type Database struct {
 	db *sql.DB
+
+	// postgres is set for a Postgres database
+	postgres bool
+
+	// writes serializes writes with any other Database on the same
+	// database in this process, waiting at most writeTimeout. Other
+	// processes are waited for through the database's own lock.
+	writes       *writeGate
+	writeTimeout time.Duration
+}
+
+// inMemoryPath keeps the database in memory, for tests and ephemeral runs.
+// Nothing survives a restart, so every run starts from scratch.
+const inMemoryPath = ":memory:"
+
+func NewDatabase(path string, writeTimeout time.Duration) (*Database, error) {
+	// Writes take SQLite's write lock when their transaction begins, and
+	// wait out one held by another process up to the same timeout
+	dsn := path
+	if path != inMemoryPath {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		dsn += fmt.Sprintf("%s_busy_timeout=%d&_txlock=immediate", sep, writeTimeout.Milliseconds())
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every connection to :memory: opens a new, empty database, so all
+	// queries have to share the one connection
+	if path == inMemoryPath {
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+
+	d := &Database{db: db, writes: writeGateFor(path), writeTimeout: writeTimeout}
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
 }
 
-func NewDatabase(path string) (*Database, error) {
-	db, err := sql.Open("sqlite3", path)
+// NewPostgresDatabase connects to a Postgres database
+func NewPostgresDatabase(url string, writeTimeout time.Duration) (*Database, error) {
+	db, err := sql.Open("postgres", url)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create tables if they don't exist
-	_, err = db.Exec(`
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("connecting to Postgres: %w", err)
+	}
+
+	d := &Database{db: db, postgres: true, writes: writeGateFor(url), writeTimeout: writeTimeout}
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// init creates the tables if they don't exist and migrates them
+func (d *Database) init() error {
+	_, err := d.db.Exec(`
 		CREATE TABLE IF NOT EXISTS post_mappings (
 			mastodon_id TEXT PRIMARY KEY,
 			bluesky_ids TEXT NOT NULL,
@@ -34,28 +102,221 @@ func NewDatabase(path string) (*Database, error) {
 			key TEXT PRIMARY KEY,
 			value TEXT NOT NULL
 		);
+		CREATE TABLE IF NOT EXISTS pending_posts (
+			mastodon_id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS media_blobs (
+			media_id TEXT PRIMARY KEY,
+			blob TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
 	`)
+	if err != nil {
+		return err
+	}
+
+	if err := d.migrate(); err != nil {
+		return fmt.Errorf("migrating database: %w", err)
+	}
+
+	return nil
+}
+
+// migrations upgrade databases created by older versions. The schema version
+// is kept in SQLite's user_version, or in the state table on Postgres, and
+// each entry moves it up by one, so new migrations must only ever be
+// appended.
+var migrations = []string{
+	// 1: when the source post was created, as opposed to bridged
+	"ALTER TABLE post_mappings ADD COLUMN source_created_at TIMESTAMP",
+
+	// 2: how many times a queued post has failed
+	"ALTER TABLE pending_posts ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0",
+}
+
+// migrate applies the migrations a database hasn't had yet
+func (d *Database) migrate() error {
+	version, err := d.schemaVersion()
+	if err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := d.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		if d.postgres {
+			_, err = tx.Exec(d.rebind("INSERT INTO state (key, value) VALUES ('schema_version', ?) "+
+				"ON CONFLICT (key) DO UPDATE SET value = excluded.value"), strconv.Itoa(i+1))
+		} else {
+			// PRAGMA doesn't take parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// schemaVersion returns how many migrations the database has had
+func (d *Database) schemaVersion() (int, error) {
+	if !d.postgres {
+		var version int
+		err := d.db.QueryRow("PRAGMA user_version").Scan(&version)
+		return version, err
+	}
+
+	var value string
+	err := d.db.QueryRow("SELECT value FROM state WHERE key = 'schema_version'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// rebind turns the ? placeholders in a query into Postgres' $1, $2, ...
+func (d *Database) rebind(query string) string {
+	if !d.postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (d *Database) exec(query string, args ...interface{}) (sql.Result, error) {
+	leave, err := d.writes.enter(d.writeTimeout)
 	if err != nil {
 		return nil, err
 	}
+	defer leave()
+
+	// The gate only orders this process's writes. Bridges in other
+	// processes take turns through the database's write lock, which each
+	// write holds for its transaction: SQLite's, taken as the transaction
+	// begins and waited for up to the busy timeout, or on Postgres an
+	// advisory lock, whose waiters are let through in order.
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("waiting for database write: %w", err)
+	}
+	defer tx.Rollback()
 
-	return &Database{db: db}, nil
+	if d.postgres {
+		// SET doesn't take parameters
+		if _, err := tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", d.writeTimeout.Milliseconds())); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", writeLockKey); err != nil {
+			return nil, fmt.Errorf("waiting for database write: %w", err)
+		}
+	}
+
+	result, err := tx.Exec(d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (d *Database) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.db.Query(d.rebind(query), args...)
+}
+
+func (d *Database) queryRow(query string, args ...interface{}) *sql.Row {
+	return d.db.QueryRow(d.rebind(query), args...)
+}
+
+// setState sets a key in the state table
+func (d *Database) setState(key, value string) error {
+	_, err := d.exec(
+		"INSERT INTO state (key, value) VALUES (?, ?) "+
+			"ON CONFLICT (key) DO UPDATE SET value = excluded.value",
+		key, value,
+	)
+	return err
 }
 
-func (d *Database) SavePostMapping(mastodonID string, bskyIDs []string) error {
+func (d *Database) SavePostMapping(mastodonID string, bskyIDs []string, sourceCreatedAt time.Time) error {
+	if err := validateRefs(bskyIDs); err != nil {
+		return err
+	}
+
 	// Join all bluesky IDs with a comma
 	idsStr := strings.Join(bskyIDs, ",")
 
-	_, err := d.db.Exec(
-		"INSERT OR REPLACE INTO post_mappings (mastodon_id, bluesky_ids) VALUES (?, ?)",
-		mastodonID, idsStr,
+	_, err := d.exec(
+		"INSERT INTO post_mappings (mastodon_id, bluesky_ids, source_created_at) VALUES (?, ?, ?) "+
+			"ON CONFLICT (mastodon_id) DO UPDATE SET bluesky_ids = excluded.bluesky_ids, "+
+			"source_created_at = excluded.source_created_at, created_at = CURRENT_TIMESTAMP",
+		mastodonID, idsStr, sourceCreatedAt.UTC(),
+	)
+	return err
+}
+
+// GetSourceCreatedAt returns when the Mastodon post was created, or the zero
+// time for posts bridged before this was recorded
+func (d *Database) GetSourceCreatedAt(mastodonID string) (time.Time, error) {
+	var createdAt sql.NullTime
+	err := d.queryRow(
+		"SELECT source_created_at FROM post_mappings WHERE mastodon_id = ?",
+		mastodonID,
+	).Scan(&createdAt)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return createdAt.Time, nil
+}
+
+// UpdatePostMapping replaces the Bluesky IDs for a post without resetting
+// when it was first bridged
+func (d *Database) UpdatePostMapping(mastodonID string, bskyIDs []string) error {
+	if err := validateRefs(bskyIDs); err != nil {
+		return err
+	}
+
+	_, err := d.exec(
+		"UPDATE post_mappings SET bluesky_ids = ? WHERE mastodon_id = ?",
+		strings.Join(bskyIDs, ","), mastodonID,
 	)
 	return err
 }
 
 func (d *Database) GetBlueskyIDsForMastodonPost(mastodonID string) ([]string, error) {
 	var idsStr string
-	err := d.db.QueryRow(
+	err := d.queryRow(
 		"SELECT bluesky_ids FROM post_mappings WHERE mastodon_id = ?",
 		mastodonID,
 	).Scan(&idsStr)
@@ -64,7 +325,31 @@ func (d *Database) GetBlueskyIDsForMastodonPost(mastodonID string) ([]string, er
 		return nil, err
 	}
 
-	return strings.Split(idsStr, ","), nil
+	// strings.Split would turn an empty value into a single empty ID
+	var ids []string
+	for _, id := range strings.Split(idsStr, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if _, err := bluesky.ParseStrongRef(id); err != nil {
+			log.Printf("WARNING: Post %s has a malformed Bluesky ref, run \"truss repair-refs\": %v", mastodonID, err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// validateRefs checks that every Bluesky ref about to be stored is a
+// well-formed uri|cid, since a bad one breaks edits and replies later
+func validateRefs(bskyIDs []string) error {
+	for _, id := range bskyIDs {
+		if _, err := bluesky.ParseStrongRef(id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (d *Database) CheckIfEdit(mastodonID string, originalID string) (string, bool) {
@@ -77,7 +362,7 @@ func (d *Database) CheckIfEdit(mastodonID string, originalID string) (string, bo
 
 	// Check our database for known edits
 	var origID string
-	err := d.db.QueryRow(
+	err := d.queryRow(
 		"SELECT original_id FROM edits WHERE edit_id = ?",
 		mastodonID,
 	).Scan(&origID)
@@ -90,8 +375,9 @@ func (d *Database) CheckIfEdit(mastodonID string, originalID string) (string, bo
 }
 
 func (d *Database) MarkAsEdit(editID, origID string) error {
-	_, err := d.db.Exec(
-		"INSERT OR REPLACE INTO edits (edit_id, original_id) VALUES (?, ?)",
+	_, err := d.exec(
+		"INSERT INTO edits (edit_id, original_id) VALUES (?, ?) "+
+			"ON CONFLICT (edit_id) DO UPDATE SET original_id = excluded.original_id, created_at = CURRENT_TIMESTAMP",
 		editID, origID,
 	)
 	return err
@@ -99,7 +385,7 @@ func (d *Database) MarkAsEdit(editID, origID string) error {
 
 func (d *Database) GetLastSeenID() (string, error) {
 	var id string
-	err := d.db.QueryRow(
+	err := d.queryRow(
 		"SELECT value FROM state WHERE key = 'last_seen_id'",
 	).Scan(&id)
 
@@ -114,19 +400,47 @@ func (d *Database) GetLastSeenID() (string, error) {
 }
 
 func (d *Database) SaveLastSeenID(id string) error {
-	_, err := d.db.Exec(
-		"INSERT OR REPLACE INTO state (key, value) VALUES ('last_seen_id', ?)",
-		id,
-	)
-	return err
+	return d.setState("last_seen_id", id)
 }
 
 func (d *Database) Close() error {
 	return d.db.Close()
 }
 
+// GetPostsCreatedBefore lists bridged posts whose source post was created
+// before t. Posts bridged before creation times were recorded are left out.
+func (d *Database) GetPostsCreatedBefore(t time.Time) ([]string, error) {
+	rows, err := d.query(
+		"SELECT mastodon_id FROM post_mappings WHERE source_created_at IS NOT NULL AND source_created_at < ?",
+		t.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (d *Database) DeletePostMapping(mastodonID string) error {
+	if _, err := d.exec("DELETE FROM post_mappings WHERE mastodon_id = ?", mastodonID); err != nil {
+		return err
+	}
+	_, err := d.exec("DELETE FROM state WHERE key IN (?, ?)", "hashtag_reply_"+mastodonID, "open_poll_"+mastodonID)
+	return err
+}
+
 func (d *Database) GetBridgedPostIDs() ([]string, error) {
-	rows, err := d.db.Query("SELECT DISTINCT mastodon_id FROM post_mappings")
+	rows, err := d.query("SELECT DISTINCT mastodon_id FROM post_mappings")
 	if err != nil {
 		return nil, err
 	}
@@ -144,9 +458,22 @@ func (d *Database) GetBridgedPostIDs() ([]string, error) {
 	return ids, nil
 }
 
+// CountPostMappings counts the bridged posts, only those created on
+// Mastodon since the given time unless it is zero
+func (d *Database) CountPostMappings(since time.Time) (int, error) {
+	var count int
+	var err error
+	if since.IsZero() {
+		err = d.queryRow("SELECT COUNT(*) FROM post_mappings").Scan(&count)
+	} else {
+		err = d.queryRow("SELECT COUNT(*) FROM post_mappings WHERE source_created_at >= ?", since.UTC()).Scan(&count)
+	}
+	return count, err
+}
+
 func (d *Database) GetLastCheckTime() (time.Time, error) {
 	var timeStr string
-	err := d.db.QueryRow("SELECT value FROM state WHERE key = 'last_edit_check'").Scan(&timeStr)
+	err := d.queryRow("SELECT value FROM state WHERE key = 'last_edit_check'").Scan(&timeStr)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return time.Time{}, nil
@@ -163,18 +490,21 @@ func (d *Database) GetLastCheckTime() (time.Time, error) {
 }
 
 func (d *Database) SaveLastCheckTime(t time.Time) error {
-	_, err := d.db.Exec(
-		"INSERT OR REPLACE INTO state (key, value) VALUES ('last_edit_check', ?)",
-		t.Format(time.RFC3339),
-	)
-	return err
+	return d.setState("last_edit_check", t.Format(time.RFC3339))
 }
 
-func (d *Database) GetRecentPostsToCheckForEdits(maxCount int) ([]string, error) {
-	rows, err := d.db.Query(
-		"SELECT mastodon_id FROM post_mappings ORDER BY created_at DESC LIMIT ?",
-		maxCount,
-	)
+// GetRecentPostsToCheckForEdits returns the maxCount most recently bridged
+// posts. If since isn't zero, only posts created on Mastodon after it are
+// returned, which leaves out those bridged before that was recorded.
+func (d *Database) GetRecentPostsToCheckForEdits(maxCount int, since time.Time) ([]string, error) {
+	query := "SELECT mastodon_id FROM post_mappings ORDER BY created_at DESC LIMIT ?"
+	args := []interface{}{maxCount}
+	if !since.IsZero() {
+		query = "SELECT mastodon_id FROM post_mappings WHERE source_created_at >= ? ORDER BY created_at DESC LIMIT ?"
+		args = []interface{}{since.UTC(), maxCount}
+	}
+
+	rows, err := d.query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -192,18 +522,65 @@ func (d *Database) GetRecentPostsToCheckForEdits(maxCount int) ([]string, error)
 	return ids, nil
 }
 
+// FindRecentHash returns a post other than excludeID whose content hash is
+// hash and whose source post was created within window of createdAt, or ""
+// if there is none. This is the only place hashes of different posts are
+// compared; everywhere else a hash is only ever checked against the one
+// saved for the same post. Posts bridged before creation times were
+// recorded never match.
+func (d *Database) FindRecentHash(hash string, createdAt time.Time, window time.Duration, excludeID string) (string, error) {
+	var id string
+	err := d.queryRow(`
+		SELECT m.mastodon_id FROM post_mappings m
+		JOIN state s ON s.key = 'content_hash_' || m.mastodon_id
+		WHERE s.value = ? AND m.mastodon_id != ?
+		AND m.source_created_at >= ? AND m.source_created_at <= ?
+		ORDER BY m.source_created_at DESC LIMIT 1`,
+		hash, excludeID, createdAt.Add(-window).UTC(), createdAt.Add(window).UTC(),
+	).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, err
+}
+
+// PruneEditState deletes the edit-detection state (content hashes, content
+// warnings, edit times and media hashes) of posts bridged longer ago than age, except the
+// keepRecent most recent posts, which are still checked for edits. Mappings
+// are kept, since replies still need them to find their parent.
+func (d *Database) PruneEditState(age time.Duration, keepRecent int) (int64, error) {
+	result, err := d.exec(`
+		DELETE FROM state WHERE key IN (
+			SELECT prefix.value || m.mastodon_id
+			FROM post_mappings m, (
+				SELECT 'content_hash_' AS value
+				UNION ALL SELECT 'spoiler_'
+				UNION ALL SELECT 'edit_time_'
+				UNION ALL SELECT 'media_hash_'
+			) prefix
+			WHERE m.created_at < ?
+			AND m.mastodon_id NOT IN (
+				SELECT mastodon_id FROM post_mappings ORDER BY created_at DESC LIMIT ?
+			)
+		)`,
+		time.Now().Add(-age).UTC(), keepRecent,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
 // Add this to track the last edit time for a post
 func (d *Database) SaveLastEditTime(postID string, editTime time.Time) error {
-	_, err := d.db.Exec(
-		"INSERT OR REPLACE INTO state (key, value) VALUES (?, ?)",
-		"edit_time_"+postID, editTime.Format(time.RFC3339),
-	)
-	return err
+	return d.setState("edit_time_"+postID, editTime.Format(time.RFC3339))
 }
 
 func (d *Database) GetLastEditTime(postID string) (time.Time, error) {
 	var timeStr string
-	err := d.db.QueryRow(
+	err := d.queryRow(
 		"SELECT value FROM state WHERE key = ?",
 		"edit_time_"+postID,
 	).Scan(&timeStr)
@@ -224,16 +601,15 @@ func (d *Database) GetLastEditTime(postID string) (time.Time, error) {
 }
 
 func (d *Database) SaveContentHash(postID string, contentHash string) error {
-	_, err := d.db.Exec(
-		"INSERT OR REPLACE INTO state (key, value) VALUES (?, ?)",
-		"content_hash_"+postID, contentHash,
-	)
-	return err
+	return d.setState("content_hash_"+postID, contentHash)
 }
 
+// GetContentHash returns the content hash saved for this post, or "" if
+// there is none. Different posts with the same text have the same hash, so
+// it is only meaningful compared with the same post's hash.
 func (d *Database) GetContentHash(postID string) (string, error) {
 	var hash string
-	err := d.db.QueryRow(
+	err := d.queryRow(
 		"SELECT value FROM state WHERE key = ?",
 		"content_hash_"+postID,
 	).Scan(&hash)
@@ -247,3 +623,290 @@ func (d *Database) GetContentHash(postID string) (string, error) {
 
 	return hash, nil
 }
+
+func (d *Database) SaveMediaBlob(mediaID string, blob string) error {
+	_, err := d.exec(
+		"INSERT INTO media_blobs (media_id, blob) VALUES (?, ?) "+
+			"ON CONFLICT (media_id) DO UPDATE SET blob = excluded.blob, created_at = CURRENT_TIMESTAMP",
+		mediaID, blob,
+	)
+	return err
+}
+
+func (d *Database) GetMediaBlob(mediaID string) (string, error) {
+	var blob string
+	err := d.queryRow(
+		"SELECT blob FROM media_blobs WHERE media_id = ?",
+		mediaID,
+	).Scan(&blob)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return blob, nil
+}
+
+func (d *Database) DeleteMediaBlob(mediaID string) error {
+	_, err := d.exec("DELETE FROM media_blobs WHERE media_id = ?", mediaID)
+	return err
+}
+
+func (d *Database) QueuePendingPost(mastodonID string) error {
+	_, err := d.exec(
+		"INSERT INTO pending_posts (mastodon_id) VALUES (?) ON CONFLICT (mastodon_id) DO NOTHING",
+		mastodonID,
+	)
+	return err
+}
+
+func (d *Database) GetPendingPosts() ([]string, error) {
+	rows, err := d.query("SELECT mastodon_id FROM pending_posts ORDER BY created_at, mastodon_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// RecordFailedAttempt queues a post that failed to bridge, if it isn't
+// already, and returns how many times it has failed
+func (d *Database) RecordFailedAttempt(mastodonID string) (int, error) {
+	_, err := d.exec(`
+		INSERT INTO pending_posts (mastodon_id, attempts) VALUES (?, 1)
+		ON CONFLICT (mastodon_id) DO UPDATE SET attempts = pending_posts.attempts + 1`,
+		mastodonID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var attempts int
+	err = d.queryRow(
+		"SELECT attempts FROM pending_posts WHERE mastodon_id = ?",
+		mastodonID,
+	).Scan(&attempts)
+
+	return attempts, err
+}
+
+func (d *Database) RemovePendingPost(mastodonID string) error {
+	_, err := d.exec("DELETE FROM pending_posts WHERE mastodon_id = ?", mastodonID)
+	return err
+}
+
+func (d *Database) SaveSpoilerText(postID string, spoilerText string) error {
+	return d.setState("spoiler_"+postID, spoilerText)
+}
+
+func (d *Database) GetSpoilerText(postID string) (string, error) {
+	var spoilerText string
+	err := d.queryRow(
+		"SELECT value FROM state WHERE key = ?",
+		"spoiler_"+postID,
+	).Scan(&spoilerText)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return spoilerText, nil
+}
+
+// SaveMediaHash records the hash of a post without its alt text, so an edit
+// that only changed the alt text can be told apart
+func (d *Database) SaveMediaHash(postID string, hash string) error {
+	return d.setState("media_hash_"+postID, hash)
+}
+
+// GetMediaHash returns the hash saved by SaveMediaHash, or "" if there is
+// none
+func (d *Database) GetMediaHash(postID string) (string, error) {
+	var hash string
+	err := d.queryRow(
+		"SELECT value FROM state WHERE key = ?",
+		"media_hash_"+postID,
+	).Scan(&hash)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// SaveReplyDepth records how deep in its Bluesky reply chain the last
+// record of a bridged post is, with the root at depth 0
+func (d *Database) SaveReplyDepth(postID string, depth int) error {
+	return d.setState("reply_depth_"+postID, strconv.Itoa(depth))
+}
+
+// GetReplyDepth returns the depth saved by SaveReplyDepth, or 0 if none was
+func (d *Database) GetReplyDepth(postID string) (int, error) {
+	var value string
+	err := d.queryRow(
+		"SELECT value FROM state WHERE key = ?",
+		"reply_depth_"+postID,
+	).Scan(&value)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return strconv.Atoi(value)
+}
+
+func (d *Database) MarkSkipped(postID string) error {
+	return d.setState("skipped_"+postID, time.Now().Format(time.RFC3339))
+}
+
+// MarkFailed records that a post was given up on after failing too often
+func (d *Database) MarkFailed(postID string) error {
+	return d.setState("failed_"+postID, time.Now().Format(time.RFC3339))
+}
+
+func (d *Database) MarkFavourited(postID string) error {
+	return d.setState("favourited_"+postID, "1")
+}
+
+func (d *Database) IsFavourited(postID string) (bool, error) {
+	var value string
+	err := d.queryRow(
+		"SELECT value FROM state WHERE key = ?",
+		"favourited_"+postID,
+	).Scan(&value)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SaveMilestone records the highest favourite milestone a post has reached
+func (d *Database) SaveMilestone(postID string, favourites int) error {
+	return d.setState("milestone_"+postID, strconv.Itoa(favourites))
+}
+
+// GetMilestone returns the milestone saved by SaveMilestone, or 0 if none was
+func (d *Database) GetMilestone(postID string) (int, error) {
+	var value string
+	err := d.queryRow(
+		"SELECT value FROM state WHERE key = ?",
+		"milestone_"+postID,
+	).Scan(&value)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(value)
+}
+
+// MarkPollAnnounced records that a poll's results were posted, and stops
+// tracking it as open
+func (d *Database) MarkPollAnnounced(postID string) error {
+	if err := d.setState("poll_announced_"+postID, time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return d.ForgetOpenPoll(postID)
+}
+
+// TrackOpenPoll records that a bridged post has a poll closing at expiresAt,
+// so its results can be announced however many posts come after it
+func (d *Database) TrackOpenPoll(postID string, expiresAt time.Time) error {
+	return d.setState("open_poll_"+postID, expiresAt.UTC().Format(time.RFC3339))
+}
+
+// GetOpenPolls returns when each poll tracked by TrackOpenPoll closes, by
+// post ID
+func (d *Database) GetOpenPolls() (map[string]time.Time, error) {
+	rows, err := d.query("SELECT key, value FROM state WHERE key LIKE 'open_poll_%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	polls := make(map[string]time.Time)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Printf("Ignoring open poll %s with invalid expiry %q", key, value)
+			continue
+		}
+		polls[strings.TrimPrefix(key, "open_poll_")] = expiresAt
+	}
+
+	return polls, rows.Err()
+}
+
+// ForgetOpenPoll stops tracking a poll
+func (d *Database) ForgetOpenPoll(postID string) error {
+	_, err := d.exec("DELETE FROM state WHERE key = ?", "open_poll_"+postID)
+	return err
+}
+
+// IsPollAnnounced reports whether MarkPollAnnounced was called for a post
+func (d *Database) IsPollAnnounced(postID string) (bool, error) {
+	var value string
+	err := d.queryRow(
+		"SELECT value FROM state WHERE key = ?",
+		"poll_announced_"+postID,
+	).Scan(&value)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SaveHashtagReply records the hashtag reply posted under a post's thread.
+// It is kept apart from the mapping so replies to the post chain from its
+// last content part rather than from the hashtag list.
+func (d *Database) SaveHashtagReply(postID string, bskyID string) error {
+	return d.setState("hashtag_reply_"+postID, bskyID)
+}
+
+// GetHashtagReply returns the reply saved by SaveHashtagReply, or "" if
+// there is none
+func (d *Database) GetHashtagReply(postID string) (string, error) {
+	var bskyID string
+	err := d.queryRow(
+		"SELECT value FROM state WHERE key = ?",
+		"hashtag_reply_"+postID,
+	).Scan(&bskyID)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return bskyID, err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"truss/bluesky"
+)
+
+// newTestDatabase opens an in-memory database for a test
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db, err := NewDatabase(inMemoryPath, 5*time.Second)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestGetBlueskyIDsEmptyMapping(t *testing.T) {
+	db := newTestDatabase(t)
+
+	for id, stored := range map[string]string{"empty": "", "separators": ",,"} {
+		if _, err := db.exec("INSERT INTO post_mappings (mastodon_id, bluesky_ids) VALUES (?, ?)", id, stored); err != nil {
+			t.Fatalf("inserting mapping: %v", err)
+		}
+
+		ids, err := db.GetBlueskyIDsForMastodonPost(id)
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if len(ids) != 0 {
+			t.Errorf("%s: got %q, want no IDs", id, ids)
+		}
+	}
+}
+
+func TestInMemoryDatabase(t *testing.T) {
+	first := newTestDatabase(t)
+	second := newTestDatabase(t)
+
+	ids := []string{"at://did:plc:me/app.bsky.feed.post/1|cid1"}
+	if err := first.SavePostMapping("1", ids, time.Now()); err != nil {
+		t.Fatalf("saving mapping: %v", err)
+	}
+	if err := first.SaveContentHash("1", "abc"); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+	if err := first.QueuePendingPost("2"); err != nil {
+		t.Fatalf("queueing post: %v", err)
+	}
+
+	// Every query shares the one connection, so what was written is there
+	// to read back
+	got, err := first.GetBlueskyIDsForMastodonPost("1")
+	if err != nil || len(got) != 1 || got[0] != ids[0] {
+		t.Errorf("got mapping %v, %v, want %v", got, err, ids)
+	}
+	if hash, err := first.GetContentHash("1"); err != nil || hash != "abc" {
+		t.Errorf("got hash %q, %v, want abc", hash, err)
+	}
+	if pending, err := first.GetPendingPosts(); err != nil || len(pending) != 1 {
+		t.Errorf("got pending posts %v, %v, want one", pending, err)
+	}
+
+	// Each in-memory database is its own
+	if got, _ := second.GetBlueskyIDsForMastodonPost("1"); len(got) != 0 {
+		t.Errorf("second database sees the first one's mapping %v", got)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	const query = "SELECT value FROM state WHERE key = ? AND value != ?"
+
+	sqlite := &Database{}
+	if got := sqlite.rebind(query); got != query {
+		t.Errorf("SQLite: got %q, want the query unchanged", got)
+	}
+
+	postgres := &Database{postgres: true}
+	if got, want := postgres.rebind(query), "SELECT value FROM state WHERE key = $1 AND value != $2"; got != want {
+		t.Errorf("Postgres: got %q, want %q", got, want)
+	}
+}
+
+func TestUpserts(t *testing.T) {
+	stores := map[string]func(t *testing.T) *Database{"sqlite": newTestDatabase}
+
+	// Postgres is only tested against a database set aside for it
+	if url := os.Getenv("TRUSS_TEST_POSTGRES_URL"); url != "" {
+		stores["postgres"] = func(t *testing.T) *Database {
+			db, err := NewPostgresDatabase(url, 5*time.Second)
+			if err != nil {
+				t.Fatalf("opening database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		}
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := open(t)
+			id := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+			for _, ref := range []string{"at://did:plc:me/app.bsky.feed.post/1|cid1", "at://did:plc:me/app.bsky.feed.post/2|cid2"} {
+				if err := db.SavePostMapping(id, []string{ref}, time.Now()); err != nil {
+					t.Fatalf("saving mapping: %v", err)
+				}
+			}
+			if got, err := db.GetBlueskyIDsForMastodonPost(id); err != nil || len(got) != 1 || !strings.HasSuffix(got[0], "|cid2") {
+				t.Errorf("got mapping %v, %v, want the second one", got, err)
+			}
+
+			for _, hash := range []string{"first", "second"} {
+				if err := db.SaveContentHash(id, hash); err != nil {
+					t.Fatalf("saving hash: %v", err)
+				}
+			}
+			if got, err := db.GetContentHash(id); err != nil || got != "second" {
+				t.Errorf("got hash %q, %v, want second", got, err)
+			}
+
+			for _, orig := range []string{"a", "b"} {
+				if err := db.MarkAsEdit(id, orig); err != nil {
+					t.Fatalf("marking edit: %v", err)
+				}
+			}
+			if got, ok := db.CheckIfEdit(id, ""); !ok || got != "b" {
+				t.Errorf("got original %q, %v, want b", got, ok)
+			}
+
+			for _, blob := range []string{"blob1", "blob2"} {
+				if err := db.SaveMediaBlob(id, blob); err != nil {
+					t.Fatalf("saving blob: %v", err)
+				}
+			}
+			if got, err := db.GetMediaBlob(id); err != nil || got != "blob2" {
+				t.Errorf("got blob %q, %v, want blob2", got, err)
+			}
+
+			// Queueing twice keeps one entry, and failures count up from it
+			for i := 0; i < 2; i++ {
+				if err := db.QueuePendingPost(id); err != nil {
+					t.Fatalf("queueing post: %v", err)
+				}
+			}
+			first, err := db.RecordFailedAttempt(id)
+			if err != nil {
+				t.Fatalf("recording failure: %v", err)
+			}
+			if second, err := db.RecordFailedAttempt(id); err != nil || second != first+1 {
+				t.Errorf("got %d attempts, %v, want %d", second, err, first+1)
+			}
+			if err := db.RemovePendingPost(id); err != nil {
+				t.Fatalf("removing pending post: %v", err)
+			}
+		})
+	}
+}
+
+func TestRefsRoundTrip(t *testing.T) {
+	db := newTestDatabase(t)
+
+	refs := []string{
+		"at://did:plc:me/app.bsky.feed.post/1|bafy1",
+		"at://did:plc:me/app.bsky.feed.post/2|bafy2",
+		"at://did:plc:me/app.bsky.feed.post/3|bafy3",
+	}
+	if err := db.SavePostMapping("1", refs, time.Now()); err != nil {
+		t.Fatalf("saving mapping: %v", err)
+	}
+
+	// Every ref comes back whole and in thread order, so edits delete the
+	// right records and replies chain from the last one
+	got, err := db.GetBlueskyIDsForMastodonPost("1")
+	if err != nil {
+		t.Fatalf("getting mapping: %v", err)
+	}
+	if strings.Join(got, ",") != strings.Join(refs, ",") {
+		t.Errorf("got %q, want %q", got, refs)
+	}
+	for _, ref := range got {
+		if _, err := bluesky.ParseStrongRef(ref); err != nil {
+			t.Errorf("ref read back malformed: %v", err)
+		}
+	}
+
+	// An edit's new records replace the old ones
+	updated := []string{"at://did:plc:me/app.bsky.feed.post/4|bafy4"}
+	if err := db.UpdatePostMapping("1", updated); err != nil {
+		t.Fatalf("updating mapping: %v", err)
+	}
+	if got, _ := db.GetBlueskyIDsForMastodonPost("1"); strings.Join(got, ",") != updated[0] {
+		t.Errorf("got %q after the update, want %q", got, updated)
+	}
+
+	if err := db.SaveHashtagReply("1", "at://did:plc:me/app.bsky.feed.post/5|bafy5"); err != nil {
+		t.Fatalf("saving hashtag reply: %v", err)
+	}
+	if got, _ := db.GetHashtagReply("1"); got != "at://did:plc:me/app.bsky.feed.post/5|bafy5" {
+		t.Errorf("got hashtag reply %q", got)
+	}
+}
+
+func TestMalformedRefsAreRejected(t *testing.T) {
+	db := newTestDatabase(t)
+
+	for _, refs := range [][]string{
+		{"at://did:plc:me/app.bsky.feed.post/1"},
+		{"at://did:plc:me/app.bsky.feed.post/1|bafy1", "at://did:plc:me/app.bsky.feed.post/2|"},
+		{"https://bsky.app/profile/me/post/1|bafy1"},
+	} {
+		if err := db.SavePostMapping("1", refs, time.Now()); err == nil {
+			t.Errorf("saved %q, want it rejected", refs)
+		}
+		if err := db.UpdatePostMapping("1", refs); err == nil {
+			t.Errorf("updated to %q, want it rejected", refs)
+		}
+	}
+
+	if got, _ := db.GetBlueskyIDsForMastodonPost("1"); len(got) != 0 {
+		t.Errorf("got %q stored, want nothing", got)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// followingRefresh is how long the list of followed accounts is cached
+const followingRefresh = time.Hour
+
+// follows reports whether the bridged account follows accountID. The list
+// of followed accounts is fetched at most once every followingRefresh; if
+// refreshing it fails, the previous list is used until the next attempt.
+func (b *Bridge) follows(ctx context.Context, accountID string) (bool, error) {
+	if time.Since(b.followingFetched) >= followingRefresh {
+		ids, err := b.mastodon.GetFollowing(ctx, b.accountID)
+		if err != nil {
+			if b.following == nil {
+				return false, fmt.Errorf("fetching followed accounts: %w", err)
+			}
+			log.Printf("Error refreshing followed accounts, using the previous list: %v", err)
+		} else {
+			b.following = make(map[string]bool, len(ids))
+			for _, id := range ids {
+				b.following[id] = true
+			}
+			log.Printf("Fetched %d followed accounts", len(ids))
+		}
+
+		// Don't retry a failed refresh on every reply
+		b.followingFetched = time.Now()
+	}
+
+	return b.following[accountID], nil
+}
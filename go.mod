@@ -6,8 +6,11 @@ require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/mattn/go-mastodon v0.0.9
 	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/text v0.16.0
 )
 
+require github.com/lib/pq v1.10.9
+
 require (
 	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/gorilla/css v1.0.1 // indirect
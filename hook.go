@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// runPostHook runs the configured post_hook for a bridged post in the
+// background
+func (b *Bridge) runPostHook(mastodonID string, bskyIDs []string) {
+	if b.config.PostHook == "" || len(bskyIDs) == 0 {
+		return
+	}
+
+	blueskyURI := strings.Split(bskyIDs[0], "|")[0]
+
+	go func() {
+		output, err := b.postHook(mastodonID, blueskyURI)
+		if err != nil {
+			log.Printf("Post hook for %s failed: %v (output: %s)",
+				mastodonID, err, truncateForLog(string(output)))
+		}
+	}()
+}
+
+// postHook runs post_hook, killing it after post_hook_timeout, and returns
+// its output. The command is split into arguments on whitespace and run
+// without a shell, so the substituted values can't inject anything; they're
+// also passed as TRUSS_MASTODON_ID and TRUSS_BLUESKY_URI environment
+// variables.
+func (b *Bridge) postHook(mastodonID, blueskyURI string) ([]byte, error) {
+	replacer := strings.NewReplacer(
+		"{mastodon_id}", mastodonID,
+		"{bluesky_uri}", blueskyURI,
+	)
+
+	var args []string
+	for _, field := range strings.Fields(b.config.PostHook) {
+		args = append(args, replacer.Replace(field))
+	}
+
+	timeout := time.Duration(b.config.PostHookTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"TRUSS_MASTODON_ID="+mastodonID,
+		"TRUSS_BLUESKY_URI="+blueskyURI,
+	)
+
+	return cmd.CombinedOutput()
+}
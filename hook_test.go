@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"truss/config"
+)
+
+func TestPostHook(t *testing.T) {
+	// Shell syntax in a URI stays inside the one argument it was put in
+	const uri = "at://did:plc:me/app.bsky.feed.post/1 $(touch pwned); --extra"
+
+	tests := []struct {
+		name string
+		hook string
+		want string
+	}{
+		{name: "substitution", hook: "echo {mastodon_id} posted", want: "1 posted\n"},
+		{name: "no injection", hook: "printf [%s] {bluesky_uri}", want: "[" + uri + "]"},
+		{name: "environment", hook: "printenv TRUSS_MASTODON_ID TRUSS_BLUESKY_URI", want: "1\n" + uri + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{PostHook: tt.hook, PostHookTimeout: 5})
+			output, err := b.postHook("1", uri)
+			if err != nil {
+				t.Fatalf("postHook: %v (output: %s)", err, output)
+			}
+			if string(output) != tt.want {
+				t.Errorf("got output %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostHookTimeout(t *testing.T) {
+	b := newTestBridge(t, &config.Config{PostHook: "sleep 10", PostHookTimeout: 1})
+
+	start := time.Now()
+	_, err := b.postHook("1", "at://did:plc:me/app.bsky.feed.post/1")
+	if err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("got error %v, want the hook killed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hook ran for %s, want it killed after post_hook_timeout", elapsed)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"unicode"
+)
+
+// scriptLanguages are the scripts that are written in only one language, so
+// seeing them is enough to know what a post is in
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	lang   string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Thai, "th"},
+	{unicode.Greek, "el"},
+	{unicode.Hebrew, "he"},
+	{unicode.Armenian, "hy"},
+	{unicode.Georgian, "ka"},
+	{unicode.Khmer, "km"},
+	{unicode.Lao, "lo"},
+	{unicode.Sinhala, "si"},
+	{unicode.Tamil, "ta"},
+	{unicode.Telugu, "te"},
+	{unicode.Kannada, "kn"},
+	{unicode.Malayalam, "ml"},
+	{unicode.Gujarati, "gu"},
+	{unicode.Gurmukhi, "pa"},
+	{unicode.Ethiopic, "am"},
+	{unicode.Myanmar, "my"},
+	{unicode.Tibetan, "bo"},
+}
+
+// minLanguageShare is how much of a post's letters have to be in one
+// language's script before that language is trusted over Mastodon's
+const minLanguageShare = 0.8
+
+// languageStage sets the language of the Bluesky records. It is the one
+// Mastodon gives, unless detect_language is set and the text is clearly in
+// another.
+func (b *Bridge) languageStage(ctx context.Context, pc *PostContext) error {
+	lang := pc.Post.Language
+
+	if b.config.DetectLanguage {
+		if detected := detectLanguage(pc.Content); detected != "" && detected != lang {
+			lang = detected
+		}
+	}
+
+	if lang != "" {
+		pc.Meta.Langs = []string{lang}
+	}
+	return nil
+}
+
+// detectLanguage guesses the language of text from its script. Only scripts
+// used by a single language can be told apart this way, so for most text,
+// including anything in Latin, Cyrillic or Arabic script, it returns "".
+// Japanese is told from Chinese by its kana.
+func detectLanguage(text string) string {
+	counts := make(map[string]int)
+	letters, han := 0, 0
+
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+
+		if unicode.Is(unicode.Han, r) {
+			han++
+			continue
+		}
+
+		for _, sl := range scriptLanguages {
+			if unicode.Is(sl.script, r) {
+				counts[sl.lang]++
+				break
+			}
+		}
+	}
+
+	if letters == 0 {
+		return ""
+	}
+
+	// Han characters are shared by Chinese and Japanese, and Korean
+	// sometimes uses them too
+	best, bestCount := "", 0
+	for lang, n := range counts {
+		if n > bestCount {
+			best, bestCount = lang, n
+		}
+	}
+	if best == "ja" || best == "ko" {
+		bestCount += han
+	} else if han > bestCount {
+		best, bestCount = "zh", han
+	}
+
+	if float64(bestCount)/float64(letters) < minLanguageShare {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"truss/bluesky"
+)
+
+const (
+	// Only the head of a page is needed for its Open Graph tags
+	maxLinkPageSize = 512 * 1024
+
+	linkCardTimeout = 10 * time.Second
+)
+
+var (
+	linkOnlyPattern = regexp.MustCompile(`^\s*(https?://\S+)\s*$`)
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrPattern = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// linkOnlyURL returns the URL if the content is nothing but a single link
+func linkOnlyURL(content string) string {
+	match := linkOnlyPattern.FindStringSubmatch(content)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// postLink bridges a link-only post as a single post with a clickable link
+// and, when fetch_link_cards is enabled, a preview card
+func (b *Bridge) postLink(ctx context.Context, text string, link string, parentUri, parentCid string,
+	meta bluesky.PostMeta) (string, error) {
+	var reply *bluesky.ReplyRef
+	if parentUri != "" {
+		rootUri, rootCid := threadRoot(ctx, b.bluesky, parentUri, parentCid)
+		reply = &bluesky.ReplyRef{
+			Root:   bluesky.StrongRef{URI: rootUri, CID: rootCid},
+			Parent: bluesky.StrongRef{URI: parentUri, CID: parentCid},
+		}
+	}
+
+	var card *bluesky.External
+	if b.config.FetchLinkCards {
+		var err error
+		card, err = b.fetchLinkCard(ctx, link)
+		if err != nil {
+			// The post is still useful with a plain link
+			log.Printf("Error fetching link card for %s: %v", link, err)
+		}
+	}
+
+	result, err := b.bluesky.CreateLinkPost(ctx, text, reply, meta, card)
+
+	var facetErr *bluesky.FacetError
+	if errors.As(err, &facetErr) {
+		log.Printf("WARNING: Link post has an invalid facet, posting it without facets: %v", facetErr)
+		meta.NoFacets = true
+		result, err = b.bluesky.CreateLinkPost(ctx, text, reply, meta, card)
+	}
+
+	return result, err
+}
+
+// fetchLinkCard builds a preview card from a page's Open Graph tags,
+// uploading its image as the thumbnail if there is one
+func (b *Bridge) fetchLinkCard(ctx context.Context, link string) (*bluesky.External, error) {
+	ctx, cancel := context.WithTimeout(ctx, linkCardTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating page request: %w", err)
+	}
+
+	resp, err := mediaHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing page request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("page request failed with status %d", resp.StatusCode)
+	}
+
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxLinkPageSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading page: %w", err)
+	}
+
+	meta := openGraphTags(string(page))
+
+	card := &bluesky.External{
+		URI:         link,
+		Title:       meta["og:title"],
+		Description: meta["og:description"],
+	}
+
+	if card.Title == "" {
+		card.Title = link
+	}
+
+	if image := meta["og:image"]; image != "" {
+		download := b.downloadMedia(ctx, image)
+		if download.err != nil {
+			log.Printf("Error downloading link card image %s: %v", image, download.err)
+			return card, nil
+		}
+
+		blob, err := b.bluesky.UploadBlob(ctx, download.data, download.mimeType)
+		if err != nil {
+			log.Printf("Error uploading link card image %s: %v", image, err)
+			return card, nil
+		}
+		card.Thumb = blob
+	}
+
+	return card, nil
+}
+
+// openGraphTags extracts the og: meta tags from a page
+func openGraphTags(page string) map[string]string {
+	tags := make(map[string]string)
+
+	for _, tag := range metaTagPattern.FindAllString(page, -1) {
+		var key, content string
+		for _, attr := range metaAttrPattern.FindAllStringSubmatch(tag, -1) {
+			value := html.UnescapeString(strings.Trim(attr[2], `"'`))
+			if strings.EqualFold(attr[1], "content") {
+				content = value
+			} else {
+				key = strings.ToLower(value)
+			}
+		}
+
+		if strings.HasPrefix(key, "og:") && tags[key] == "" {
+			tags[key] = strings.TrimSpace(content)
+		}
+	}
+
+	return tags
+}
@@ -4,18 +4,25 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
 	"truss/bluesky"
 	"truss/config"
 	"truss/mastodon"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 func main() {
@@ -27,6 +34,14 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Run a maintenance command instead of the bridge if one was given
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(cfg, args); err != nil {
+			log.Fatalf("Command failed: %v", err)
+		}
+		return
+	}
+
 	// Try bluesky first
 	bsky, err := bluesky.NewClient(cfg.Bluesky)
 	if err != nil {
@@ -52,13 +67,19 @@ func main() {
 	// Try to get account info
 	account, err := masto.GetAccount(context.Background())
 	if err != nil {
+		if errors.Is(err, mastodon.ErrUnauthorized) {
+			log.Printf("Mastodon token invalid — update the access token in your config")
+			os.Exit(exitAuthFailure)
+		}
 		log.Fatalf("Failed to get Mastodon account: %v", err)
 	}
 
 	log.Printf("Mastodon account: %s", account.Acct)
+	log.Printf("Mastodon server software: %s", masto.DetectSoftware(context.Background()))
 
 	// Continue with the bridge setup...
 	bridge := NewBridge(masto, bsky, cfg)
+	bridge.accountID = string(account.ID)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -72,30 +93,131 @@ func main() {
 		cancel()
 	}()
 
+	if cfg.StatusAddr != "" {
+		go bridge.serveStatus(ctx)
+	}
+
 	if err := bridge.Run(ctx); err != nil {
+		if errors.Is(err, mastodon.ErrUnauthorized) {
+			log.Printf("Mastodon token invalid — update the access token in your config")
+			os.Exit(exitAuthFailure)
+		}
 		log.Fatalf("Bridge failed: %v", err)
 	}
 }
 
+// exitAuthFailure is the exit code used when Mastodon rejects our token, so
+// supervisors can tell it apart from crashes that are worth restarting for
+const exitAuthFailure = 78
+
+// editCheckCount is how many of the most recently bridged posts are
+// checked for edits
+const editCheckCount = 10
+
+// A thread rate limited partway through waits defaultRateLimitWait if
+// Bluesky doesn't say how long, up to maxRateLimitWaits times. A limit
+// longer than maxRateLimitWait, such as a daily one, isn't waited out.
+const (
+	defaultRateLimitWait = 30 * time.Second
+	maxRateLimitWait     = 5 * time.Minute
+	maxRateLimitWaits    = 3
+)
+
+// orphanPartLength is how short the last part of a thread has to be for
+// rebalance_parts to even it out with the part before
+const orphanPartLength = 60
+
 type Bridge struct {
 	mastodon *mastodon.Client
 	bluesky  *bluesky.Client
 	config   *config.Config
-	db       *Database
+	db       Store
+	breaker  *circuitBreaker
+	stages   []Stage
+
+	// mediaSlots bounds concurrent media downloads across all posts
+	mediaSlots chan struct{}
+
+	// accountID is the Mastodon account being bridged
+	accountID string
+
+	// parentMisses remembers when a parent lookup on Bluesky last failed, so
+	// a burst of replies to the same missing parent only looks it up once
+	parentMisses map[string]time.Time
+
+	// parentWaits tracks the replies queued until the post of ours they
+	// reply to is bridged
+	parentWaits map[string]parentWait
+
+	// lastBridged is the most recently bridged post, so the next post of a
+	// self-thread can chain onto it without looking its parent up again
+	lastBridged *bridgedPost
+
+	// stats counts what happened during the current poll cycle
+	stats *cycleStats
+
+	// following is the set of accounts the bridged account follows, as of
+	// followingFetched
+	following        map[string]bool
+	followingFetched time.Time
+
+	// mirroredPin is the Bluesky post mirror_pins last pinned, so a post
+	// pinned on Bluesky by hand is never unpinned
+	mirroredPin string
+
+	// status is what /status reports about the bridge loop
+	status *bridgeStatus
+
+	// unsettledEdits holds edits waiting out edit_debounce, by post ID
+	unsettledEdits map[string]unsettledEdit
+
+	// dryRun keeps the stages from writing to Bluesky or the database, so
+	// truss diff can show what they would do
+	dryRun bool
+}
+
+// unsettledEdit is the latest content of an edited post seen, and when it
+// was first seen
+type unsettledEdit struct {
+	hash string
+	seen time.Time
+}
+
+// bridgedPost is where a Mastodon post ended up on Bluesky
+type bridgedPost struct {
+	mastodonID string
+	blueskyIDs []string
+	depth      int
 }
 
 func NewBridge(masto *mastodon.Client, bsky *bluesky.Client, cfg *config.Config) *Bridge {
-	db, err := NewDatabase(cfg.DatabasePath)
+	db, err := openStore(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	return &Bridge{
+	if sqlitePath(cfg) == inMemoryPath {
+		log.Println("WARNING: database_path is :memory:, nothing will be remembered between runs")
+	}
+
+	bridge := &Bridge{
 		mastodon: masto,
 		bluesky:  bsky,
 		config:   cfg,
 		db:       db,
+		breaker: newCircuitBreaker(cfg.BreakerThreshold,
+			time.Duration(cfg.BreakerCooldown)*time.Second),
+		mediaSlots:   make(chan struct{}, cfg.MediaDownloadConcurrency),
+		parentMisses: make(map[string]time.Time),
+		parentWaits:  make(map[string]parentWait),
+		stats:        newCycleStats(),
+		status:       newBridgeStatus(),
+
+		unsettledEdits: make(map[string]unsettledEdit),
 	}
+	bridge.stages = bridge.pipeline()
+
+	return bridge
 }
 
 func (b *Bridge) Run(ctx context.Context) error {
@@ -110,247 +232,743 @@ func (b *Bridge) Run(ctx context.Context) error {
 	// Start time for this run
 	startTime := time.Now()
 
-	// Create a ticker for normal post polling
-	postTicker := time.NewTicker(time.Duration(b.config.PollInterval) * time.Second)
-	defer postTicker.Stop()
+	// Phase this bridge's polling apart from others sharing the accounts
+	// or instance, so they don't all hit the APIs at the same moment
+	if b.config.StaggerOffset > 0 {
+		log.Printf("Waiting %ds before the first poll (stagger_offset)", b.config.StaggerOffset)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(b.config.StaggerOffset) * time.Second):
+		}
+	}
+
+	// Check right away instead of waiting a full interval for the first tick
+	lastID, err = b.checkNewPosts(ctx, lastID, startTime)
+	if err != nil {
+		return err
+	}
+
+	if b.config.InitialEditCheck {
+		b.checkEdits(ctx)
+	}
+	b.endCycle()
+
+	// Poll with a timer rather than a ticker so adaptive polling can
+	// change the interval between polls
+	pollInterval := time.Duration(b.config.PollInterval) * time.Second
+	postTimer := time.NewTimer(pollInterval)
+	defer postTimer.Stop()
 
-	// Create a ticker for edit checking
-	editTicker := time.NewTicker(time.Duration(b.config.PollInterval) * time.Second * 2)
+	// Edits are checked half as often as new posts, backing off with them
+	editTicker := time.NewTicker(pollInterval * 2)
 	defer editTicker.Stop()
 
+	// Only poll for likes when mirroring is enabled
+	var likesC <-chan time.Time
+	if b.config.MirrorLikes {
+		likesTicker := time.NewTicker(time.Duration(b.config.MirrorLikesInterval) * time.Second)
+		defer likesTicker.Stop()
+		likesC = likesTicker.C
+	}
+
+	// Expiry deletes posts from Bluesky, so it only runs when asked for
+	if b.config.PostTTL > 0 {
+		log.Printf("WARNING: post_ttl is set, bridged posts older than %s will be deleted from Bluesky",
+			time.Duration(b.config.PostTTL)*time.Second)
+	}
+
+	// Housekeeping only runs when something needs it
+	var maintenanceC <-chan time.Time
+	if b.config.PostTTL > 0 || b.config.HashRetention > 0 || b.config.MirrorPins {
+		maintenanceTicker := time.NewTicker(time.Hour)
+		defer maintenanceTicker.Stop()
+		maintenanceC = maintenanceTicker.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 
-		case <-postTicker.C:
-			log.Println("Checking for new posts...")
-			// Handle new posts
-			posts, err := b.mastodon.GetNewPosts(ctx, lastID, startTime)
+		case <-likesC:
+			b.mirrorLikes(ctx)
+
+		case <-maintenanceC:
+			b.maintain(ctx)
+
+		case <-postTimer.C:
+			prevID := lastID
+			lastID, err = b.checkNewPosts(ctx, lastID, startTime)
 			if err != nil {
-				log.Printf("Error fetching posts: %v", err)
+				return err
+			}
+
+			next := b.nextPollInterval(pollInterval, lastID != prevID)
+			if next != pollInterval {
+				editTicker.Reset(next * 2)
+			}
+			pollInterval = next
+			postTimer.Reset(pollInterval)
+
+			// Edits, expiry and the like since the last poll are counted in
+			// with it
+			b.endCycle()
+
+		case <-editTicker.C:
+			b.checkEdits(ctx)
+		}
+	}
+}
+
+// nextPollInterval returns how long to wait before polling again. With
+// adaptive polling, each poll that finds nothing new backs off further up to
+// max_poll_interval, and any new post goes straight back to poll_interval.
+func (b *Bridge) nextPollInterval(current time.Duration, active bool) time.Duration {
+	base := time.Duration(b.config.PollInterval) * time.Second
+	if !b.config.AdaptivePolling || active {
+		if current != base {
+			log.Printf("New activity, polling every %s again", base)
+		}
+		return base
+	}
+
+	maxInterval := time.Duration(b.config.MaxPollInterval) * time.Second
+	next := time.Duration(float64(current) * b.config.PollBackoffFactor)
+	if next > maxInterval {
+		next = maxInterval
+	}
+
+	if next != current {
+		log.Printf("No new posts, polling every %s", next)
+	}
+
+	return next
+}
+
+// checkNewPosts bridges posts made since lastID and returns the new last
+// seen ID. Only errors that should stop the bridge are returned.
+func (b *Bridge) checkNewPosts(ctx context.Context, lastID string, startTime time.Time) (string, error) {
+	log.Println("Checking for new posts...")
+	// Handle new posts
+	posts, err := b.mastodon.GetNewPosts(ctx, lastID, startTime)
+	if err != nil {
+		b.status.failed(err)
+		if errors.Is(err, mastodon.ErrUnauthorized) {
+			log.Printf("Mastodon token invalid — update the access token in your config")
+			if b.config.ExitOnAuthFailure {
+				return lastID, err
+			}
+		}
+		log.Printf("Error fetching posts: %v", err)
+		return lastID, nil
+	}
+
+	b.status.polled()
+
+	// Retry anything queued while Bluesky was failing
+	b.processPendingPosts(ctx)
+
+	if len(posts) > 0 {
+		log.Printf("Found %d new posts", len(posts))
+		b.stats.found += len(posts)
+
+		// Posts are newest first, so anything past the backlog limit is the
+		// oldest
+		if b.config.MaxBacklog > 0 && len(posts) > b.config.MaxBacklog {
+			log.Printf("%d new posts exceed max_backlog, skipping the oldest %d",
+				len(posts), len(posts)-b.config.MaxBacklog)
+			for _, post := range posts[b.config.MaxBacklog:] {
+				b.skipBacklogPost(post.ID)
+			}
+			posts = posts[:b.config.MaxBacklog]
+		}
+
+		// Process posts in chronological order
+		for i := len(posts) - 1; i >= 0; i-- {
+			post := posts[i]
+			lastID = post.ID
+
+			// Pinned posts can show up again outside the sinceID window
+			if post.Pinned && b.config.SkipPinned {
+				log.Printf("Skipping pinned post %s", post.ID)
+				b.stats.skip("pinned")
 				continue
 			}
 
-			if len(posts) > 0 {
-				log.Printf("Found %d new posts", len(posts))
-
-				// Process posts in chronological order
-				for i := len(posts) - 1; i >= 0; i-- {
-					post := posts[i]
-					if err := b.ProcessPost(ctx, post); err != nil {
-						log.Printf("Error processing post %s: %v", post.ID, err)
-						continue
-					}
-					lastID = post.ID
-				}
+			// Never bridge a known post twice, edits are handled separately
+			if b.isBridged(post.ID) {
+				log.Printf("Post %s has already been bridged, skipping", post.ID)
+				b.stats.skip("already_bridged")
+				continue
+			}
 
-				if err := b.db.SaveLastSeenID(lastID); err != nil {
-					log.Printf("Error saving last seen ID: %v", err)
-				}
+			if b.config.QuietHours.Contains(time.Now()) {
+				log.Printf("Quiet hours, queueing post %s for later", post.ID)
+				b.queuePost(post.ID)
+				b.stats.skip("queued")
+				continue
 			}
 
-		case <-editTicker.C:
-			log.Println("Checking for post edits...")
-			// Check for edits (only check the 10 most recent posts)
-			recentIDs, err := b.db.GetRecentPostsToCheckForEdits(10)
-			if err != nil {
-				log.Printf("Error getting recent posts to check: %v", err)
+			if !b.breaker.Allow() {
+				log.Printf("Bluesky is unavailable, queueing post %s for later", post.ID)
+				b.queuePost(post.ID)
+				b.stats.skip("queued")
 				continue
 			}
 
-			for _, id := range recentIDs {
-				post, err := b.mastodon.GetPostWithEdits(ctx, id)
-				if err != nil {
-					log.Printf("Error checking post %s for edits: %v", id, err)
-					continue
+			if err := b.ProcessPost(ctx, post); errors.Is(err, errParentPending) {
+				b.stats.skip("parent_pending")
+				continue
+			} else if err != nil {
+				log.Printf("Error processing post %s: %v", post.ID, err)
+				b.stats.errors++
+				b.status.failed(err)
+				if isBlueskyError(err) {
+					b.breaker.RecordFailure()
 				}
+				b.recordFailedAttempt(post.ID)
+				continue
+			}
+			b.breaker.RecordSuccess()
+		}
 
-				// Calculate new content hash
-				newContentHash := hashPostContent(post.Content)
+		if err := b.db.SaveLastSeenID(lastID); err != nil {
+			log.Printf("Error saving last seen ID: %v", err)
+		}
+	}
 
-				// Get the stored hash
-				oldContentHash, err := b.db.GetContentHash(id)
-				if err != nil {
-					log.Printf("Error getting content hash for post %s: %v", id, err)
-					continue
-				}
+	return lastID, nil
+}
 
-				// Only process if content actually changed
-				if newContentHash != oldContentHash {
-					log.Printf("Content changed for post %s (hash: %s -> %s), reprocessing",
-						id, oldContentHash[:8], newContentHash[:8])
+// checkEdits reprocesses recently bridged posts whose content has changed
+func (b *Bridge) checkEdits(ctx context.Context) {
+	// Edits are still detected by their hash once quiet hours end
+	if b.config.QuietHours.Contains(time.Now()) {
+		log.Println("Quiet hours, deferring edit check")
+		return
+	}
 
-					// Process the updated post
-					if err := b.ProcessPost(ctx, post); err != nil {
-						log.Printf("Error processing edited post %s: %v", id, err)
-						continue
-					}
-				}
+	log.Println("Checking for post edits...")
+	// Check for edits (only check the most recent posts, and with
+	// edit_check_since only those young enough to still be edited)
+	var since time.Time
+	if b.config.EditCheckSince > 0 {
+		since = time.Now().Add(-time.Duration(b.config.EditCheckSince) * time.Second)
+	}
+	recentIDs, err := b.db.GetRecentPostsToCheckForEdits(editCheckCount, since)
+	if err != nil {
+		log.Printf("Error getting recent posts to check: %v", err)
+		return
+	}
+
+	for _, id := range recentIDs {
+		post, err := b.mastodon.GetPostWithEdits(ctx, id)
+		if err != nil {
+			log.Printf("Error checking post %s for edits: %v", id, err)
+			continue
+		}
+
+		// A boost is hashed by what it boosted, which ProcessReblog
+		// checks itself
+		if post.Reblog != nil {
+			if err := b.ProcessPost(ctx, post); err != nil {
+				log.Printf("Error processing edited reblog %s: %v", id, err)
+				b.stats.errors++
 			}
+			continue
+		}
+
+		if len(b.config.FavouriteMilestones) > 0 {
+			b.checkMilestones(ctx, post)
+		}
+
+		if b.config.AnnouncePollResults && post.Poll != nil && post.Poll.Expired {
+			b.announcePollResults(ctx, post)
+		}
+
+		// Calculate new content hash
+		newContentHash := postHash(post.Content, post.SpoilerText, hashedMedia(b.config, post), b.config.EditSensitivity)
+
+		// Get the stored hash
+		oldContentHash, err := b.db.GetContentHash(id)
+		if err != nil {
+			log.Printf("Error getting content hash for post %s: %v", id, err)
+			continue
+		}
+
+		// Only process if content actually changed
+		if newContentHash == oldContentHash || b.upgradeLegacyHash(post, oldContentHash, newContentHash) {
+			delete(b.unsettledEdits, id)
+			continue
+		}
+
+		if !b.editSettled(post, newContentHash) {
+			log.Printf("Post %s was edited less than edit_debounce ago, waiting for further edits", id)
+			continue
+		}
+
+		log.Printf("Content changed for post %s (hash: %s -> %s), reprocessing",
+			id, oldContentHash[:8], newContentHash[:8])
+
+		// Process the updated post
+		if err := b.ProcessPost(ctx, post); err != nil {
+			log.Printf("Error processing edited post %s: %v", id, err)
+			b.stats.errors++
 		}
 	}
+
+	if b.config.AnnouncePollResults {
+		b.checkOpenPolls(ctx)
+	}
 }
 
-func (b *Bridge) ProcessPost(ctx context.Context, post *mastodon.Post) error {
-	if post.Reblog != nil {
-		return b.ProcessReblog(ctx, post)
+// editSettled reports whether an edited post has gone edit_debounce without
+// another edit. The time of the last edit comes from Mastodon if it says,
+// and otherwise from when this version was first seen.
+func (b *Bridge) editSettled(post *mastodon.Post, hash string) bool {
+	debounce := time.Duration(b.config.EditDebounce) * time.Second
+	if debounce == 0 {
+		return true
 	}
 
-	// Skip non-public posts
-	if post.Visibility != "public" {
-		log.Printf("Skipping non-public post: %s (visibility: %s)", post.ID, post.Visibility)
-		return nil
+	edit, ok := b.unsettledEdits[post.ID]
+	if !ok || edit.hash != hash {
+		edit = unsettledEdit{hash: hash, seen: time.Now()}
+		b.unsettledEdits[post.ID] = edit
 	}
 
-	if post.Content == "" {
-		log.Printf("Skipping post with empty content: %s", post.ID)
-		return nil
+	lastEdit := edit.seen
+	if !post.EditedAt.IsZero() {
+		lastEdit = post.EditedAt
+	}
+	if time.Since(lastEdit) < debounce {
+		return false
 	}
 
-	// If hashtag filtering is enabled, check for the required hashtag
-	if b.config.FilterHashtag != "" {
-		hasFilterTag := false
-		for _, tag := range post.Hashtags {
-			if strings.EqualFold(tag, b.config.FilterHashtag) {
-				hasFilterTag = true
-				break
+	delete(b.unsettledEdits, post.ID)
+	return true
+}
+
+// maintain runs the periodic housekeeping that is enabled
+func (b *Bridge) maintain(ctx context.Context) {
+	if b.config.PostTTL > 0 {
+		b.expirePosts(ctx)
+	}
+
+	if b.config.HashRetention > 0 {
+		retention := time.Duration(b.config.HashRetention) * time.Second
+		pruned, err := b.db.PruneEditState(retention, editCheckCount)
+		if err != nil {
+			log.Printf("Error pruning edit state: %v", err)
+		} else if pruned > 0 {
+			log.Printf("Pruned %d edit state rows older than %s", pruned, retention)
+		}
+	}
+
+	if b.config.MirrorPins {
+		b.mirrorPins(ctx)
+	}
+}
+
+// expirePosts deletes bridged posts older than post_ttl from Bluesky. Posts
+// that were replied to within post_ttl_grace are kept for now, so a live
+// conversation doesn't lose its root.
+func (b *Bridge) expirePosts(ctx context.Context) {
+	ttl := time.Duration(b.config.PostTTL) * time.Second
+	ids, err := b.db.GetPostsCreatedBefore(time.Now().Add(-ttl))
+	if err != nil {
+		log.Printf("Error getting expired posts: %v", err)
+		return
+	}
+
+	grace := time.Duration(b.config.PostTTLGrace) * time.Second
+	for _, id := range ids {
+		bskyIDs, err := bridgedRecords(b.db, id)
+		if err != nil {
+			log.Printf("Error getting Bluesky posts for expired post %s: %v", id, err)
+			continue
+		}
+
+		if len(bskyIDs) > 0 {
+			rootUri := strings.Split(bskyIDs[0], "|")[0]
+			latest, err := b.bluesky.LatestReplyTime(ctx, rootUri)
+			if err != nil {
+				log.Printf("Error checking replies to expired post %s, keeping it: %v", id, err)
+				continue
+			}
+			if time.Since(latest) < grace {
+				log.Printf("Keeping expired post %s for now, it was replied to %s ago",
+					id, time.Since(latest).Round(time.Minute))
+				continue
 			}
 		}
 
-		if !hasFilterTag {
-			log.Printf("Skipping post %s without required hashtag #%s", post.ID, b.config.FilterHashtag)
-			return nil
+		log.Printf("Deleting expired post %s (%d Bluesky records)", id, len(bskyIDs))
+		failed := false
+		for _, bskyID := range bskyIDs {
+			if err := b.bluesky.DeletePost(ctx, bskyID); err != nil {
+				log.Printf("Error deleting Bluesky post %s: %v", bskyID, err)
+				failed = true
+			}
+		}
+
+		// Keep the mapping so the next pass tries again
+		if failed {
+			continue
+		}
+
+		if err := b.db.DeletePostMapping(id); err != nil {
+			log.Printf("Error deleting mapping for expired post %s: %v", id, err)
+		}
+		b.stats.deleted++
+
+		if b.lastBridged != nil && b.lastBridged.mastodonID == id {
+			b.lastBridged = nil
 		}
 	}
+}
 
-	// Calculate content hash
-	contentHash := hashPostContent(post.Content)
+// mirrorLikes favourites the Mastodon source of recently bridged posts that
+// have been liked on Bluesky
+func (b *Bridge) mirrorLikes(ctx context.Context) {
+	log.Println("Checking for Bluesky likes...")
+	recentIDs, err := b.db.GetRecentPostsToCheckForEdits(20, time.Time{})
+	if err != nil {
+		log.Printf("Error getting recent posts to check for likes: %v", err)
+		return
+	}
 
-	// Check if we've already processed this exact content
-	existingHash, err := b.db.GetContentHash(post.ID)
-	if err == nil && existingHash == contentHash {
-		log.Printf("Post %s content unchanged (hash: %s), skipping", post.ID, contentHash[:8])
-		return nil
+	for _, id := range recentIDs {
+		favourited, err := b.db.IsFavourited(id)
+		if err != nil || favourited {
+			continue
+		}
+
+		bskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(id)
+		if err != nil || len(bskyIDs) == 0 {
+			continue
+		}
+
+		// Likes on the first record of a thread count for the whole post
+		uri := strings.Split(bskyIDs[0], "|")[0]
+		if !strings.Contains(uri, "/app.bsky.feed.post/") {
+			continue
+		}
+
+		likes, err := b.bluesky.GetLikes(ctx, uri)
+		if err != nil {
+			log.Printf("Error getting likes for %s: %v", uri, err)
+			continue
+		}
+
+		if likes == 0 {
+			continue
+		}
+
+		log.Printf("Post %s has %d likes on Bluesky, favouriting on Mastodon", id, likes)
+		if err := b.mastodon.Favourite(ctx, id); err != nil {
+			log.Printf("Error favouriting post %s: %v", id, err)
+			continue
+		}
+
+		if err := b.db.MarkFavourited(id); err != nil {
+			log.Printf("Error saving favourite state for post %s: %v", id, err)
+		}
 	}
+}
 
-	// If we're here, either it's a new post or the content has changed
-	if existingHash != "" {
-		log.Printf("Post %s content changed (hash: %s -> %s), reprocessing",
-			post.ID, existingHash[:8], contentHash[:8])
+// allowNonPublicReply reports whether a non-public post may be bridged
+// anyway because it replies to a bridged post. This publishes content the
+// user gave a narrower audience, so it is opt-in and never applies to DMs.
+func (b *Bridge) allowNonPublicReply(post *mastodon.Post) bool {
+	if b.config.ReplyVisibilityPolicy != "follow_thread" {
+		return false
+	}
 
-		// Delete any existing posts for this ID
-		bskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(post.ID)
-		if err == nil && len(bskyIDs) > 0 {
-			log.Printf("Found %d existing Bluesky posts to delete", len(bskyIDs))
+	if post.InReplyToID == "" || post.Visibility == "direct" {
+		return false
+	}
 
-			// Delete all previous posts
-			for _, id := range bskyIDs {
-				if err := b.bluesky.DeletePost(ctx, id); err != nil {
-					log.Printf("Error deleting Bluesky post %s: %v", id, err)
-				}
-			}
+	return b.isBridged(post.InReplyToID)
+}
+
+// isBridged reports whether a post already has a mapping
+func (b *Bridge) isBridged(id string) bool {
+	bskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(id)
+	return err == nil && len(bskyIDs) > 0
+}
+
+// bridgedRecords returns every Bluesky record made for a post: its thread,
+// then the hashtag reply if it has one
+func bridgedRecords(db Store, id string) ([]string, error) {
+	bskyIDs, err := db.GetBlueskyIDsForMastodonPost(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply, err := db.GetHashtagReply(id); err != nil {
+		log.Printf("Error getting hashtag reply for post %s: %v", id, err)
+	} else if reply != "" {
+		bskyIDs = append(bskyIDs, reply)
+	}
+	return bskyIDs, nil
+}
+
+// queuePost records a post to retry once Bluesky is reachable again
+func (b *Bridge) queuePost(id string) {
+	if err := b.db.QueuePendingPost(id); err != nil {
+		log.Printf("Error queueing post %s: %v", id, err)
+	}
+}
+
+// recordFailedAttempt queues a post that failed to retry later. Once it has
+// failed max_post_attempts times it is marked as failed and dropped, so it
+// doesn't keep tripping the circuit breaker for the posts queued behind it.
+func (b *Bridge) recordFailedAttempt(id string) {
+	attempts, err := b.db.RecordFailedAttempt(id)
+	if err != nil {
+		log.Printf("Error queueing post %s: %v", id, err)
+		return
+	}
+
+	if attempts < b.config.MaxPostAttempts {
+		return
+	}
+
+	log.Printf("WARNING: Giving up on post %s after %d failed attempts", id, attempts)
+
+	// Mark it before dropping it from the queue, so it is never just lost
+	if err := b.db.MarkFailed(id); err != nil {
+		log.Printf("Error marking post %s as failed: %v", id, err)
+		return
+	}
+
+	if err := b.db.RemovePendingPost(id); err != nil {
+		log.Printf("Error removing pending post %s: %v", id, err)
+	}
+}
+
+// processPendingPosts retries queued posts in the order they were queued
+func (b *Bridge) processPendingPosts(ctx context.Context) {
+	if b.config.QuietHours.Contains(time.Now()) {
+		return
+	}
+
+	ids, err := b.db.GetPendingPosts()
+	if err != nil {
+		log.Printf("Error getting pending posts: %v", err)
+		return
+	}
+
+	// Pending posts are oldest first
+	if b.config.MaxBacklog > 0 && len(ids) > b.config.MaxBacklog {
+		excess := len(ids) - b.config.MaxBacklog
+		log.Printf("%d pending posts exceed max_backlog, skipping the oldest %d", len(ids), excess)
+		for _, id := range ids[:excess] {
+			b.skipBacklogPost(id)
 		}
+		ids = ids[excess:]
 	}
 
-	// Handle reply to our own post or another bridged post
-	var parentUri, parentCid string
+	for _, id := range ids {
+		if !b.breaker.Allow() {
+			return
+		}
 
-	if post.InReplyToID != "" {
-		// First, check if we've bridged the parent post ourselves
-		parentBskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(post.InReplyToID)
-		if err == nil && len(parentBskyIDs) > 0 {
-			// We found the parent post, this is a reply to our own post
-			log.Printf("Post %s is a reply to our own bridged post %s", post.ID, post.InReplyToID)
+		post, err := b.mastodon.GetPostWithEdits(ctx, id)
+		if err != nil {
+			log.Printf("Error fetching pending post %s: %v", id, err)
+			b.recordFailedAttempt(id)
+			continue
+		}
 
-			// Get the last part of the parent thread
-			lastParentID := parentBskyIDs[len(parentBskyIDs)-1]
-			parts := strings.Split(lastParentID, "|")
-			if len(parts) == 2 {
-				parentUri = parts[0]
-				parentCid = parts[1]
-			}
-		} else {
-			// We haven't bridged this post - try to find it on Mastodon
-			parentPost, err := b.mastodon.GetPostWithEdits(ctx, post.InReplyToID)
-			if err != nil {
-				log.Printf("Error getting parent post %s: %v", post.InReplyToID, err)
-			} else {
-				if parentPost.Username != "" && parentPost.Instance != "" {
-					// Look up this post on Bluesky via our more robust method
-					log.Printf("Looking for parent post %s by %s@%s (%s) on Bluesky",
-						post.InReplyToID, parentPost.Username, parentPost.Instance, parentPost.DisplayName)
-
-					parentUri, parentCid, err = b.bluesky.LookupBridgedMastodonPost(
-						ctx,
-						post.InReplyToID,
-						parentPost.Username,
-						parentPost.Instance,
-						parentPost.Content,
-						parentPost.DisplayName,
-						parentPost.CreatedAt)
-
-					if err != nil {
-						log.Printf("Could not find parent post on Bluesky: %v", err)
-						// If we can't find the parent post, should we skip this post?
-						log.Printf("Skipping post %s as we can't find the parent", post.ID)
-						return nil
-					}
-
-					log.Printf("Found parent post on Bluesky: %s", parentUri)
-				}
+		log.Printf("Retrying pending post %s", id)
+		if err := b.ProcessPost(ctx, post); errors.Is(err, errParentPending) {
+			// Still queued, for the next poll
+			b.stats.skip("parent_pending")
+			continue
+		} else if err != nil {
+			log.Printf("Error processing pending post %s: %v", id, err)
+			b.stats.errors++
+			if isBlueskyError(err) {
+				b.breaker.RecordFailure()
 			}
+			b.recordFailedAttempt(id)
+			continue
 		}
+		b.breaker.RecordSuccess()
 
-		// If we still haven't found a parent, we should skip this post
-		if parentUri == "" {
-			log.Printf("Skipping post %s as we can't find the parent post to reply to", post.ID)
+		if err := b.db.RemovePendingPost(id); err != nil {
+			log.Printf("Error removing pending post %s: %v", id, err)
+		}
+	}
+}
+
+// skipBacklogPost records that a post was dropped to stay within
+// max_backlog, so it isn't retried later
+func (b *Bridge) skipBacklogPost(id string) {
+	log.Printf("Skipping post %s: over max_backlog", id)
+	b.stats.skip("backlog")
+
+	if err := b.db.MarkSkipped(id); err != nil {
+		log.Printf("Error marking post %s as skipped: %v", id, err)
+	}
+
+	if err := b.db.RemovePendingPost(id); err != nil {
+		log.Printf("Error removing pending post %s: %v", id, err)
+	}
+}
+
+// ProcessPost bridges a new or edited post by running it through the pipeline
+func (b *Bridge) ProcessPost(ctx context.Context, post *mastodon.Post) error {
+	// Bridging a post that came from Bluesky back again would echo it, and
+	// with Bridgy Fed running the other way it would loop forever
+	if b.config.SkipBridgedInPosts {
+		if isBridgedIn(post) {
+			log.Printf("Skipping post %s: it was bridged in from Bluesky", post.ID)
+			b.stats.skip("bridged_in")
+			return nil
+		}
+		if post.Reblog != nil && isBridgedIn(post.Reblog) {
+			log.Printf("Skipping reblog %s: the boosted post was bridged in from Bluesky", post.ID)
+			b.stats.skip("bridged_in")
 			return nil
 		}
 	}
 
-	// Split content if needed and post to Bluesky
-	parts := splitContent(post.Content)
+	if post.Reblog != nil {
+		return b.ProcessReblog(ctx, post)
+	}
+
+	return b.runPipeline(ctx, post)
+}
 
+// bridgyFedBlueskyDomain is where Bridgy Fed serves bridged Bluesky
+// accounts and posts from
+const bridgyFedBlueskyDomain = "bsky.brid.gy"
+
+// isBridgedIn reports whether a post originated on Bluesky and reached
+// Mastodon through Bridgy Fed. Either its author lives on the Bridgy Fed
+// Bluesky domain, or its ActivityPub ID points at it.
+func isBridgedIn(post *mastodon.Post) bool {
+	if strings.EqualFold(post.Instance, bridgyFedBlueskyDomain) {
+		return true
+	}
+
+	uri, err := url.Parse(post.URI)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(uri.Hostname(), bridgyFedBlueskyDomain)
+}
+
+// createThread posts parts as a thread, replying to the given parent if
+// there is one, and returns the URI|CID of every record created. Each part
+// gets the attachments at the same index. If any part fails, the parts
+// already created are deleted again.
+func (b *Bridge) createThread(ctx context.Context, parts []string, attachments [][]attachment,
+	parentUri, parentCid string, meta bluesky.PostMeta) ([]string, error) {
 	var bskyIDs []string
 	var lastUri, lastCid string
+	var rootUri, rootCid string
 
 	// If this is a reply to our own post, use the parent's information
 	if parentUri != "" && parentCid != "" {
 		lastUri = parentUri
 		lastCid = parentCid
+		rootUri, rootCid = threadRoot(ctx, b.bluesky, parentUri, parentCid)
 	}
 
 	for i, part := range parts {
 		// Double check length before posting
-		if len(part) > 300 {
-			log.Printf("WARNING: Part %d still too long (%d chars), truncating", i+1, len(part))
-			part = part[:297] + "..."
+		if graphemeLen(part) > 300 {
+			log.Printf("WARNING: Part %d still too long (%d chars), truncating", i+1, graphemeLen(part))
+			part = part[:graphemeOffset(part, 297)] + "..."
 		}
 
-		if part == "" {
+		var partAttachments []attachment
+		if i < len(attachments) {
+			partAttachments = attachments[i]
+		}
+
+		if part == "" && len(partAttachments) == 0 {
 			log.Printf("WARNING: Skipping empty post content (part %d)", i+1)
 			continue
 		}
 
-		var result string
-		var err error
-
 		// Add a small delay between posts to avoid rate limits
 		if i > 0 {
 			time.Sleep(500 * time.Millisecond)
 		}
 
-		if i == 0 && parentUri == "" && parentCid == "" {
+		if lastUri == "" {
 			// First post in a new thread
 			log.Printf("Creating initial post (part %d/%d, length: %d): %s",
 				i+1, len(parts), len(part), truncateForLog(part))
-			result, err = b.bluesky.CreatePost(ctx, part)
 		} else {
 			// Reply to either the parent post or the previous post in the thread
 			log.Printf("Creating reply post (part %d/%d, length: %d): %s",
 				i+1, len(parts), len(part), truncateForLog(part))
-			result, err = b.bluesky.CreateReply(ctx, part, lastCid, lastUri)
+		}
+
+		// A link card belongs at the end of the thread, and a quote at the
+		// start
+		meta := meta
+		if i < len(parts)-1 {
+			meta.External = nil
+		}
+		if i > 0 {
+			meta.Quote = nil
+		}
+
+		// With thread_rate_limit_mode wait, a rate limit on any attempt at
+		// the part is waited out rather than tearing down what is already
+		// posted
+		create := func(partAttachments []attachment, meta bluesky.PostMeta) (string, error) {
+			result, err := b.createPart(ctx, part, partAttachments, meta, rootUri, rootCid, lastUri, lastCid)
+			for wait := 0; b.config.ThreadRateLimitMode == "wait" && wait < maxRateLimitWaits; wait++ {
+				var rateErr *bluesky.RateLimitError
+				if !errors.As(err, &rateErr) {
+					break
+				}
+
+				delay := rateErr.RetryAfter
+				if delay == 0 {
+					delay = defaultRateLimitWait
+				}
+				if delay > maxRateLimitWait {
+					log.Printf("Rate limited on part %d for %s, too long to wait", i+1, delay)
+					break
+				}
+
+				log.Printf("Rate limited on part %d, waiting %s to carry on with the thread", i+1, delay)
+				select {
+				case <-ctx.Done():
+					return "", ctx.Err()
+				case <-time.After(delay):
+					result, err = b.createPart(ctx, part, partAttachments, meta, rootUri, rootCid, lastUri, lastCid)
+				}
+			}
+			return result, err
+		}
+
+		result, err := create(partAttachments, meta)
+
+		// Cached blobs may have been garbage-collected, upload them again and retry once
+		if errors.Is(err, bluesky.ErrBlobNotFound) {
+			log.Printf("Cached media for part %d has expired, uploading again", i+1)
+			partAttachments = b.reuploadMedia(ctx, partAttachments)
+			result, err = create(partAttachments, meta)
+		}
+
+		// Rather than lose the part to a bad facet, post it as plain text
+		var facetErr *bluesky.FacetError
+		if errors.As(err, &facetErr) {
+			log.Printf("WARNING: Part %d has an invalid facet, posting it without facets: %v", i+1, facetErr)
+			plain := meta
+			plain.NoFacets = true
+			result, err = create(partAttachments, plain)
 		}
 
 		if err != nil {
@@ -362,7 +980,7 @@ func (b *Bridge) ProcessPost(ctx context.Context, post *mastodon.Post) error {
 					b.bluesky.DeletePost(ctx, parts[0])
 				}
 			}
-			return err
+			return nil, &blueskyError{err}
 		}
 
 		// Split the result into URI and CID
@@ -377,32 +995,95 @@ func (b *Bridge) ProcessPost(ctx context.Context, post *mastodon.Post) error {
 
 		// Store the full result for mapping
 		bskyIDs = append(bskyIDs, result)
+
+		if b.config.VerifyAfterPost {
+			if err := b.verifyPost(ctx, lastUri, lastCid); err != nil {
+				log.Printf("Error verifying part %d: %v", i+1, err)
+				for _, id := range bskyIDs {
+					b.bluesky.DeletePost(ctx, strings.Split(id, "|")[0])
+				}
+				return nil, &blueskyError{err}
+			}
+		}
+
+		// The first post of a new thread is the root for the rest
+		if rootUri == "" {
+			rootUri = lastUri
+			rootCid = lastCid
+		}
 	}
 
-	// Store the mapping in the database
-	if err := b.db.SavePostMapping(post.ID, bskyIDs); err != nil {
-		log.Printf("Error saving post mapping: %v", err)
+	return bskyIDs, nil
+}
+
+// verifyPost checks that a post we just created can be read back, for
+// verify_after_post
+func (b *Bridge) verifyPost(ctx context.Context, uri, cid string) error {
+	exists, err := b.bluesky.RecordExists(ctx, uri, cid)
+	if err != nil {
+		return fmt.Errorf("reading back %s: %w", uri, err)
 	}
+	if !exists {
+		return fmt.Errorf("post %s was accepted but can't be found", uri)
+	}
+	return nil
+}
 
-	// Store the content hash
-	if err := b.db.SaveContentHash(post.ID, contentHash); err != nil {
-		log.Printf("Error saving content hash: %v", err)
+// createPart creates one post of a thread, as a new post if there is nothing
+// to reply to yet
+func (b *Bridge) createPart(ctx context.Context, text string, attachments []attachment, meta bluesky.PostMeta,
+	rootUri, rootCid, lastUri, lastCid string) (string, error) {
+	if lastUri == "" {
+		return b.bluesky.CreatePost(ctx, text, meta, blueskyImages(attachments)...)
 	}
 
-	return nil
+	return b.bluesky.CreateReply(ctx, text,
+		bluesky.StrongRef{URI: rootUri, CID: rootCid},
+		bluesky.StrongRef{URI: lastUri, CID: lastCid},
+		meta, blueskyImages(attachments)...)
+}
+
+// threadRoot finds the root of the thread a parent post belongs to, so
+// replies point at the real root rather than at the post they reply to
+func threadRoot(ctx context.Context, bsky *bluesky.Client, parentUri, parentCid string) (string, string) {
+	reply, err := bsky.GetRecordReply(ctx, parentUri)
+	if err != nil {
+		log.Printf("Error getting thread root for %s, using parent as root: %v", parentUri, err)
+		return parentUri, parentCid
+	}
+
+	if reply == nil {
+		return parentUri, parentCid
+	}
+
+	return reply.Root.URI, reply.Root.CID
 }
 
 func (b *Bridge) ProcessReblog(ctx context.Context, post *mastodon.Post) error {
-	// Skip non-public posts
-	if post.Visibility != "public" || post.Reblog.Visibility != "public" {
-		log.Printf("Skipping non-public reblog: %s (visibility: %s/%s)",
-			post.ID, post.Visibility, post.Reblog.Visibility)
+	if b.config.BoostAttributionMode == "skip" {
+		log.Printf("Skipping reblog %s (boost_attribution_mode is skip)", post.ID)
+		b.stats.skip("reblog")
 		return nil
 	}
 
 	// Skip if reblog is nil or has empty content
 	if post.Reblog == nil || post.Reblog.Content == "" {
 		log.Printf("Skipping reblog with empty content: %s", post.ID)
+		b.stats.skip("reblog")
+		return nil
+	}
+
+	if post.Reblog.LocalOnly {
+		log.Printf("Skipping reblog %s of a local-only post", post.ID)
+		b.stats.skip("reblog")
+		return nil
+	}
+
+	// Skip non-public posts
+	if post.Visibility != "public" || post.Reblog.Visibility != "public" {
+		log.Printf("Skipping non-public reblog: %s (visibility: %s/%s)",
+			post.ID, post.Visibility, post.Reblog.Visibility)
+		b.stats.skip("reblog")
 		return nil
 	}
 
@@ -418,23 +1099,26 @@ func (b *Bridge) ProcessReblog(ctx context.Context, post *mastodon.Post) error {
 
 		if !hasFilterTag {
 			log.Printf("Skipping reblog %s without required hashtag #%s", post.ID, b.config.FilterHashtag)
+			b.stats.skip("reblog")
 			return nil
 		}
 	}
 
 	// Track reblog with content hash
-	contentHash := hashPostContent(post.Reblog.ID + ":" + post.Reblog.Content)
+	contentHash := hashPostContent(post.Reblog.ID+":"+post.Reblog.Content, b.config.EditSensitivity)
 
 	// Check if already processed
 	existingHash, err := b.db.GetContentHash(post.ID)
 	if err == nil && existingHash == contentHash {
 		log.Printf("Reblog %s unchanged (hash: %s), skipping", post.ID, contentHash[:8])
+		b.stats.skip("unchanged")
 		return nil
 	}
 
 	// If detecting a change to empty content, don't delete the original
 	if existingHash != "" && post.Reblog.Content == "" {
 		log.Printf("Reblog %s was edited to empty content, preserving original", post.ID)
+		b.stats.skip("reblog")
 		return nil
 	}
 
@@ -450,11 +1134,22 @@ func (b *Bridge) ProcessReblog(ctx context.Context, post *mastodon.Post) error {
 		}
 	}
 
+	// A boost of our own bridged post reposts the record we already made
+	var ownUri, ownCid string
+	if b.config.BridgeSelfBoosts {
+		ownIDs, err := b.db.GetBlueskyIDsForMastodonPost(post.Reblog.ID)
+		if err == nil && len(ownIDs) > 0 {
+			if ref := strings.Split(ownIDs[0], "|"); len(ref) == 2 {
+				ownUri, ownCid = ref[0], ref[1]
+			}
+		}
+	}
+
 	// Try to find original post on Bluesky
 	var originalUri, originalCid string
 	var lookupErr error
 
-	if post.Reblog.Username != "" && post.Reblog.Instance != "" {
+	if ownUri == "" && post.Reblog.Username != "" && post.Reblog.Instance != "" {
 		log.Printf("Looking for original post %s by %s@%s on Bluesky",
 			post.Reblog.ID, post.Reblog.Username, post.Reblog.Instance)
 
@@ -468,27 +1163,78 @@ func (b *Bridge) ProcessReblog(ctx context.Context, post *mastodon.Post) error {
 			post.Reblog.CreatedAt)
 	}
 
-	// If found, create a proper repost; otherwise skip
-	if lookupErr == nil && originalUri != "" && originalCid != "" {
+	found := lookupErr == nil && originalUri != "" && originalCid != ""
+
+	var bskyIDs []string
+	switch {
+	case ownUri != "":
+		log.Printf("Reblog %s boosts our own bridged post %s, reposting it: %s", post.ID, post.Reblog.ID, ownUri)
+
+		result, err := b.bluesky.CreateRepost(ctx, ownUri, ownCid)
+		if err != nil {
+			log.Printf("Error creating Bluesky repost: %v", err)
+			return &blueskyError{err}
+		}
+		bskyIDs = []string{result}
+
+	case found && b.config.BoostAttributionMode == "quote":
+		log.Printf("Found original post on Bluesky, creating quote post: %s", originalUri)
+
+		result, err := b.bluesky.CreateQuote(ctx, b.config.PrefixByType.Boost, bluesky.StrongRef{URI: originalUri, CID: originalCid})
+		if err != nil {
+			log.Printf("Error creating Bluesky quote post: %v", err)
+			return &blueskyError{err}
+		}
+		bskyIDs = []string{result}
+
+	case found:
 		log.Printf("Found original post on Bluesky, creating repost: %s", originalUri)
 
 		result, err := b.bluesky.CreateRepost(ctx, originalUri, originalCid)
 		if err != nil {
 			log.Printf("Error creating Bluesky repost: %v", err)
-			return err
+			return &blueskyError{err}
 		}
+		bskyIDs = []string{result}
+
+	case b.config.BoostAttributionMode == "attributed_text":
+		// The author isn't on Bluesky, so post their content under our account
+		log.Printf("Original post not found on Bluesky, bridging reblog %s as attributed text", post.ID)
 
-		// Save mapping and content hash
-		if err := b.db.SavePostMapping(post.ID, []string{result}); err != nil {
-			log.Printf("Error saving post mapping: %v", err)
+		text := fmt.Sprintf("🔁 @%s@%s:\n\n%s", post.Reblog.Username, post.Reblog.Instance, post.Reblog.Content)
+		text, attachments, err := b.prepareMedia(ctx, text, post.Reblog.Media)
+		if err != nil {
+			return err
 		}
+		parts, partAttachments := b.groupAttachments(splitContent(text, postSignature(b.config, post), b.config.FirstIndicatorFormat, b.config.RestIndicatorFormat, b.config.RebalanceParts), attachments)
 
-		if err := b.db.SaveContentHash(post.ID, contentHash); err != nil {
-			log.Printf("Error saving content hash: %v", err)
+		bskyIDs, err = b.createThread(ctx, parts, partAttachments, "", "", bluesky.PostMeta{})
+		if err != nil {
+			return err
 		}
-	} else {
+
+	default:
 		// Skip if original post not found
 		log.Printf("Original post not found on Bluesky, skipping reblog")
+		b.stats.skip("reblog")
+		return nil
+	}
+
+	// Save mapping and content hash
+	if err := b.db.SavePostMapping(post.ID, bskyIDs, post.CreatedAt); err != nil {
+		log.Printf("Error saving post mapping: %v", err)
+	}
+
+	if err := b.db.SaveContentHash(post.ID, contentHash); err != nil {
+		log.Printf("Error saving content hash: %v", err)
+	}
+
+	b.runPostHook(post.ID, bskyIDs)
+
+	if existingHash != "" {
+		b.stats.edited++
+	} else {
+		b.stats.bridged++
 	}
 
 	return nil
@@ -503,35 +1249,172 @@ func truncateForLog(text string) string {
 	return text[:maxLogLength-3] + "..."
 }
 
-// splitContent splits text into parts that fit within Bluesky's character limit
-func splitContent(content string) []string {
+var (
+	repeatedSpacePattern   = regexp.MustCompile(`[ \t]+`)
+	repeatedNewlinePattern = regexp.MustCompile(`\n\s*\n`)
+)
+
+// shortenToFit tries to make content fit in maxLength without losing
+// anything meaningful, by collapsing whitespace and then dropping trailing
+// hashtags. It reports whether the result fits.
+func shortenToFit(content string, maxLength int) (string, bool) {
+	content = repeatedSpacePattern.ReplaceAllString(content, " ")
+	content = repeatedNewlinePattern.ReplaceAllString(content, "\n")
+	content = strings.TrimSpace(content)
+
+	for graphemeLen(content) > maxLength {
+		cut := strings.LastIndexAny(content, " \n")
+		if cut == -1 || !strings.HasPrefix(content[cut+1:], "#") {
+			break
+		}
+		content = strings.TrimSpace(content[:cut])
+	}
+
+	return content, graphemeLen(content) <= maxLength
+}
+
+// truncateWithLink cuts content short at a word boundary so that it fits in
+// a single post followed by an ellipsis, the link and the signature
+func truncateWithLink(content string, link string, signature string) string {
+	const maxLength = 300
+
+	tail := "…\n\n" + link
+	if signature != "" {
+		tail += "\n\n" + signature
+	}
+
+	room := maxLength - graphemeLen(tail)
+	if room <= 0 {
+		return link
+	}
+
+	content = strings.TrimSpace(content)
+	if graphemeLen(content) > room {
+		cut := strings.LastIndexAny(content[:graphemeOffset(content, room+1)], " \n")
+		if cut <= 0 {
+			// No word boundary, so cut at the last whole grapheme
+			cut = graphemeOffset(content, room)
+		}
+		content = strings.TrimSpace(content[:cut])
+	}
+
+	return content + tail
+}
+
+// splitTrailingHashtags separates a run of hashtags at the end of content
+// from the rest. Nothing is split off if the post is only hashtags.
+func splitTrailingHashtags(content string) (string, string) {
+	body := strings.TrimSpace(content)
+	var tags []string
+
+	for {
+		cut := strings.LastIndexAny(body, " \t\n")
+		word := body[cut+1:]
+		if !strings.HasPrefix(word, "#") || len(word) == 1 {
+			break
+		}
+		if cut == -1 {
+			// Everything is a hashtag
+			return content, ""
+		}
+		tags = append([]string{word}, tags...)
+		body = strings.TrimSpace(body[:cut])
+	}
+
+	if len(tags) == 0 {
+		return content, ""
+	}
+
+	return body, strings.Join(tags, " ")
+}
+
+// splitContent splits text into parts that fit within Bluesky's character
+// limit, ending the last part with the signature if there is one. The first
+// part's indicator uses firstFormat and every other part's restFormat.
+func splitContent(content string, signature string, firstFormat, restFormat string, rebalance bool) []string {
+	const maxLength = 300
+
+	if signature != "" {
+		signature = "\n\n" + signature
+	}
+
+	// In right-to-left posts, URLs and the part indicators are isolated so
+	// they don't scramble the text around them
+	rtl := isRTL(content)
+	if rtl {
+		content = isolateURLs(content)
+	}
+
+	// Bluesky counts graphemes, so a post of exactly 300 of them, however
+	// many bytes they take, still fits in one record
+	if graphemeLen(content)+graphemeLen(signature) <= maxLength {
+		return []string{content + signature}
+	}
+
+	// The part suffixes need room, and their widest rendering is the one
+	// with the largest numbers, so the text is split for an estimate of the
+	// part count. If that comes out short, as when the count reaches 10,
+	// the wider suffixes may not fit, so it is split again for the count it
+	// came to. A longer count only ever makes more parts, so this ends, and
+	// a count that comes out lower than reserved for still fits.
+	total := (graphemeLen(content) + maxLength - 1) / (maxLength - 10)
+	parts := splitParts(content, signature, firstFormat, restFormat, rebalance, rtl, total)
+	for len(parts) > total {
+		total = len(parts)
+		parts = splitParts(content, signature, firstFormat, restFormat, rebalance, rtl, total)
+	}
+
+	// Now add the part indicators
+	for i := range parts {
+		format := restFormat
+		if i == 0 {
+			format = firstFormat
+		}
+		parts[i] = parts[i] + partSuffix(format, i+1, len(parts), rtl)
+	}
+
+	return parts
+}
+
+// splitParts splits content into parts with room for the indicators of a
+// thread of total parts, and adds the signature, but not the indicators
+func splitParts(content string, signature string, firstFormat, restFormat string, rebalance, rtl bool, total int) []string {
 	const maxLength = 300
 
-	if len(content) <= maxLength {
-		return []string{content}
+	// The first part's indicator may differ from the rest, so each
+	// reserves room for its own
+	firstMaxLength := maxLength - graphemeLen(partSuffix(firstFormat, 1, total, rtl))
+	restMaxLength := maxLength - graphemeLen(partSuffix(restFormat, total, total, rtl))
+	maxLengthAt := func(i int) int {
+		if i == 0 {
+			return firstMaxLength
+		}
+		return restMaxLength
 	}
 
 	var parts []string
+	var starts []int
 	remaining := content
 	partCount := 0
 
-	// First, estimate how many parts we'll need
-	// This helps us reserve space for "(n/total)" suffixes
-	estimatedTotal := (len(content) + maxLength - 1) / (maxLength - 10)
-	suffixSize := len(fmt.Sprintf(" (%d/%d)", estimatedTotal, estimatedTotal))
-	effectiveMaxLength := maxLength - suffixSize
-
 	for len(remaining) > 0 {
+		effectiveMaxLength := maxLengthAt(partCount)
 		partCount++
+		starts = append(starts, len(content)-len(remaining))
 
-		if len(remaining) <= effectiveMaxLength {
+		if graphemeLen(remaining) <= effectiveMaxLength {
 			// Last part fits completely
 			parts = append(parts, remaining)
 			break
 		}
 
+		// The limits in graphemes as byte offsets, so a part is never cut
+		// in the middle of a character
+		limit := graphemeOffset(remaining, effectiveMaxLength)
+		half := graphemeOffset(remaining, effectiveMaxLength/2)
+
 		// Find a good breaking point - look for a space
-		breakPoint := effectiveMaxLength
+		breakPoint := limit
 
 		// Move back to find a space
 		for breakPoint > 0 && remaining[breakPoint] != ' ' {
@@ -539,10 +1422,10 @@ func splitContent(content string) []string {
 		}
 
 		// If no space found in reasonable range, break at a character boundary
-		if breakPoint < effectiveMaxLength/2 {
+		if breakPoint < half {
 			// Try forward for a space instead
-			breakPoint = effectiveMaxLength / 2
-			for i := breakPoint; i < min(effectiveMaxLength, len(remaining)); i++ {
+			breakPoint = half
+			for i := breakPoint; i < min(limit, len(remaining)); i++ {
 				if remaining[i] == ' ' {
 					breakPoint = i
 					break
@@ -550,8 +1433,8 @@ func splitContent(content string) []string {
 			}
 
 			// If still no good position, just break at effective max length
-			if breakPoint < effectiveMaxLength/2 || breakPoint == effectiveMaxLength/2 {
-				breakPoint = effectiveMaxLength
+			if breakPoint <= half {
+				breakPoint = limit
 			}
 		}
 
@@ -566,17 +1449,247 @@ func splitContent(content string) []string {
 		}
 	}
 
-	// Now add the part indicators
-	for i := range parts {
-		parts[i] = parts[i] + fmt.Sprintf(" (%d/%d)", i+1, len(parts))
+	// Rather than end on a few stray words, share the text of the last two
+	// parts out evenly
+	if last := len(parts) - 1; rebalance && last > 0 && len(parts[last]) < orphanPartLength {
+		first, second, ok := rebalanceParts(content[starts[last-1]:], maxLengthAt(last-1), maxLengthAt(last), len(signature))
+		if ok {
+			parts[last-1], parts[last] = first, second
+		}
+	}
+
+	// The signature goes on the last part if it fits, otherwise it gets a
+	// part of its own
+	if signature != "" {
+		last := len(parts) - 1
+		if graphemeLen(parts[last])+graphemeLen(signature) <= maxLengthAt(last) {
+			parts[last] += signature
+		} else {
+			parts = append(parts, strings.TrimPrefix(signature, "\n\n"))
+		}
 	}
 
 	return parts
 }
 
-// hashPostContent creates a consistent hash of post content
-func hashPostContent(content string) string {
+// rebalanceParts splits text, the last two parts of a thread, at the space
+// that makes them closest in length, counting the signature the second one
+// will end with. It reports false if no split fits both parts.
+func rebalanceParts(text string, firstMax, secondMax, signatureLen int) (string, string, bool) {
+	best, bestDiff := -1, 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != ' ' {
+			continue
+		}
+
+		first, second := len(text[:i]), len(text[i+1:])+signatureLen
+		if first > firstMax || second > secondMax {
+			continue
+		}
+
+		diff := first - second
+		if diff < 0 {
+			diff = -diff
+		}
+		if best == -1 || diff < bestDiff {
+			best, bestDiff = i, diff
+		}
+	}
+
+	if best == -1 {
+		return "", "", false
+	}
+	return text[:best], text[best+1:], true
+}
+
+// partSuffix renders the thread_suffix indicator, " (n/total)" by default,
+// at the end of a thread part
+func partSuffix(format string, n, total int, rtl bool) string {
+	indicator := strings.NewReplacer(
+		"{n}", strconv.Itoa(n),
+		"{total}", strconv.Itoa(total),
+	).Replace(format)
+
+	// The separator stays outside the isolate
+	if rtl {
+		trimmed := strings.TrimLeftFunc(indicator, unicode.IsSpace)
+		indicator = indicator[:len(indicator)-len(trimmed)] + isolate(trimmed)
+	}
+	return indicator
+}
+
+// graphemeLen approximates how many graphemes Bluesky counts in s, treating
+// combining marks, variation selectors, skin tones and joined emoji as part
+// of the character before them, and a pair of regional indicators as one
+// flag
+func graphemeLen(s string) int {
+	count := 0
+	bluesky.GraphemeStarts(s, func(int) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// graphemeOffset returns the byte offset just past the first n graphemes of
+// s, counted as graphemeLen counts them, or len(s) if it is shorter
+func graphemeOffset(s string, n int) int {
+	offset := len(s)
+	count := 0
+	bluesky.GraphemeStarts(s, func(i int) bool {
+		if count == n {
+			offset = i
+			return false
+		}
+		count++
+		return true
+	})
+	return offset
+}
+
+// postHash is the content hash used to detect edits. The content warning and
+// any media passed in are included so changing them counts as an edit, but
+// posts without either hash the same as they always have.
+func postHash(content string, spoilerText string, media []mastodon.Media, sensitivity string) string {
+	content = withContentWarning(content, spoilerText)
+
+	// Media IDs change when an image is swapped, descriptions when alt text
+	// is fixed
+	for _, m := range media {
+		content += "\x00media:" + m.ID + ":" + m.Description
+	}
+
+	return hashPostContent(content, sensitivity)
+}
+
+// upgradeLegacyHash stores a post's current hash in place of one saved
+// before content warnings were hashed, so upgrading doesn't make every post
+// with a content warning look edited. It reports whether the stored hash
+// was such a legacy hash.
+func (b *Bridge) upgradeLegacyHash(post *mastodon.Post, oldHash string, newHash string) bool {
+	if post.SpoilerText == "" || oldHash == "" {
+		return false
+	}
+
+	if postHash(post.Content, "", hashedMedia(b.config, post), b.config.EditSensitivity) != oldHash {
+		return false
+	}
+
+	if b.dryRun {
+		return true
+	}
+
+	if err := b.db.SaveContentHash(post.ID, newHash); err != nil {
+		log.Printf("Error upgrading content hash for post %s: %v", post.ID, err)
+	} else {
+		log.Printf("Upgraded content hash for post %s to include its content warning", post.ID)
+	}
+	return true
+}
+
+// hashedMedia returns the media that goes into a post's hash, which is none
+// unless hash_includes_media is set
+func hashedMedia(cfg *config.Config, post *mastodon.Post) []mastodon.Media {
+	if !cfg.HashIncludesMedia {
+		return nil
+	}
+	return post.Media
+}
+
+// altlessHash is a post's hash with its media but without their alt text
+func altlessHash(cfg *config.Config, post *mastodon.Post) string {
+	media := make([]mastodon.Media, len(post.Media))
+	for i, m := range post.Media {
+		m.Description = ""
+		media[i] = m
+	}
+	return postHash(post.Content, post.SpoilerText, media, cfg.EditSensitivity)
+}
+
+// withContentWarning prefixes content with its content warning, if any
+func withContentWarning(content string, spoilerText string) string {
+	if spoilerText == "" {
+		return content
+	}
+	return "[CW: " + spoilerText + "]\n\n" + content
+}
+
+// postSignature is the signature that ends a bridged post, followed by
+// bot_marker if the post is from a bot account
+func postSignature(cfg *config.Config, post *mastodon.Post) string {
+	if !post.Bot || cfg.BotMarker == "" {
+		return cfg.Signature
+	}
+	if cfg.Signature == "" {
+		return cfg.BotMarker
+	}
+	return cfg.Signature + " " + cfg.BotMarker
+}
+
+// spoilerLabelWords map words in a content warning to the Bluesky
+// self-label that covers them
+var spoilerLabelWords = map[string]string{
+	"nsfw":     "sexual",
+	"lewd":     "sexual",
+	"sexual":   "sexual",
+	"nude":     "nudity",
+	"nudity":   "nudity",
+	"porn":     "porn",
+	"gore":     "graphic-media",
+	"blood":    "graphic-media",
+	"graphic":  "graphic-media",
+	"violence": "graphic-media",
+}
+
+// spoilerLabel returns the self-label a content warning can be shown as, or
+// "" if it isn't about anything Bluesky has a label for
+func spoilerLabel(spoilerText string) string {
+	for _, word := range strings.FieldsFunc(strings.ToLower(spoilerText), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		if label, ok := spoilerLabelWords[word]; ok {
+			return label
+		}
+	}
+	return ""
+}
+
+// applyContentWarning returns the bridged text and self-labels for a post's
+// content warning. With cw_mode label, a warning Bluesky has a label for
+// becomes just that label. Everything else keeps the warning as a prefix,
+// labelled with cw_label if that is set.
+func applyContentWarning(cfg *config.Config, content string, spoilerText string) (string, []string) {
+	if spoilerText == "" {
+		return content, nil
+	}
+
+	if cfg.CWMode == "label" {
+		if label := spoilerLabel(spoilerText); label != "" {
+			return content, []string{label}
+		}
+	}
+
+	var labels []string
+	if cfg.CWLabel != "" {
+		labels = []string{cfg.CWLabel}
+	}
+	return withContentWarning(content, spoilerText), labels
+}
+
+// hashPostContent creates a consistent hash of post content. In normalized
+// mode, cosmetic whitespace and Unicode form changes don't change the hash.
+func hashPostContent(content string, sensitivity string) string {
+	if sensitivity == "normalized" {
+		content = normalizeForHash(content)
+	}
+
 	hasher := sha256.New()
 	hasher.Write([]byte(content))
 	return hex.EncodeToString(hasher.Sum(nil))
 }
+
+// normalizeForHash collapses whitespace and applies Unicode NFC
+func normalizeForHash(content string) string {
+	content = norm.NFC.String(content)
+	return strings.Join(strings.Fields(content), " ")
+}
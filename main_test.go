@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateWithLink(t *testing.T) {
+	const link = "https://example.social/@me/111"
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "ascii words", content: strings.Repeat("word ", 100)},
+		{name: "multibyte letters", content: strings.Repeat("ünïcødé ", 60)},
+		{name: "emoji without spaces", content: strings.Repeat("👍🏽", 400)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateWithLink(tt.content, link, "")
+			if n := graphemeLen(got); n > 300 {
+				t.Errorf("got %d graphemes, want at most 300", n)
+			}
+			if !strings.HasSuffix(got, "…\n\n"+link) {
+				t.Errorf("got %q, want it to end with the link", got)
+			}
+			// The room is measured in graphemes, so multibyte text isn't
+			// cut far shorter than it has to be
+			if n := graphemeLen(got); n < 250 {
+				t.Errorf("got %d graphemes, want close to 300", n)
+			}
+		})
+	}
+}
+
+func TestHashtagReplyKeptOutOfMapping(t *testing.T) {
+	db := newTestDatabase(t)
+
+	thread := []string{"at://did:plc:me/app.bsky.feed.post/1|cid1", "at://did:plc:me/app.bsky.feed.post/2|cid2"}
+	reply := "at://did:plc:me/app.bsky.feed.post/3|cid3"
+	if err := db.SavePostMapping("1", thread, time.Now()); err != nil {
+		t.Fatalf("saving mapping: %v", err)
+	}
+	if err := db.SaveHashtagReply("1", reply); err != nil {
+		t.Fatalf("saving hashtag reply: %v", err)
+	}
+
+	// Replies chain from the mapping, whose tail is the last content part
+	mapped, err := db.GetBlueskyIDsForMastodonPost("1")
+	if err != nil {
+		t.Fatalf("getting mapping: %v", err)
+	}
+	if got := mapped[len(mapped)-1]; got != thread[1] {
+		t.Errorf("mapping ends with %s, want the last content part %s", got, thread[1])
+	}
+
+	// Deleting the post still finds the hashtag reply
+	records, err := bridgedRecords(db, "1")
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	if len(records) != 3 || records[2] != reply {
+		t.Errorf("got records %v, want the thread then the hashtag reply", records)
+	}
+
+	if err := db.DeletePostMapping("1"); err != nil {
+		t.Fatalf("deleting mapping: %v", err)
+	}
+	if got, _ := db.GetHashtagReply("1"); got != "" {
+		t.Errorf("hashtag reply %s survived deleting the mapping", got)
+	}
+}
+
+func TestIsRTL(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"مرحبا بالعالم https://example.com", true},
+		{"שלום עולם", true},
+		{"Hello world", false},
+		{"Hello مرحبا world", false},
+		{"12345 !?", false},
+	}
+
+	for _, tt := range tests {
+		if got := isRTL(tt.text); got != tt.want {
+			t.Errorf("isRTL(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSplitContentRTL(t *testing.T) {
+	const url = "https://example.com/article"
+	content := strings.Repeat("هذا نص عربي طويل ", 20) + url + " " + strings.Repeat("وهنا المزيد من النص ", 20)
+
+	parts := splitContent(content, "", " ({n}/{total})", " ({n}/{total})", false)
+	if len(parts) < 2 {
+		t.Fatalf("got %d parts, want a thread", len(parts))
+	}
+
+	joined := strings.Join(parts, "")
+	if !strings.Contains(joined, isolate(url)) {
+		t.Errorf("URL isn't wrapped in bidi isolates")
+	}
+
+	for i, part := range parts {
+		if n := graphemeLen(part); n > 300 {
+			t.Errorf("part %d is %d graphemes, want at most 300", i+1, n)
+		}
+
+		// The indicator is isolated, with the separating space outside
+		suffix := " " + isolate(fmt.Sprintf("(%d/%d)", i+1, len(parts)))
+		if !strings.HasSuffix(part, suffix) {
+			t.Errorf("part %d = %q, want it to end with %q", i+1, part, suffix)
+		}
+	}
+}
+
+func TestSplitContentLTRNotIsolated(t *testing.T) {
+	content := strings.Repeat("plain english words ", 20) + "https://example.com"
+
+	for _, part := range splitContent(content, "", " ({n}/{total})", " ({n}/{total})", false) {
+		if strings.ContainsAny(part, firstStrongIsolate+popDirectionalIsolate) {
+			t.Errorf("left-to-right part %q has bidi isolates", part)
+		}
+	}
+}
+
+func TestSplitContentFitsAcrossIndicatorWidths(t *testing.T) {
+	tests := []struct {
+		name    string
+		word    string
+		length  int
+		atLeast int
+	}{
+		// Long words break parts near half their length, so the first
+		// estimate of 8 parts comes out as 10, whose wider indicators have
+		// to be made room for
+		{name: "count reaches 10", word: strings.Repeat("x", 103), length: 2165, atLeast: 10},
+		{name: "count reaches 12", word: strings.Repeat("x", 100), length: 2515, atLeast: 12},
+		{name: "ordinary words", word: "word", length: 2900, atLeast: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := strings.Repeat(tt.word+" ", tt.length/(len(tt.word)+1)+1)[:tt.length]
+
+			parts := splitContent(content, "", " ({n}/{total})", " ({n}/{total})", false)
+			if len(parts) < tt.atLeast {
+				t.Fatalf("got %d parts, want at least %d", len(parts), tt.atLeast)
+			}
+			for i, part := range parts {
+				if n := graphemeLen(part); n > 300 {
+					t.Errorf("part %d/%d is %d graphemes", i+1, len(parts), n)
+				}
+				if suffix := fmt.Sprintf(" (%d/%d)", i+1, len(parts)); !strings.HasSuffix(part, suffix) {
+					t.Errorf("part %d doesn't end with %q", i+1, suffix)
+				}
+			}
+		})
+	}
+}
+
+func TestPartSuffix(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		n      int
+		total  int
+		rtl    bool
+		want   string
+	}{
+		{name: "default", format: " ({n}/{total})", n: 2, total: 5, want: " (2/5)"},
+		{name: "emoji first", format: " 🧵 {n}/{total}", n: 1, total: 3, want: " 🧵 1/3"},
+		{name: "without the count", format: " 🧵", n: 1, total: 3, want: " 🧵"},
+		{name: "right to left", format: " {n}/{total}", n: 1, total: 2, rtl: true, want: " " + isolate("1/2")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partSuffix(tt.format, tt.n, tt.total, tt.rtl); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitContentIndicatorFormats(t *testing.T) {
+	content := strings.Repeat("word ", 200)
+
+	parts := splitContent(content, "", " 🧵 {n}/{total}", " {n}/{total}", false)
+	if len(parts) < 3 {
+		t.Fatalf("got %d parts, want a thread", len(parts))
+	}
+
+	for i, part := range parts {
+		want := fmt.Sprintf(" %d/%d", i+1, len(parts))
+		if i == 0 {
+			want = fmt.Sprintf(" 🧵 1/%d", len(parts))
+		}
+		if !strings.HasSuffix(part, want) {
+			t.Errorf("part %d = %q, want it to end with %q", i+1, part, want)
+		}
+		if n := graphemeLen(part); n > 300 {
+			t.Errorf("part %d is %d graphemes, want at most 300", i+1, n)
+		}
+	}
+}
+
+func TestSplitContentRebalance(t *testing.T) {
+	for length := 301; length <= 320; length++ {
+		t.Run(strconv.Itoa(length), func(t *testing.T) {
+			content := strings.Repeat("word ", 70)[:length-1] + "x"
+
+			plain := splitContent(content, "", " ({n}/{total})", " ({n}/{total})", false)
+			parts := splitContent(content, "", " ({n}/{total})", " ({n}/{total})", true)
+			if len(parts) != 2 || len(plain) != 2 {
+				t.Fatalf("got %d and %d parts, want 2", len(plain), len(parts))
+			}
+
+			var texts []string
+			for i, part := range parts {
+				if n := graphemeLen(part); n > 300 {
+					t.Errorf("part %d is %d graphemes, want at most 300", i+1, n)
+				}
+				texts = append(texts, strings.TrimSuffix(part, fmt.Sprintf(" (%d/2)", i+1)))
+			}
+			if joined := strings.Join(texts, " "); joined != content {
+				t.Errorf("rebalanced parts lost text: got %q", joined)
+			}
+
+			// Without rebalancing the last part is a few stray words, and
+			// with it the two are within a word of each other
+			if orphan := strings.TrimSuffix(plain[1], " (2/2)"); len(orphan) >= orphanPartLength {
+				t.Errorf("got a last part of %d chars without rebalancing, want an orphan", len(orphan))
+			}
+			if diff := len(texts[0]) - len(texts[1]); diff < -5 || diff > 5 {
+				t.Errorf("got parts of %d and %d chars, want them even", len(texts[0]), len(texts[1]))
+			}
+		})
+	}
+}
+
+func TestSplitContentGraphemeBoundaries(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		signature string
+		wantParts int
+	}{
+		{name: "299 graphemes", content: strings.Repeat("a", 299), wantParts: 1},
+		{name: "300 graphemes", content: strings.Repeat("a", 300), wantParts: 1},
+		{name: "301 graphemes", content: strings.Repeat("a", 301), wantParts: 2},
+		{name: "299 emoji with skin tones", content: strings.Repeat("👍🏽", 299), wantParts: 1},
+		{name: "300 emoji with skin tones", content: strings.Repeat("👍🏽", 300), wantParts: 1},
+		{name: "301 emoji with skin tones", content: strings.Repeat("👍🏽", 301), wantParts: 2},
+		{name: "300 with the signature", content: strings.Repeat("a", 290), signature: "sig-1234", wantParts: 1},
+		{name: "301 with the signature", content: strings.Repeat("a", 291), signature: "sig-1234", wantParts: 2},
+		{name: "300 flags", content: strings.Repeat("🇳🇱", 300), wantParts: 1},
+		{name: "301 flags", content: strings.Repeat("🇳🇱", 301), wantParts: 2},
+		{name: "300 joined emoji", content: strings.Repeat("👩\u200d💻", 300), wantParts: 1},
+		{name: "301 joined emoji", content: strings.Repeat("👩\u200d💻", 301), wantParts: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitContent(tt.content, tt.signature, " ({n}/{total})", " ({n}/{total})", false)
+			if len(parts) != tt.wantParts {
+				t.Fatalf("got %d parts, want %d", len(parts), tt.wantParts)
+			}
+			for i, part := range parts {
+				if n := graphemeLen(part); n > 300 {
+					t.Errorf("part %d is %d graphemes", i+1, n)
+				}
+
+				// Parts never start or end in the middle of a grapheme
+				if strings.HasPrefix(part, "\u200d") || strings.HasPrefix(part, "\U0001F3FD") {
+					t.Errorf("part %d starts in the middle of a grapheme", i+1)
+				}
+			}
+		})
+	}
+}
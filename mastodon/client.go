@@ -2,9 +2,13 @@ package mastodon
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"log"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -14,15 +18,84 @@ import (
 	"github.com/microcosm-cc/bluemonday"
 )
 
+// ErrUnauthorized is returned when Mastodon rejects the access token,
+// usually because it was revoked or rotated
+var ErrUnauthorized = errors.New("mastodon access token is invalid")
+
+// ErrNotFound is returned when a status doesn't exist or can't be seen,
+// such as one that was deleted or that the account can't view
+var ErrNotFound = errors.New("mastodon status not found")
+
 type ClientConfig struct {
 	Server       string
 	ClientID     string
 	ClientSecret string
 	AccessToken  string
+
+	// AnchorMode controls how links with custom text are rendered:
+	// "text_url" (default) gives "text (url)", "url" keeps only the URL,
+	// and "text" keeps only the link text
+	AnchorMode string `toml:"anchor_mode"`
+
+	// StripReadMoreLinks removes a trailing "read more" link pointing back
+	// at the status itself, which some clients append to long posts
+	StripReadMoreLinks bool `toml:"strip_readmore_links"`
+
+	// FetchAppNames makes the client look up which application each status
+	// was posted from. It costs a request per status, so it is only set when
+	// app filters are configured.
+	FetchAppNames bool `toml:"-"`
+
+	// CheckLocalOnly looks up the local_only flag that glitch-soc and
+	// Hometown set on posts that mustn't federate, and also treats posts
+	// ending in glitch-soc's 👁 marker as local-only. Like FetchAppNames it
+	// costs a request per status, so turn it on only on those instances.
+	// The marker is always honoured on servers detected as glitch-soc.
+	CheckLocalOnly bool `toml:"check_local_only"`
+
+	// SourceSoftware is the fediverse software the server runs, which
+	// decides how its HTML is cleaned up: "mastodon", "glitch-soc",
+	// "pleroma", "akkoma" or "gotosocial". Left empty, it is detected from
+	// the server's nodeinfo.
+	SourceSoftware string `toml:"source_software"`
+
+	// EmojiFallback maps custom emoji shortcodes to text that stands in for
+	// them on Bluesky, such as "verified" to "✓". Custom emoji without a
+	// fallback are left as their :shortcode:.
+	EmojiFallback map[string]string `toml:"emoji_fallback"`
+
+	// PlainMentionFormat is how mentions read on Bluesky, where they can't
+	// link to the account: "@user@instance", "@user" or "user@instance".
+	// Left empty, mentions keep the text the server rendered them with.
+	PlainMentionFormat string `toml:"plain_mention_format"`
 }
 
 type Client struct {
-	client *mastodon.Client
+	client         *mastodon.Client
+	clean          cleanOptions
+	fetchAppNames  bool
+	checkLocalOnly bool
+
+	// glitch is set when the server is detected as glitch-soc, whose 👁
+	// marker keeps a post local
+	glitch bool
+
+	// statusesCount is the account's status count at the last poll
+	statusesCount int64
+}
+
+// cleanOptions controls how status HTML is turned into plain text
+type cleanOptions struct {
+	anchorMode         string
+	stripReadMoreLinks bool
+
+	// software selects the extra cleanup in softwareCleaners
+	software string
+
+	// emojiFallback is keyed by shortcode without the colons
+	emojiFallback map[string]string
+
+	mentionFormat string
 }
 
 type Post struct {
@@ -38,6 +111,56 @@ type Post struct {
 	Username    string
 	Instance    string
 	DisplayName string
+	Poll        *Poll
+	Media       []Media
+	Pinned      bool
+	AppName     string
+
+	// AccountID is the ID of the post's author
+	AccountID string
+
+	// InReplyToAccountID is the ID of the author of the post replied to
+	InReplyToAccountID string
+
+	// Bot is set when the author's account is marked as a bot
+	Bot bool
+
+	// Language is the ISO 639 code Mastodon has for the post, if any
+	Language string
+
+	// LocalOnly is set for posts that mustn't leave their instance
+	LocalOnly bool
+
+	// SpoilerText is the content warning, if any
+	SpoilerText string
+	Sensitive   bool
+
+	// URI is the ActivityPub ID, which points at the origin server
+	URI string
+
+	// URL is the post's web page
+	URL string
+
+	// FavouritesCount and ReblogsCount are how many times the post has been
+	// favourited and boosted, as far as its server knows
+	FavouritesCount int64
+	ReblogsCount    int64
+}
+
+type Media struct {
+	ID          string
+	Type        string
+	URL         string
+	Description string
+}
+
+type Poll struct {
+	Options   []string
+	Expired   bool
+	ExpiresAt time.Time
+
+	// Votes holds the votes for the option at the same index
+	Votes []int64
 }
 
 func NewClient(config ClientConfig) (*Client, error) {
@@ -61,14 +184,44 @@ func NewClient(config ClientConfig) (*Client, error) {
 		AccessToken:  config.AccessToken,
 	})
 
-	return &Client{client: c}, nil
+	anchorMode := config.AnchorMode
+	if anchorMode == "" {
+		anchorMode = "text_url"
+	}
+
+	emojiFallback := make(map[string]string, len(config.EmojiFallback))
+	for shortcode, text := range config.EmojiFallback {
+		emojiFallback[strings.Trim(shortcode, ":")] = text
+	}
+
+	// glitch-soc shares Mastodon's HTML, so only its local-only marker
+	// needs telling apart
+	software := strings.ToLower(config.SourceSoftware)
+	glitch := software == "glitch-soc"
+	if glitch {
+		software = "mastodon"
+	}
+
+	return &Client{
+		client:         c,
+		fetchAppNames:  config.FetchAppNames,
+		checkLocalOnly: config.CheckLocalOnly,
+		glitch:         glitch,
+		clean: cleanOptions{
+			anchorMode:         anchorMode,
+			stripReadMoreLinks: config.StripReadMoreLinks,
+			software:           software,
+			emojiFallback:      emojiFallback,
+			mentionFormat:      config.PlainMentionFormat,
+		},
+	}, nil
 }
 
 func (c *Client) GetNewPosts(ctx context.Context, sinceID string, sinceTime time.Time) ([]*Post, error) {
 	// Get current user account
 	account, err := c.client.GetAccountCurrentUser(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("getting current user: %w", err)
+		return nil, fmt.Errorf("getting current user: %w", checkAuth(err))
 	}
 
 	// Set up pagination
@@ -80,7 +233,21 @@ func (c *Client) GetNewPosts(ctx context.Context, sinceID string, sinceTime time
 	// Get user's statuses
 	timeline, err := c.client.GetAccountStatuses(ctx, account.ID, pg)
 	if err != nil {
-		return nil, fmt.Errorf("getting timeline: %w", err)
+		return nil, fmt.Errorf("getting timeline: %w", checkAuth(err))
+	}
+
+	// An instance upgrade or migration can change how IDs are made, and a
+	// stored ID from before then can make since_id miss every new post.
+	// Catch that and rely on sinceTime (and the bridge's own records of
+	// what it has bridged) instead.
+	stalled := len(timeline) == 0 && c.statusesCount > 0 && account.StatusesCount > c.statusesCount
+	c.statusesCount = account.StatusesCount
+	if sinceID != "" && (stalled || !idsAfter(timeline, sinceID)) {
+		log.Printf("WARNING: Statuses don't line up with the last seen ID %s, falling back to filtering by time", sinceID)
+		timeline, err = c.statusesSince(ctx, account.ID, sinceTime)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var posts []*Post
@@ -90,8 +257,10 @@ func (c *Client) GetNewPosts(ctx context.Context, sinceID string, sinceTime time
 			continue
 		}
 
-		// Only include public posts
-		if status.Visibility != "public" {
+		// Only include public posts, and non-direct replies which may
+		// still be bridged to keep a thread coherent
+		if status.Visibility != "public" &&
+			(status.InReplyToID == nil || status.Visibility == "direct") {
 			log.Printf("Skipping non-public post %s with visibility %s", status.ID, status.Visibility)
 			continue
 		}
@@ -104,9 +273,11 @@ func (c *Client) GetNewPosts(ctx context.Context, sinceID string, sinceTime time
 
 		isReply := status.InReplyToID != ""
 
+		details := c.fetchStatusDetails(ctx, status.ID)
+
 		post := &Post{
 			ID:         string(status.ID),
-			Content:    cleanHTML(status.Content, hashtags, isReply),
+			Content:    c.cleanStatus(status, hashtags, isReply),
 			Visibility: status.Visibility,
 			CreatedAt:  status.CreatedAt,
 			InReplyToID: func() string {
@@ -119,44 +290,32 @@ func (c *Client) GetNewPosts(ctx context.Context, sinceID string, sinceTime time
 			}(),
 			Hashtags: hashtags,
 			EditedAt: status.EditedAt,
+			Poll:     convertPoll(status.Poll),
+			Media:    convertMedia(status.MediaAttachments),
+			Pinned:   isPinned(status),
+			AppName:  details.AppName,
+
+			SpoilerText: status.SpoilerText,
+			Sensitive:   status.Sensitive,
+			URI:         status.URI,
+			URL:         status.URL,
 		}
 
+		post.AccountID = string(status.Account.ID)
+		post.InReplyToAccountID, _ = status.InReplyToAccountID.(string)
+		post.FavouritesCount = status.FavouritesCount
+		post.ReblogsCount = status.ReblogsCount
+		post.Bot = status.Account.Bot
+		post.Language = status.Language
+		post.LocalOnly = isLocalOnly(status, details, post.Content, c.honourLocalOnlyMarker())
+
 		// Check if this is an edit
 		if !status.EditedAt.IsZero() {
 			post.OriginalID = string(status.ID)
 		}
 
 		if status.Reblog != nil {
-			reblogHashtags := []string{}
-			for _, tag := range status.Reblog.Tags {
-				reblogHashtags = append(reblogHashtags, tag.Name)
-			}
-
-			reblogIsReply := status.Reblog.InReplyToID != ""
-
-			// Add these fields for reblogged content
-			reblogUsername := status.Reblog.Account.Username
-			reblogInstance := extractInstanceFromAcct(status.Reblog.Account.Acct, c.client.Config.Server)
-			reblogDisplayName := status.Reblog.Account.DisplayName
-
-			post.Reblog = &Post{
-				ID:         string(status.Reblog.ID),
-				Content:    cleanHTML(status.Reblog.Content, reblogHashtags, reblogIsReply),
-				Visibility: status.Reblog.Visibility,
-				CreatedAt:  status.Reblog.CreatedAt,
-				InReplyToID: func() string {
-					if status.Reblog.InReplyToID != nil {
-						if id, ok := status.Reblog.InReplyToID.(string); ok {
-							return id
-						}
-					}
-					return ""
-				}(),
-				Hashtags:    reblogHashtags,
-				Username:    reblogUsername,
-				Instance:    reblogInstance,
-				DisplayName: reblogDisplayName,
-			}
+			post.Reblog = c.convertReblog(status.Reblog)
 		}
 
 		posts = append(posts, post)
@@ -165,11 +324,247 @@ func (c *Client) GetNewPosts(ctx context.Context, sinceID string, sinceTime time
 	return posts, nil
 }
 
+// convertReblog converts the boosted status inside a reblog
+func (c *Client) convertReblog(reblog *mastodon.Status) *Post {
+	hashtags := []string{}
+	for _, tag := range reblog.Tags {
+		hashtags = append(hashtags, tag.Name)
+	}
+
+	isReply := reblog.InReplyToID != ""
+
+	post := &Post{
+		ID:         string(reblog.ID),
+		Content:    c.cleanStatus(reblog, hashtags, isReply),
+		Visibility: reblog.Visibility,
+		CreatedAt:  reblog.CreatedAt,
+		InReplyToID: func() string {
+			if reblog.InReplyToID != nil {
+				if id, ok := reblog.InReplyToID.(string); ok {
+					return id
+				}
+			}
+			return ""
+		}(),
+		Hashtags:    hashtags,
+		Username:    reblog.Account.Username,
+		Instance:    extractInstanceFromAcct(reblog.Account.Acct, c.client.Config.Server),
+		DisplayName: reblog.Account.DisplayName,
+		Poll:        convertPoll(reblog.Poll),
+		Media:       convertMedia(reblog.MediaAttachments),
+		SpoilerText: reblog.SpoilerText,
+		Sensitive:   reblog.Sensitive,
+		URI:         reblog.URI,
+		URL:         reblog.URL,
+	}
+	post.AccountID = string(reblog.Account.ID)
+	post.InReplyToAccountID, _ = reblog.InReplyToAccountID.(string)
+	post.FavouritesCount = reblog.FavouritesCount
+	post.ReblogsCount = reblog.ReblogsCount
+	post.Bot = reblog.Account.Bot
+	post.Language = reblog.Language
+	post.LocalOnly = isLocalOnly(reblog, statusDetails{}, post.Content, c.honourLocalOnlyMarker())
+
+	return post
+}
+
+// statusDetails are the fields of a status that go-mastodon doesn't decode
+type statusDetails struct {
+	AppName   string
+	LocalOnly bool
+}
+
+// fetchStatusDetails looks up the fields go-mastodon doesn't decode, but only
+// when something needs them, since it costs a request per status
+func (c *Client) fetchStatusDetails(ctx context.Context, id mastodon.ID) statusDetails {
+	if !c.fetchAppNames && !c.checkLocalOnly {
+		return statusDetails{}
+	}
+
+	url := strings.TrimSuffix(c.client.Config.Server, "/") + "/api/v1/statuses/" + string(id)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		log.Printf("Error creating details request for status %s: %v", id, err)
+		return statusDetails{}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.client.Config.AccessToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		log.Printf("Error getting details for status %s: %v", id, err)
+		return statusDetails{}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error getting details for status %s: status %d", id, resp.StatusCode)
+		return statusDetails{}
+	}
+
+	var status struct {
+		Application struct {
+			Name string `json:"name"`
+		} `json:"application"`
+		LocalOnly bool `json:"local_only"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		log.Printf("Error decoding details for status %s: %v", id, err)
+		return statusDetails{}
+	}
+
+	return statusDetails{AppName: status.Application.Name, LocalOnly: status.LocalOnly}
+}
+
+// localOnlyMarker is appended to posts on glitch-soc to keep them from
+// federating
+const localOnlyMarker = "👁"
+
+// isLocalOnly reports whether a status is meant to stay on its instance.
+// Akkoma and Pleroma use a "local" visibility, and glitch-soc and Hometown
+// set local_only in the API. glitch-soc also marks the text with an eye
+// emoji, but elsewhere a post can just end in one, so the marker only counts
+// when checkMarker is set.
+func isLocalOnly(status *mastodon.Status, details statusDetails, content string, checkMarker bool) bool {
+	if details.LocalOnly || status.Visibility == "local" {
+		return true
+	}
+
+	if !checkMarker {
+		return false
+	}
+
+	text := strings.TrimSuffix(strings.TrimSpace(content), "\uFE0F")
+	return strings.HasSuffix(text, localOnlyMarker)
+}
+
+// honourLocalOnlyMarker reports whether a trailing 👁 makes a post
+// local-only, which is only on glitch-soc or with check_local_only set
+func (c *Client) honourLocalOnlyMarker() bool {
+	return c.glitch || c.checkLocalOnly
+}
+
+// isPinned reports whether a status is pinned to our profile. Mastodon only
+// sets the flag on statuses from the authenticated account.
+func isPinned(status *mastodon.Status) bool {
+	pinned, _ := status.Pinned.(bool)
+	return pinned
+}
+
+// convertPoll extracts the option titles from a Mastodon poll
+func convertPoll(poll *mastodon.Poll) *Poll {
+	if poll == nil {
+		return nil
+	}
+
+	var options []string
+	var votes []int64
+	for _, option := range poll.Options {
+		options = append(options, option.Title)
+		votes = append(votes, option.VotesCount)
+	}
+
+	return &Poll{
+		Options:   options,
+		Expired:   poll.Expired,
+		ExpiresAt: poll.ExpiresAt,
+		Votes:     votes,
+	}
+}
+
+// convertMedia extracts the fields we need from Mastodon media attachments
+func convertMedia(attachments []mastodon.Attachment) []Media {
+	var media []Media
+	for _, attachment := range attachments {
+		media = append(media, Media{
+			ID:          string(attachment.ID),
+			Type:        attachment.Type,
+			URL:         attachment.URL,
+			Description: attachment.Description,
+		})
+	}
+	return media
+}
+
+// cleanStatus turns a status' HTML content into plain text
+func (c *Client) cleanStatus(status *mastodon.Status, hashtags []string, isReply bool) string {
+	content := status.Content
+	if c.clean.stripReadMoreLinks {
+		content = stripReadMoreLink(content, string(status.ID), status.URL, status.URI)
+	}
+	content = replaceCustomEmoji(content, status.Emojis, c.clean.emojiFallback)
+	return cleanHTML(content, hashtags, isReply, c.clean)
+}
+
+// replaceCustomEmoji swaps the shortcodes of a status' custom emoji for their
+// emoji_fallback text. Only shortcodes the status says are custom emoji are
+// touched, so ordinary text between colons is left alone.
+func replaceCustomEmoji(content string, emojis []mastodon.Emoji, fallback map[string]string) string {
+	for _, emoji := range emojis {
+		if text, ok := fallback[emoji.ShortCode]; ok {
+			content = strings.ReplaceAll(content, ":"+emoji.ShortCode+":", html.EscapeString(text))
+		}
+	}
+	return content
+}
+
+var (
+	anchorStartPattern    = regexp.MustCompile(`(?i)<a\s`)
+	trailingAnchorPattern = regexp.MustCompile(`(?is)^<a\s[^>]*href="([^"]*)"[^>]*>.*?</a>((?:\s|</p>|<br\s*/?>)*)$`)
+	readMoreLabelPattern  = regexp.MustCompile(`(?i)(^|[\s>])(?:read more|continue reading)[\s:….]*$`)
+)
+
+// stripReadMoreLink removes a link at the very end of the content that
+// points back at the status itself, along with a "Read more" or "Continue
+// reading" label just before it
+func stripReadMoreLink(content string, id string, urls ...string) string {
+	starts := anchorStartPattern.FindAllStringIndex(content, -1)
+	if starts == nil {
+		return content
+	}
+	start := starts[len(starts)-1][0]
+
+	match := trailingAnchorPattern.FindStringSubmatchIndex(content[start:])
+	if match == nil {
+		return content
+	}
+
+	href := html.UnescapeString(content[start+match[2] : start+match[3]])
+	selfLink := strings.HasSuffix(strings.TrimSuffix(href, "/"), "/"+id)
+	for _, url := range urls {
+		if url != "" && href == url {
+			selfLink = true
+		}
+	}
+
+	if !selfLink {
+		return content
+	}
+
+	before := readMoreLabelPattern.ReplaceAllString(content[:start], "$1")
+	return before + content[start+match[4]:start+match[5]]
+}
+
 // cleanHTML removes HTML tags and converts HTML entities
-func cleanHTML(input string, hashtags []string, isReply bool) string {
+func cleanHTML(input string, hashtags []string, isReply bool, opts cleanOptions) string {
 	// Use bluemonday to strip HTML tags safely
 	p := bluemonday.StripTagsPolicy()
 
+	// Mentions are rewritten from their links before any h-card markup
+	// around them is unwrapped
+	if opts.mentionFormat != "" {
+		input = convertMentions(input)
+	}
+
+	// Smooth over how other fediverse software differs from Mastodon
+	if cleaner := softwareCleaners[opts.software]; cleaner != nil {
+		input = cleaner(input)
+	}
+
+	// Keep link targets that would otherwise be lost with the tags
+	input = convertAnchors(input, opts.anchorMode)
+
 	// Replace common HTML elements with appropriate text replacements
 	input = strings.ReplaceAll(input, "<br>", "\n")
 	input = strings.ReplaceAll(input, "<br/>", "\n")
@@ -222,6 +617,10 @@ func cleanHTML(input string, hashtags []string, isReply bool) string {
 		clean = strings.Join(lines, "\n")
 	}
 
+	// Leading mentions are stripped from replies in their full form, so the
+	// chosen format is applied after
+	clean = formatMentions(clean, opts.mentionFormat)
+
 	// Clean up multiple newlines
 	re := regexp.MustCompile(`\n{3,}`)
 	clean = re.ReplaceAllString(clean, "\n\n")
@@ -232,6 +631,108 @@ func cleanHTML(input string, hashtags []string, isReply bool) string {
 	return clean
 }
 
+var (
+	mentionHandlePattern = regexp.MustCompile(`(^|[^\w@/.])@([\w.-]+)@([\w-]+(?:\.[\w-]+)+)`)
+)
+
+// convertMentions replaces mention links with the full @user@instance
+// handle, taking the instance from the link since Mastodon only shows the
+// username
+func convertMentions(input string) string {
+	return anchorPattern.ReplaceAllStringFunc(input, func(anchor string) string {
+		match := anchorPattern.FindStringSubmatch(anchor)
+		attrs, inner := match[1], match[2]
+
+		if !strings.Contains(attrs, "mention") || strings.Contains(attrs, "hashtag") {
+			return anchor
+		}
+
+		hrefMatch := hrefPattern.FindStringSubmatch(attrs)
+		if hrefMatch == nil {
+			return anchor
+		}
+		u, err := url.Parse(html.UnescapeString(hrefMatch[1]))
+		if err != nil || u.Host == "" {
+			return anchor
+		}
+
+		user := strings.TrimPrefix(strings.TrimSpace(tagPattern.ReplaceAllString(inner, "")), "@")
+		user, _, _ = strings.Cut(user, "@")
+		if user == "" {
+			return anchor
+		}
+
+		return "@" + user + "@" + u.Host
+	})
+}
+
+// formatMentions rewrites full @user@instance handles in plain_mention_format
+func formatMentions(text, format string) string {
+	switch format {
+	case "@user":
+		return mentionHandlePattern.ReplaceAllString(text, "$1@$2")
+	case "user@instance":
+		return mentionHandlePattern.ReplaceAllString(text, "$1$2@$3")
+	default:
+		return text
+	}
+}
+
+var (
+	anchorPattern = regexp.MustCompile(`(?is)<a\s([^>]*)>(.*?)</a>`)
+	hrefPattern   = regexp.MustCompile(`(?i)href="([^"]*)"`)
+	tagPattern    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// convertAnchors rewrites links whose text differs from their target, such as
+// Markdown links from Pleroma/Akkoma, so the URL survives tag stripping.
+// Mentions, hashtags and plain URL links are left alone.
+func convertAnchors(input string, mode string) string {
+	return anchorPattern.ReplaceAllStringFunc(input, func(anchor string) string {
+		match := anchorPattern.FindStringSubmatch(anchor)
+		attrs, inner := match[1], match[2]
+
+		if strings.Contains(attrs, "mention") || strings.Contains(attrs, "hashtag") {
+			return anchor
+		}
+
+		hrefMatch := hrefPattern.FindStringSubmatch(attrs)
+		if hrefMatch == nil {
+			return anchor
+		}
+		href := hrefMatch[1]
+		text := strings.TrimSpace(tagPattern.ReplaceAllString(inner, ""))
+
+		if text == "" || isSameLink(text, href) {
+			return href
+		}
+
+		switch mode {
+		case "url":
+			return href
+		case "text":
+			return text
+		default:
+			return text + " (" + href + ")"
+		}
+	})
+}
+
+// isSameLink reports whether link text is just a (possibly shortened) form
+// of the link target
+func isSameLink(text, href string) bool {
+	normalize := func(s string) string {
+		s = strings.TrimPrefix(s, "https://")
+		s = strings.TrimPrefix(s, "http://")
+		s = strings.TrimPrefix(s, "www.")
+		s = strings.TrimSuffix(s, "…")
+		return strings.TrimSuffix(s, "/")
+	}
+
+	text, href = normalize(text), normalize(href)
+	return text != "" && strings.HasPrefix(href, text)
+}
+
 func (c *Client) GetAccount(ctx context.Context) (*mastodon.Account, error) {
 	// For debugging
 	log.Printf("Using Mastodon server: %s", c.client.Config.Server)
@@ -239,7 +740,7 @@ func (c *Client) GetAccount(ctx context.Context) (*mastodon.Account, error) {
 	// Try to get current user account
 	account, err := c.client.GetAccountCurrentUser(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("getting current user: %w", err)
+		return nil, fmt.Errorf("getting current user: %w", checkAuth(err))
 	}
 
 	return account, nil
@@ -248,7 +749,7 @@ func (c *Client) GetAccount(ctx context.Context) (*mastodon.Account, error) {
 func (c *Client) GetPostWithEdits(ctx context.Context, postID string) (*Post, error) {
 	status, err := c.client.GetStatus(ctx, mastodon.ID(postID))
 	if err != nil {
-		return nil, fmt.Errorf("getting status: %w", err)
+		return nil, fmt.Errorf("getting status: %w", checkAuth(err))
 	}
 
 	var hashtags []string
@@ -264,9 +765,11 @@ func (c *Client) GetPostWithEdits(ctx context.Context, postID string) (*Post, er
 	// Check if this is a reply
 	isReply := status.InReplyToID != ""
 
+	details := c.fetchStatusDetails(ctx, status.ID)
+
 	post := &Post{
 		ID:         string(status.ID),
-		Content:    cleanHTML(status.Content, hashtags, isReply),
+		Content:    c.cleanStatus(status, hashtags, isReply),
 		Visibility: status.Visibility,
 		CreatedAt:  status.CreatedAt,
 		InReplyToID: func() string {
@@ -276,15 +779,168 @@ func (c *Client) GetPostWithEdits(ctx context.Context, postID string) (*Post, er
 			return ""
 		}(),
 		Hashtags:    hashtags,
+		EditedAt:    status.EditedAt,
 		Username:    username,
 		Instance:    instance,
 		DisplayName: displayName,
+		Poll:        convertPoll(status.Poll),
+		Media:       convertMedia(status.MediaAttachments),
+		Pinned:      isPinned(status),
+		AppName:     details.AppName,
+		SpoilerText: status.SpoilerText,
+		Sensitive:   status.Sensitive,
+		URI:         status.URI,
+		URL:         status.URL,
+	}
+
+	post.AccountID = string(status.Account.ID)
+	post.InReplyToAccountID, _ = status.InReplyToAccountID.(string)
+	post.FavouritesCount = status.FavouritesCount
+	post.ReblogsCount = status.ReblogsCount
+	post.Bot = status.Account.Bot
+	post.Language = status.Language
+	post.LocalOnly = isLocalOnly(status, details, post.Content, c.honourLocalOnlyMarker())
+
+	// A boost's own content is empty, what was boosted is in the reblog
+	if status.Reblog != nil {
+		post.Reblog = c.convertReblog(status.Reblog)
 	}
 
-	// Rest of the function remains the same
 	return post, nil
 }
 
+// GetPinnedPostIDs returns the IDs of the posts accountID has pinned
+func (c *Client) GetPinnedPostIDs(ctx context.Context, accountID string) ([]string, error) {
+	statuses, err := c.client.GetAccountPinnedStatuses(ctx, mastodon.ID(accountID))
+	if err != nil {
+		return nil, fmt.Errorf("getting pinned statuses: %w", checkAuth(err))
+	}
+
+	var ids []string
+	for _, status := range statuses {
+		ids = append(ids, string(status.ID))
+	}
+	return ids, nil
+}
+
+// GetFollowing returns the IDs of every account accountID follows
+func (c *Client) GetFollowing(ctx context.Context, accountID string) ([]string, error) {
+	var ids []string
+	var maxID mastodon.ID
+	for {
+		// The next page's max_id comes from the Link header, which is
+		// left out on the last page
+		pg := mastodon.Pagination{MaxID: maxID}
+		accounts, err := c.client.GetAccountFollowing(ctx, mastodon.ID(accountID), &pg)
+		if err != nil {
+			return nil, fmt.Errorf("getting followed accounts: %w", checkAuth(err))
+		}
+
+		for _, account := range accounts {
+			ids = append(ids, string(account.ID))
+		}
+
+		if len(accounts) == 0 || pg.MaxID == "" || pg.MaxID == maxID {
+			return ids, nil
+		}
+		maxID = pg.MaxID
+	}
+}
+
+// Favourite favourites a status
+func (c *Client) Favourite(ctx context.Context, postID string) error {
+	if _, err := c.client.Favourite(ctx, mastodon.ID(postID)); err != nil {
+		return fmt.Errorf("favouriting status: %w", checkAuth(err))
+	}
+	return nil
+}
+
+// checkAuth marks authentication failures and missing statuses so callers
+// can tell them apart from transient errors
+func checkAuth(err error) error {
+	var apiErr *mastodon.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		case http.StatusNotFound, http.StatusGone:
+			return fmt.Errorf("%w: %v", ErrNotFound, err)
+		}
+	}
+	return err
+}
+
+// maxFallbackPages is how many pages of statuses statusesSince goes back
+// through at most
+const maxFallbackPages = 10
+
+// statusesSince pages back through an account's statuses until it reaches
+// one created before since, for when since_id can't be relied on. It stops
+// after maxFallbackPages, warning that any older posts were missed.
+func (c *Client) statusesSince(ctx context.Context, accountID mastodon.ID, since time.Time) ([]*mastodon.Status, error) {
+	var statuses []*mastodon.Status
+	var maxID mastodon.ID
+	for page := 1; ; page++ {
+		// The next page's max_id comes from the Link header, which is
+		// left out on the last page
+		pg := mastodon.Pagination{MaxID: maxID}
+		batch, err := c.client.GetAccountStatuses(ctx, accountID, &pg)
+		if err != nil {
+			return nil, fmt.Errorf("getting timeline: %w", checkAuth(err))
+		}
+		statuses = append(statuses, batch...)
+
+		if len(batch) == 0 || pg.MaxID == "" || pg.MaxID == maxID {
+			return statuses, nil
+		}
+		if !since.IsZero() && batch[len(batch)-1].CreatedAt.Before(since) {
+			return statuses, nil
+		}
+		if page == maxFallbackPages {
+			log.Printf("WARNING: Stopped after %d pages of statuses without reaching the last one seen; "+
+				"any posts older than %s were missed", page, batch[len(batch)-1].CreatedAt.Format(time.RFC3339))
+			return statuses, nil
+		}
+		maxID = pg.MaxID
+	}
+}
+
+// idsAfter reports whether every status sorts after sinceID
+func idsAfter(statuses []*mastodon.Status, sinceID string) bool {
+	for _, status := range statuses {
+		if !idAfter(string(status.ID), sinceID) {
+			return false
+		}
+	}
+	return true
+}
+
+// idAfter reports whether status ID a is newer than b. Mastodon's IDs are
+// numbers that can grow a digit, while GoToSocial's ULIDs sort as text. IDs
+// of different kinds can't be compared, so never count as newer.
+func idAfter(a, b string) bool {
+	aNumeric, bNumeric := isNumericID(a), isNumericID(b)
+	if aNumeric != bNumeric {
+		return false
+	}
+	if aNumeric && len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+func isNumericID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 func extractInstanceFromAcct(acct string, defaultServer string) string {
 	// If it contains @, it's likely a remote account
 	if strings.Contains(acct, "@") {
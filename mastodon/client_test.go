@@ -0,0 +1,366 @@
+package mastodon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestConvertAnchors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		mode  string
+		want  string
+	}{
+		{
+			name:  "markdown link as text and url",
+			input: `<p>See <a href="https://example.com/docs">the docs</a> for more</p>`,
+			mode:  "text_url",
+			want:  "See the docs (https://example.com/docs) for more",
+		},
+		{
+			name:  "markdown link as url",
+			input: `<p>See <a href="https://example.com/docs">the docs</a></p>`,
+			mode:  "url",
+			want:  "See https://example.com/docs",
+		},
+		{
+			name:  "markdown link as text",
+			input: `<p>See <a href="https://example.com/docs">the docs</a></p>`,
+			mode:  "text",
+			want:  "See the docs",
+		},
+		{
+			name:  "shortened url link isn't duplicated",
+			input: `<p><a href="https://example.com/a/very/long/path" rel="nofollow"><span class="invisible">https://</span><span class="ellipsis">example.com/a/very/</span></a></p>`,
+			mode:  "text_url",
+			want:  "https://example.com/a/very/long/path",
+		},
+		{
+			name:  "mentions and hashtags are left alone",
+			input: `<p><span class="h-card"><a href="https://example.social/@bob" class="u-url mention">@<span>bob</span></a></span> <a href="https://example.social/tags/go" class="mention hashtag">#<span>go</span></a></p>`,
+			mode:  "text_url",
+			want:  "@bob #go",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cleanHTML(tt.input, nil, false, cleanOptions{anchorMode: tt.mode})
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripReadMoreLink(t *testing.T) {
+	const id = "111"
+	self := `<a href="https://example.social/@me/111">https://example.social/@me/111</a>`
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "labelled self link",
+			input: `<p>Long post text. Read more: ` + self + `</p>`,
+			want:  `<p>Long post text. </p>`,
+		},
+		{
+			name:  "self link after an earlier mention",
+			input: `<p><a href="https://example.social/@bob" class="u-url mention">@bob</a> hello. Continue reading… ` + self + `</p>`,
+			want:  `<p><a href="https://example.social/@bob" class="u-url mention">@bob</a> hello. </p>`,
+		},
+		{
+			name:  "trailing link to something else",
+			input: `<p>Read more: <a href="https://example.com/article">article</a></p>`,
+			want:  `<p>Read more: <a href="https://example.com/article">article</a></p>`,
+		},
+		{
+			name:  "a trailing word more is kept",
+			input: `<p>I want more ` + self + `</p>`,
+			want:  `<p>I want more </p>`,
+		},
+		{
+			name:  "earlier self link isn't stripped",
+			input: `<p>` + self + ` and then some text</p>`,
+			want:  `<p>` + self + ` and then some text</p>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripReadMoreLink(tt.input, id); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLocalOnly(t *testing.T) {
+	tests := []struct {
+		name        string
+		visibility  string
+		details     statusDetails
+		content     string
+		checkMarker bool
+		want        bool
+	}{
+		{name: "local visibility", visibility: "local", content: "hello", want: true},
+		{name: "local_only flag", visibility: "public", details: statusDetails{LocalOnly: true}, content: "hello", want: true},
+		{name: "glitch-soc marker", visibility: "public", content: "just for here 👁", checkMarker: true, want: true},
+		{name: "marker with variation selector", visibility: "public", content: "just for here 👁️", checkMarker: true, want: true},
+		{name: "eye emoji elsewhere", visibility: "public", content: "keeping an eye on it 👁", want: false},
+		{name: "ordinary post", visibility: "public", content: "hello", checkMarker: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &mastodon.Status{Visibility: tt.visibility}
+			if got := isLocalOnly(status, tt.details, tt.content, tt.checkMarker); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPostWithEditsReblog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/statuses/10" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"id": "10",
+			"content": "",
+			"visibility": "public",
+			"account": {"id": "1", "username": "me", "acct": "me"},
+			"reblog": {
+				"id": "20",
+				"content": "<p>Boosted words</p>",
+				"visibility": "public",
+				"spoiler_text": "cw",
+				"account": {"id": "2", "username": "alice", "acct": "alice@example.social", "display_name": "Alice"},
+				"tags": [{"name": "go"}]
+			}
+		}`)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(ClientConfig{Server: srv.URL, AccessToken: "token"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	post, err := c.GetPostWithEdits(context.Background(), "10")
+	if err != nil {
+		t.Fatalf("GetPostWithEdits: %v", err)
+	}
+
+	if post.Reblog == nil {
+		t.Fatal("reblog isn't populated")
+	}
+	r := post.Reblog
+	if r.ID != "20" || r.Content != "Boosted words" || r.Username != "alice" || r.Instance != "example.social" ||
+		r.DisplayName != "Alice" || r.SpoilerText != "cw" || len(r.Hashtags) != 1 || r.Hashtags[0] != "go" {
+		t.Errorf("got reblog %+v", r)
+	}
+}
+
+func TestEmojiFallback(t *testing.T) {
+	c := &Client{clean: cleanOptions{
+		anchorMode:    "text_url",
+		emojiFallback: map[string]string{"verified": "✓", "heart_pride": "<3"},
+	}}
+	emojis := []mastodon.Emoji{{ShortCode: "verified"}, {ShortCode: "blobcat"}, {ShortCode: "heart_pride"}}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "mapped shortcode", content: "<p>Account :verified:</p>", want: "Account ✓"},
+		{name: "unmapped shortcode", content: "<p>Hello :blobcat:</p>", want: "Hello :blobcat:"},
+		{name: "fallback text is escaped once", content: "<p>:heart_pride: you</p>", want: "<3 you"},
+		{name: "shortcode the status doesn't use", content: "<p>Ratio :nope:</p>", want: "Ratio :nope:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &mastodon.Status{Content: tt.content, Emojis: emojis}
+			if got := c.cleanStatus(status, nil, false); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIDAfter(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"109000000000000001", "109000000000000000", true},
+		{"109000000000000000", "109000000000000001", false},
+		{"1000", "999", true},
+		{"01HQZX3Y5V6W7X8Y9Z0A1B2C3D", "01HQZX3Y5V6W7X8Y9Z0A1B2C3C", true},
+		{"01HQZX3Y5V6W7X8Y9Z0A1B2C3D", "109000000000000000", false},
+		{"109000000000000000", "01HQZX3Y5V6W7X8Y9Z0A1B2C3D", false},
+	}
+
+	for _, tt := range tests {
+		if got := idAfter(tt.a, tt.b); got != tt.want {
+			t.Errorf("idAfter(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestGetNewPostsMismatchedIDScheme(t *testing.T) {
+	now := time.Now().UTC()
+	var sinceIDs []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/accounts/verify_credentials":
+			fmt.Fprint(w, `{"id": "1", "username": "me", "acct": "me", "statuses_count": 3}`)
+		case "/api/v1/accounts/1/statuses":
+			// After a migration to ULIDs, the numeric since_id from before
+			// no longer filters anything out
+			sinceIDs = append(sinceIDs, r.URL.Query().Get("since_id"))
+			fmt.Fprintf(w, `[
+				{"id": "01HQZX3Y5V6W7X8Y9Z0A1B2C3E", "content": "<p>new</p>", "visibility": "public", "created_at": %q, "account": {"id": "1", "username": "me", "acct": "me"}},
+				{"id": "01HQZX3Y5V6W7X8Y9Z0A1B2C3D", "content": "<p>old</p>", "visibility": "public", "created_at": %q, "account": {"id": "1", "username": "me", "acct": "me"}}
+			]`, now.Format(time.RFC3339), now.Add(-2*time.Hour).Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(ClientConfig{Server: srv.URL, AccessToken: "token"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	posts, err := c.GetNewPosts(context.Background(), "109000000000000000", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("GetNewPosts: %v", err)
+	}
+
+	if len(sinceIDs) != 2 || sinceIDs[1] != "" {
+		t.Errorf("got since_id %q, want a retry without since_id", sinceIDs)
+	}
+	if len(posts) != 1 || posts[0].Content != "new" {
+		t.Errorf("got %d posts, want only the one newer than sinceTime", len(posts))
+	}
+}
+
+func TestGetNewPostsFallbackPagesBack(t *testing.T) {
+	now := time.Now().UTC()
+	status := func(id string, age time.Duration) string {
+		return fmt.Sprintf(`{"id": %q, "content": "<p>%s</p>", "visibility": "public", "created_at": %q, "account": {"id": "1", "username": "me", "acct": "me"}}`,
+			id, id, now.Add(-age).Format(time.RFC3339))
+	}
+
+	// More than a page of posts arrived since the last seen ID, which is
+	// from before a migration to ULIDs
+	pages := map[string][]string{
+		"":   {status("01HQZX3Y5V6W7X8Y9Z0A1B2C3G", 0), status("01HQZX3Y5V6W7X8Y9Z0A1B2C3F", 20*time.Minute)},
+		"p2": {status("01HQZX3Y5V6W7X8Y9Z0A1B2C3E", 40*time.Minute), status("01HQZX3Y5V6W7X8Y9Z0A1B2C3D", 2*time.Hour)},
+		"p3": {status("01HQZX3Y5V6W7X8Y9Z0A1B2C3C", 3*time.Hour)},
+	}
+	next := map[string]string{"": "p2", "p2": "p3"}
+	var requested []string
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/accounts/verify_credentials":
+			fmt.Fprint(w, `{"id": "1", "username": "me", "acct": "me", "statuses_count": 5}`)
+		case "/api/v1/accounts/1/statuses":
+			maxID := r.URL.Query().Get("max_id")
+			requested = append(requested, maxID)
+			if next[maxID] != "" {
+				w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/accounts/1/statuses?max_id=%s>; rel="next"`, srv.URL, next[maxID]))
+			}
+			fmt.Fprintf(w, "[%s]", strings.Join(pages[maxID], ","))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(ClientConfig{Server: srv.URL, AccessToken: "token"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	posts, err := c.GetNewPosts(context.Background(), "109000000000000000", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("GetNewPosts: %v", err)
+	}
+
+	// The page with a post older than sinceTime is the last one needed
+	if want := []string{"", "", "p2"}; strings.Join(requested, ",") != strings.Join(want, ",") {
+		t.Errorf("requested pages %q, want %q", requested, want)
+	}
+	if len(posts) != 3 {
+		t.Errorf("got %d posts, want the 3 newer than sinceTime from both pages", len(posts))
+	}
+}
+
+func TestPlainMentionFormat(t *testing.T) {
+	const (
+		local  = `<span class="h-card"><a href="https://my.example/@alice" class="u-url mention">@<span>alice</span></a></span>`
+		remote = `<span class="h-card"><a href="https://other.example/@bob" class="u-url mention">@<span>bob</span></a></span>`
+		input  = `<p>Thanks ` + local + ` and ` + remote + `!</p>`
+	)
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "", want: "Thanks @alice and @bob!"},
+		{format: "@user@instance", want: "Thanks @alice@my.example and @bob@other.example!"},
+		{format: "@user", want: "Thanks @alice and @bob!"},
+		{format: "user@instance", want: "Thanks alice@my.example and bob@other.example!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if got := cleanHTML(input, nil, false, cleanOptions{mentionFormat: tt.format}); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlainMentionFormatInReplies(t *testing.T) {
+	const input = `<p><span class="h-card"><a href="https://other.example/@bob" class="u-url mention">@<span>bob</span></a></span> ` +
+		`ask <span class="h-card"><a href="https://my.example/@alice" class="u-url mention">@<span>alice</span></a></span></p>`
+
+	// The leading mention is stripped from a reply whatever the format
+	for _, format := range []string{"@user@instance", "@user", "user@instance"} {
+		got := cleanHTML(input, nil, true, cleanOptions{mentionFormat: format})
+		want := map[string]string{
+			"@user@instance": "Ask @alice@my.example",
+			"@user":          "Ask @alice",
+			"user@instance":  "Ask alice@my.example",
+		}[format]
+		if got != want {
+			t.Errorf("%s: got %q, want %q", format, got, want)
+		}
+	}
+}
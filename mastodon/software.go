@@ -0,0 +1,137 @@
+package mastodon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	hCardPattern = regexp.MustCompile(`(?is)<span class=["']h-card["'][^>]*>\s*<a\s[^>]*>(.*?)</a>\s*</span>`)
+	mfmPattern   = regexp.MustCompile(`\$\[[\w.=,-]+\s+([^\[\]]*)\]`)
+)
+
+// softwareCleaners prepare status HTML from fediverse software that differs
+// from Mastodon's before the usual cleanup
+var softwareCleaners = map[string]func(string) string{
+	"pleroma":    cleanPleromaHTML,
+	"akkoma":     cleanPleromaHTML,
+	"gotosocial": unwrapHCards,
+}
+
+// knownSoftware reports whether there is handling for the named software,
+// Mastodon's being the default
+func knownSoftware(name string) bool {
+	_, ok := softwareCleaners[name]
+	return ok || name == "mastodon"
+}
+
+// cleanPleromaHTML unwraps h-card mentions and drops the MFM animation and
+// styling markup that Pleroma and Akkoma pass through, keeping its text
+func cleanPleromaHTML(input string) string {
+	input = unwrapHCards(input)
+
+	// MFM can nest, so strip it from the inside out
+	for {
+		next := mfmPattern.ReplaceAllString(input, "$1")
+		if next == input {
+			return input
+		}
+		input = next
+	}
+}
+
+// unwrapHCards replaces h-card mention markup with the plain "@user" text,
+// whatever attributes the link inside has
+func unwrapHCards(input string) string {
+	return hCardPattern.ReplaceAllString(input, "$1")
+}
+
+// DetectSoftware works out which fediverse software the server runs, from
+// its nodeinfo, unless source_software says. Servers that can't be
+// identified are treated as Mastodon.
+func (c *Client) DetectSoftware(ctx context.Context) string {
+	if c.clean.software != "" {
+		return c.clean.software
+	}
+
+	name, version, err := c.fetchSoftware(ctx)
+	if err != nil {
+		log.Printf("Error detecting server software, assuming Mastodon: %v", err)
+		name = "mastodon"
+	} else if !knownSoftware(name) {
+		// Mastodon forks such as glitch-soc and Hometown share its HTML
+		name = "mastodon"
+	}
+
+	// glitch-soc usually calls itself Mastodon in nodeinfo, but says so in
+	// its version
+	if strings.Contains(version, "glitch") {
+		c.glitch = true
+	}
+
+	c.clean.software = name
+	return name
+}
+
+// fetchSoftware reads the software name and version from the server's
+// nodeinfo
+func (c *Client) fetchSoftware(ctx context.Context) (string, string, error) {
+	server := strings.TrimSuffix(c.client.Config.Server, "/")
+
+	var index struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := c.getJSON(ctx, server+"/.well-known/nodeinfo", &index); err != nil {
+		return "", "", fmt.Errorf("getting nodeinfo index: %w", err)
+	}
+
+	var href string
+	for _, link := range index.Links {
+		if strings.HasPrefix(link.Rel, "http://nodeinfo.diaspora.software/ns/schema/") {
+			href = link.Href
+		}
+	}
+	if href == "" {
+		return "", "", fmt.Errorf("no nodeinfo schema linked")
+	}
+
+	var nodeinfo struct {
+		Software struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"software"`
+	}
+	if err := c.getJSON(ctx, href, &nodeinfo); err != nil {
+		return "", "", fmt.Errorf("getting nodeinfo: %w", err)
+	}
+
+	return strings.ToLower(nodeinfo.Software.Name), strings.ToLower(nodeinfo.Software.Version), nil
+}
+
+// getJSON fetches and decodes a public JSON document
+func (c *Client) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
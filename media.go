@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"truss/bluesky"
+	"truss/mastodon"
+)
+
+const (
+	// Bluesky rejects image blobs larger than this
+	maxBlobSize = 1000000
+
+	// Bluesky allows at most this many images on a single post
+	maxImagesPerPost = 4
+)
+
+var mediaHTTPClient = &http.Client{}
+
+// attachment is an uploaded image together with the media it came from
+type attachment struct {
+	media mastodon.Media
+	image bluesky.Image
+}
+
+// imageMedia returns the attachments that can be bridged as images
+func imageMedia(media []mastodon.Media) []mastodon.Media {
+	var images []mastodon.Media
+	for _, m := range media {
+		if m.Type != "image" {
+			log.Printf("Skipping unsupported media %s (type: %s)", m.ID, m.Type)
+			continue
+		}
+		images = append(images, m)
+	}
+	return images
+}
+
+// prepareMedia uploads a post's images, applying image_overflow_mode when
+// there are more than fit on one post. Content is returned with links or
+// notes for anything that couldn't be attached. In the link media mode
+// nothing is uploaded and all media is linked instead.
+func (b *Bridge) prepareMedia(ctx context.Context, content string, media []mastodon.Media) (string, []attachment, error) {
+	if b.config.MediaMode == "link" {
+		if len(media) > 0 {
+			log.Printf("Linking %d media attachments (media_mode is link)", len(media))
+		}
+		return linkMedia(content, media), nil, nil
+	}
+
+	images := imageMedia(media)
+
+	if len(images) > maxImagesPerPost {
+		extra := images[maxImagesPerPost:]
+
+		switch b.config.ImageOverflowMode {
+		case "thread":
+			// Everything is uploaded and spread over the thread later
+		case "link":
+			log.Printf("Post has more than %d images, linking the rest", maxImagesPerPost)
+			images = images[:maxImagesPerPost]
+			content = linkMedia(content, extra)
+		default:
+			log.Printf("Post has more than %d images, dropping the rest", maxImagesPerPost)
+			images = images[:maxImagesPerPost]
+			content = strings.TrimSpace(content) + fmt.Sprintf("\n\n(+%d more images on Mastodon)", len(extra))
+		}
+	}
+
+	attachments, failed, err := b.uploadMedia(ctx, images)
+	if err != nil {
+		return content, nil, err
+	}
+	if len(failed) > 0 {
+		log.Printf("Linking %d images that couldn't be downloaded or uploaded", len(failed))
+		content = linkMedia(content, failed)
+	}
+
+	return content, attachments, nil
+}
+
+// uploadMedia uploads images to Bluesky. Blob refs are cached by Mastodon
+// media ID so reprocessing an edit reuses them instead of downloading and
+// uploading the same image again. Images that couldn't be downloaded in time
+// are returned separately so they can be linked instead, along with those
+// that couldn't be uploaded when media_upload_fallback is link_media.
+func (b *Bridge) uploadMedia(ctx context.Context, media []mastodon.Media) ([]attachment, []mastodon.Media, error) {
+	// A dry run only needs to know which part each image would go on
+	if b.dryRun {
+		attachments := make([]attachment, len(media))
+		for i, m := range media {
+			attachments[i] = attachment{media: m}
+		}
+		return attachments, nil, nil
+	}
+
+	// Download everything that isn't cached in parallel, bounded by the
+	// bridge-wide download pool
+	blobs := make([]json.RawMessage, len(media))
+	downloads := make([]mediaDownload, len(media))
+	var wg sync.WaitGroup
+
+	for i, m := range media {
+		cached, err := b.db.GetMediaBlob(m.ID)
+		if err != nil {
+			log.Printf("Error getting cached blob for media %s: %v", m.ID, err)
+		}
+
+		if cached != "" {
+			log.Printf("Reusing cached blob for media %s", m.ID)
+			blobs[i] = json.RawMessage(cached)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, m mastodon.Media) {
+			defer wg.Done()
+			downloads[i] = b.downloadMedia(ctx, m.URL)
+		}(i, m)
+	}
+	wg.Wait()
+
+	var attachments []attachment
+	var failed []mastodon.Media
+
+	for i, m := range media {
+		if blobs[i] == nil {
+			if downloads[i].err != nil {
+				log.Printf("Error downloading media %s: %v", m.ID, downloads[i].err)
+				failed = append(failed, m)
+				continue
+			}
+
+			blob, err := b.uploadBlob(ctx, downloads[i])
+			if err != nil {
+				log.Printf("Error uploading media %s: %v", m.ID, err)
+				switch b.config.MediaUploadFallback {
+				case "fail_post":
+					return nil, nil, fmt.Errorf("uploading media %s: %w", m.ID, err)
+				case "link_media":
+					failed = append(failed, m)
+				}
+				continue
+			}
+
+			if err := b.db.SaveMediaBlob(m.ID, string(blob)); err != nil {
+				log.Printf("Error caching blob for media %s: %v", m.ID, err)
+			}
+			blobs[i] = blob
+		}
+
+		attachments = append(attachments, attachment{
+			media: m,
+			image: bluesky.Image{Alt: m.Description, Blob: blobs[i]},
+		})
+	}
+
+	return attachments, failed, nil
+}
+
+// uploadBlob uploads a downloaded image, retrying up to media_upload_retries
+// times with a doubling delay
+func (b *Bridge) uploadBlob(ctx context.Context, download mediaDownload) (json.RawMessage, error) {
+	delay := time.Duration(b.config.MediaUploadRetryDelay) * time.Second
+
+	for attempt := 0; ; attempt++ {
+		blob, err := b.bluesky.UploadBlob(ctx, download.data, download.mimeType)
+		if err == nil || attempt >= b.config.MediaUploadRetries {
+			return blob, err
+		}
+
+		log.Printf("Error uploading media (attempt %d of %d), retrying in %s: %v",
+			attempt+1, b.config.MediaUploadRetries+1, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// reuploadMedia drops cached blob refs that Bluesky has garbage-collected
+// and uploads the images again
+func (b *Bridge) reuploadMedia(ctx context.Context, attachments []attachment) []attachment {
+	var media []mastodon.Media
+	for _, a := range attachments {
+		if err := b.db.DeleteMediaBlob(a.media.ID); err != nil {
+			log.Printf("Error dropping cached blob for media %s: %v", a.media.ID, err)
+		}
+		media = append(media, a.media)
+	}
+
+	reuploaded, _, err := b.uploadMedia(ctx, media)
+	if err != nil {
+		log.Printf("Error uploading media again: %v", err)
+	}
+	return reuploaded
+}
+
+// groupAttachments assigns images to thread parts, four at most per part,
+// following thread_media_placement: from the first part on, on the last
+// parts, or spread evenly over every part. Only in thread overflow mode can
+// there be more than four, in which case image-only parts are added if
+// needed.
+func (b *Bridge) groupAttachments(parts []string, attachments []attachment) ([]string, [][]attachment) {
+	groups := make([][]attachment, len(parts))
+	if len(attachments) == 0 {
+		return parts, groups
+	}
+
+	// place puts images on part i, adding parts up to it
+	place := func(i int, images []attachment) {
+		for i >= len(parts) {
+			parts = append(parts, "")
+			groups = append(groups, nil)
+		}
+		groups[i] = images
+	}
+
+	chunks := (len(attachments) + maxImagesPerPost - 1) / maxImagesPerPost
+	chunk := func(i int) []attachment {
+		return attachments[i*maxImagesPerPost : min((i+1)*maxImagesPerPost, len(attachments))]
+	}
+
+	switch b.config.ThreadMediaPlacement {
+	case "last":
+		start := max(0, len(parts)-chunks)
+		for i := 0; i < chunks; i++ {
+			place(start+i, chunk(i))
+		}
+	case "distribute":
+		slots := max(len(parts), chunks)
+		for i := 0; i < slots; i++ {
+			place(i, attachments[i*len(attachments)/slots:(i+1)*len(attachments)/slots])
+		}
+	default:
+		for i := 0; i < chunks; i++ {
+			place(i, chunk(i))
+		}
+	}
+
+	return parts, groups
+}
+
+// blueskyImages returns the Bluesky images for a set of attachments
+func blueskyImages(attachments []attachment) []bluesky.Image {
+	var imgs []bluesky.Image
+	for _, a := range attachments {
+		imgs = append(imgs, a.image)
+	}
+	return imgs
+}
+
+type mediaDownload struct {
+	data     []byte
+	mimeType string
+	err      error
+}
+
+// downloadMedia fetches a media file once a slot in the download pool is free
+func (b *Bridge) downloadMedia(ctx context.Context, url string) mediaDownload {
+	select {
+	case b.mediaSlots <- struct{}{}:
+		defer func() { <-b.mediaSlots }()
+	case <-ctx.Done():
+		return mediaDownload{err: ctx.Err()}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(b.config.MediaDownloadTimeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return mediaDownload{err: fmt.Errorf("creating media request: %w", err)}
+	}
+
+	resp, err := mediaHTTPClient.Do(req)
+	if err != nil {
+		return mediaDownload{err: fmt.Errorf("performing media request: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return mediaDownload{err: fmt.Errorf("media request failed with status %d", resp.StatusCode)}
+	}
+
+	// Read one byte past the limit so oversized files can be detected
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlobSize+1))
+	if err != nil {
+		return mediaDownload{err: fmt.Errorf("reading media: %w", err)}
+	}
+
+	if len(data) > maxBlobSize {
+		return mediaDownload{err: fmt.Errorf("media exceeds %d bytes", maxBlobSize)}
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	return mediaDownload{data: data, mimeType: mimeType}
+}
+
+// linkMedia appends links to media that couldn't be attached
+func linkMedia(content string, media []mastodon.Media) string {
+	for _, m := range media {
+		content += "\n" + m.URL
+	}
+	return strings.TrimSpace(content)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"truss/config"
+	"truss/mastodon"
+)
+
+func TestGroupAttachments(t *testing.T) {
+	var images []attachment
+	for i := 1; i <= 6; i++ {
+		images = append(images, attachment{media: mastodon.Media{ID: strconv.Itoa(i)}})
+	}
+
+	tests := []struct {
+		placement string
+		parts     int
+		want      string
+	}{
+		// Images on each part, by media ID
+		{placement: "first", parts: 1, want: "[[1 2 3 4] [5 6]]"},
+		{placement: "first", parts: 3, want: "[[1 2 3 4] [5 6] []]"},
+		{placement: "last", parts: 1, want: "[[1 2 3 4] [5 6]]"},
+		{placement: "last", parts: 3, want: "[[] [1 2 3 4] [5 6]]"},
+		{placement: "last", parts: 5, want: "[[] [] [] [1 2 3 4] [5 6]]"},
+		{placement: "distribute", parts: 1, want: "[[1 2 3] [4 5 6]]"},
+		{placement: "distribute", parts: 3, want: "[[1 2] [3 4] [5 6]]"},
+		{placement: "distribute", parts: 4, want: "[[1] [2 3] [4] [5 6]]"},
+		{placement: "distribute", parts: 8, want: "[[] [1] [2] [3] [] [4] [5] [6]]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d parts", tt.placement, tt.parts), func(t *testing.T) {
+			b := &Bridge{config: &config.Config{ThreadMediaPlacement: tt.placement}}
+			parts := make([]string, tt.parts)
+			for i := range parts {
+				parts[i] = "part " + strconv.Itoa(i+1)
+			}
+
+			gotParts, groups := b.groupAttachments(parts, images)
+			if len(gotParts) != len(groups) {
+				t.Fatalf("got %d parts and %d image groups", len(gotParts), len(groups))
+			}
+
+			var ids [][]string
+			for _, group := range groups {
+				if len(group) > maxImagesPerPost {
+					t.Errorf("got %d images on one part, want at most %d", len(group), maxImagesPerPost)
+				}
+				idsOnPart := []string{}
+				for _, a := range group {
+					idsOnPart = append(idsOnPart, a.media.ID)
+				}
+				ids = append(ids, idsOnPart)
+			}
+			if got := fmt.Sprint(ids); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+
+			// Parts added for images have no text
+			for i := tt.parts; i < len(gotParts); i++ {
+				if gotParts[i] != "" {
+					t.Errorf("added part %d has text %q", i+1, gotParts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMediaUploadRetriesAndFallback(t *testing.T) {
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	}))
+	defer images.Close()
+
+	tests := []struct {
+		name        string
+		retries     int
+		failUploads int
+		fallback    string
+		wantErr     bool
+		wantImages  int
+		wantLinked  bool
+		wantUploads int
+	}{
+		{name: "succeeds on a retry", retries: 2, failUploads: 2, fallback: "post_without_media", wantImages: 1, wantUploads: 3},
+		{name: "without media", retries: 1, failUploads: 5, fallback: "post_without_media", wantUploads: 2},
+		{name: "linked", retries: 1, failUploads: 5, fallback: "link_media", wantLinked: true, wantUploads: 2},
+		{name: "fails the post", retries: 1, failUploads: 5, fallback: "fail_post", wantErr: true, wantUploads: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{
+				MediaUploadRetries:   tt.retries,
+				MediaUploadFallback:  tt.fallback,
+				MediaDownloadTimeout: 5,
+			})
+			b.mediaSlots = make(chan struct{}, 1)
+			pds := newFakePDS(t, b)
+			pds.failUploads = tt.failUploads
+
+			media := []mastodon.Media{{ID: "m1", Type: "image", URL: images.URL + "/m1.png"}}
+			content, attachments, err := b.prepareMedia(context.Background(), "hello", media)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if pds.uploads != tt.wantUploads {
+				t.Errorf("got %d uploads, want %d", pds.uploads, tt.wantUploads)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(attachments) != tt.wantImages {
+				t.Errorf("got %d images, want %d", len(attachments), tt.wantImages)
+			}
+			if linked := strings.Contains(content, media[0].URL); linked != tt.wantLinked {
+				t.Errorf("got content %q, want the image linked: %v", content, tt.wantLinked)
+			}
+
+			// Only an uploaded image is cached for the next edit
+			cached, _ := b.db.GetMediaBlob("m1")
+			if (cached != "") != (tt.wantImages > 0) {
+				t.Errorf("got cached blob %q", cached)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"truss/bluesky"
+	"truss/mastodon"
+)
+
+// checkMilestones notes when a bridged post has reached a new favourite
+// milestone. Only the highest one reached is noted, once.
+func (b *Bridge) checkMilestones(ctx context.Context, post *mastodon.Post) {
+	reached := 0
+	for _, milestone := range b.config.FavouriteMilestones {
+		if post.FavouritesCount >= int64(milestone) {
+			reached = milestone
+		}
+	}
+	if reached == 0 {
+		return
+	}
+
+	noted, err := b.db.GetMilestone(post.ID)
+	if err != nil {
+		log.Printf("Error getting milestone of post %s: %v", post.ID, err)
+		return
+	}
+	if reached <= noted {
+		return
+	}
+
+	log.Printf("Post %s reached %d favourites on Mastodon", post.ID, reached)
+
+	if b.config.AnnounceMilestones {
+		if err := b.announceMilestone(ctx, post, reached); err != nil {
+			log.Printf("Error announcing milestone of post %s: %v", post.ID, err)
+			return
+		}
+	}
+
+	if err := b.db.SaveMilestone(post.ID, reached); err != nil {
+		log.Printf("Error saving milestone of post %s: %v", post.ID, err)
+	}
+}
+
+// announceMilestone replies to a bridged post with a note of its favourites
+// on Mastodon. The original post is left as it is.
+func (b *Bridge) announceMilestone(ctx context.Context, post *mastodon.Post, favourites int) error {
+	return b.appendNote(ctx, post, fmt.Sprintf("(%d favourites on Mastodon)", favourites))
+}
+
+// appendNote replies to the end of a bridged post with a note, followed by
+// a link to the post on Mastodon. Like an alt text note, the note becomes
+// part of the bridged post and goes when it does.
+func (b *Bridge) appendNote(ctx context.Context, post *mastodon.Post, note string) error {
+	bskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(post.ID)
+	if err != nil || len(bskyIDs) == 0 {
+		return fmt.Errorf("post isn't bridged")
+	}
+
+	tail := strings.Split(bskyIDs[len(bskyIDs)-1], "|")
+	if len(tail) != 2 {
+		return fmt.Errorf("invalid Bluesky ID %q", bskyIDs[len(bskyIDs)-1])
+	}
+
+	if post.URL != "" {
+		note += "\n" + post.URL
+	}
+
+	noteIDs, err := b.createThread(ctx, []string{note}, nil, tail[0], tail[1], bluesky.PostMeta{})
+	if err != nil {
+		return fmt.Errorf("posting note: %w", err)
+	}
+
+	bskyIDs = append(bskyIDs, noteIDs...)
+	if err := b.db.UpdatePostMapping(post.ID, bskyIDs); err != nil {
+		log.Printf("Error updating post mapping: %v", err)
+	}
+	if b.lastBridged != nil && b.lastBridged.mastodonID == post.ID {
+		b.lastBridged.blueskyIDs = bskyIDs
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+var (
+	mentionPattern   = regexp.MustCompile(`(?:^|[\s(])@[\w.-]+(?:@[\w.-]+\.\w+)?`)
+	rtPrefixPattern  = regexp.MustCompile(`^(?i:RT):?\s+(@[\w.-]+(?:@[\w.-]+\.\w+)?:)`)
+	watermarkPattern = regexp.MustCompile(`(?i)\n+\s*(?:` +
+		`(?:sent|posted|shared) (?:from|via|with|using) (?:` + watermarkClients + `)` +
+		`|via (?:` + watermarkServices + `)` +
+		`)\.?\s*$`)
+	blankLinePattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// The clients and services whose watermark strip_watermarks removes. Only
+// these are matched, so a closing line like "Posted from the summit" is
+// left alone.
+const (
+	watermarkClients  = `my (?:iPhone|iPad|Android(?: phone)?|Galaxy[\w ]{0,20}|Pixel[\w ]{0,10}|BlackBerry)|` + watermarkServices
+	watermarkServices = `Buffer|Hootsuite|IFTTT|dlvr\.it|Zapier|Tusky|Ivory|Ice Cubes|Mona|Elk|Phanpy|Fedilab|Moshidon|Megalodon`
+)
+
+// normalizeStage applies the enabled [normalize] cleaners for common
+// fediverse artifacts. The content hash is taken before this stage, so
+// toggling a cleaner doesn't make every post look edited.
+func (b *Bridge) normalizeStage(ctx context.Context, pc *PostContext) error {
+	n := b.config.Normalize
+
+	if n.StripRTPrefix {
+		pc.Content = stripRTPrefix(pc.Content)
+	}
+
+	if n.DedupeMentions {
+		pc.Content = dedupeMentions(pc.Content)
+	}
+
+	if n.StripWatermarks {
+		pc.Content = stripWatermarks(pc.Content)
+	}
+
+	if n.CollapseBlankLines {
+		pc.Content = blankLinePattern.ReplaceAllString(pc.Content, "\n\n")
+	}
+
+	return nil
+}
+
+// stripRTPrefix removes an old-style "RT" marker from the start of a post
+// quoting someone as "RT @user: ...", keeping the attribution. A post that
+// merely starts with the letters RT is left alone.
+func stripRTPrefix(content string) string {
+	return rtPrefixPattern.ReplaceAllString(content, "$1")
+}
+
+// dedupeMentions drops repeats of a mention, which some servers produce
+// when a reply mentions the same account more than once
+func dedupeMentions(content string) string {
+	seen := make(map[string]bool)
+	content = mentionPattern.ReplaceAllStringFunc(content, func(match string) string {
+		// The match includes the character before the mention, if any
+		at := strings.Index(match, "@")
+		key := strings.ToLower(match[at:])
+		if seen[key] {
+			return match[:at]
+		}
+		seen[key] = true
+		return match
+	})
+
+	// Tidy up the gaps the dropped mentions leave behind
+	return strings.TrimSpace(repeatedSpacePattern.ReplaceAllString(content, " "))
+}
+
+// stripWatermarks removes a trailing "Sent from my iPhone" or "via Buffer"
+// line added by a known client or posting service
+func stripWatermarks(content string) string {
+	return strings.TrimSpace(watermarkPattern.ReplaceAllString(content, ""))
+}
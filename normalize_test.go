@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"truss/config"
+	"truss/mastodon"
+)
+
+func TestStripRTPrefix(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"RT @alice: hello there", "@alice: hello there"},
+		{"RT: @alice@example.social: hello", "@alice@example.social: hello"},
+		{"rt @bob: lowercase marker", "@bob: lowercase marker"},
+		{"RT is short for retweet", "RT is short for retweet"},
+		{"RT @alice hello, no colon", "RT @alice hello, no colon"},
+		{"RTFM: read the manual", "RTFM: read the manual"},
+	}
+
+	for _, tt := range tests {
+		if got := stripRTPrefix(tt.input); got != tt.want {
+			t.Errorf("stripRTPrefix(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestDedupeMentions(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"@alice @alice hi", "@alice hi"},
+		{"@alice@example.social @Alice@example.social hi", "@alice@example.social hi"},
+		{"@alice @bob hi", "@alice @bob hi"},
+		{"mail me at me@example.com", "mail me at me@example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := dedupeMentions(tt.input); got != tt.want {
+			t.Errorf("dedupeMentions(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestStripWatermarks(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Hello\n\nSent from my iPhone", "Hello"},
+		{"Hello\nvia Buffer", "Hello"},
+		{"Hello\n\nPosted using Ice Cubes.", "Hello"},
+		{"Made it to the top!\n\nPosted from the summit", "Made it to the top!\n\nPosted from the summit"},
+		{"Thanks everyone\nshared with my family", "Thanks everyone\nshared with my family"},
+		{"Sent from my iPhone in the middle\nof a post", "Sent from my iPhone in the middle\nof a post"},
+	}
+
+	for _, tt := range tests {
+		if got := stripWatermarks(tt.input); got != tt.want {
+			t.Errorf("stripWatermarks(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestCollapseBlankLines(t *testing.T) {
+	b := newTestBridge(t, &config.Config{Normalize: config.Normalize{CollapseBlankLines: true}})
+
+	pc := &PostContext{Post: &mastodon.Post{ID: "1"}, Content: "one\n\n\n\ntwo\n\nthree"}
+	if err := b.normalizeStage(context.Background(), pc); err != nil {
+		t.Fatalf("normalizeStage: %v", err)
+	}
+	if want := "one\n\ntwo\n\nthree"; pc.Content != want {
+		t.Errorf("got %q, want %q", pc.Content, want)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"truss/bluesky"
+)
+
+// mirrorPins pins the Bluesky post of the most recently pinned Mastodon post
+// that was bridged. When none of the pinned posts are bridged any more, the
+// post mirror_pins pinned earlier is unpinned.
+func (b *Bridge) mirrorPins(ctx context.Context) {
+	ids, err := b.mastodon.GetPinnedPostIDs(ctx, b.accountID)
+	if err != nil {
+		log.Printf("Error getting pinned posts: %v", err)
+		return
+	}
+
+	// Mastodon lists the most recently pinned first
+	var ref *bluesky.StrongRef
+	for _, id := range ids {
+		bskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(id)
+		if err != nil || len(bskyIDs) == 0 {
+			continue
+		}
+
+		parts := strings.Split(bskyIDs[0], "|")
+		if len(parts) == 2 {
+			ref = &bluesky.StrongRef{URI: parts[0], CID: parts[1]}
+			break
+		}
+	}
+
+	current, err := b.bluesky.PinnedPost(ctx)
+	if err != nil {
+		log.Printf("Error getting the pinned Bluesky post: %v", err)
+		return
+	}
+
+	switch {
+	case ref != nil && ref.URI == current:
+		// Already pinned, maybe before a restart
+		b.mirroredPin = current
+
+	case ref != nil:
+		if err := b.bluesky.SetPinnedPost(ctx, ref); err != nil {
+			log.Printf("Error pinning %s: %v", ref.URI, err)
+			return
+		}
+		log.Printf("Pinned %s to mirror the pinned Mastodon post", ref.URI)
+		b.mirroredPin = ref.URI
+
+	case ref == nil && current != "" && current == b.mirroredPin:
+		if err := b.bluesky.SetPinnedPost(ctx, nil); err != nil {
+			log.Printf("Error unpinning %s: %v", current, err)
+			return
+		}
+		log.Printf("Unpinned %s, which is no longer pinned on Mastodon", current)
+		b.mirroredPin = ""
+	}
+}
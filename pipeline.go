@@ -0,0 +1,961 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"truss/bluesky"
+	"truss/mastodon"
+)
+
+// PostContext carries a post through the processing pipeline. Each stage
+// reads what earlier stages produced and fills in its own part.
+type PostContext struct {
+	Post *mastodon.Post
+
+	// Content is the text to bridge, which stages may transform
+	Content string
+
+	ContentHash  string
+	ExistingHash string
+
+	// ParentUri and ParentCid are set when the post replies to a post
+	// that exists on Bluesky
+	ParentUri string
+	ParentCid string
+
+	// ParentDepth is the reply depth of the parent record, or -1 when the
+	// post starts a new thread
+	ParentDepth int
+
+	// LinkBack is the source link that ends the text when link_back_mode
+	// can't make it a card
+	LinkBack string
+
+	// HashtagReply is posted as a reply after the main post when set, and
+	// HashtagReplyID is the record it was posted as
+	HashtagReply   string
+	HashtagReplyID string
+
+	// Orphan is set for a reply posted on its own because its parent isn't
+	// on Bluesky
+	Orphan bool
+
+	Attachments []attachment
+	Parts       []string
+
+	// PartAttachments holds the images for the part at the same index
+	PartAttachments [][]attachment
+
+	// Meta holds the optional record fields, such as labels
+	Meta bluesky.PostMeta
+
+	BlueskyIDs []string
+
+	// SkipReason stops the pipeline without an error when set
+	SkipReason string
+	SkipKind   string
+}
+
+// Skip stops processing the post, recording why. kind is a short, fixed
+// name for the reason that skips are counted under.
+func (pc *PostContext) Skip(kind string, format string, args ...interface{}) {
+	pc.SkipKind = kind
+	pc.SkipReason = fmt.Sprintf(format, args...)
+}
+
+// Stage is one step of post processing
+type Stage func(ctx context.Context, pc *PostContext) error
+
+// pipeline returns the stages every new or edited post goes through, in order
+func (b *Bridge) pipeline() []Stage {
+	return append(b.prepareStages(), b.replaceStage, b.postStage, b.saveStage)
+}
+
+// prepareStages returns the stages that decide whether and how a post is
+// bridged, up to the point where it is posted
+func (b *Bridge) prepareStages() []Stage {
+	return []Stage{
+		b.filterStage,
+		b.hashStage,
+		b.altEditStage,
+		b.normalizeStage,
+		b.languageStage,
+		b.warningStage,
+		b.replyStage,
+		b.hashtagStage,
+		b.mediaStage,
+		b.sanitizeStage,
+		b.emptyStage,
+		b.prefixStage,
+		b.linkBackStage,
+		b.splitStage,
+		b.attachStage,
+	}
+}
+
+// runPipeline runs a post through the stages until one fails or skips it
+func (b *Bridge) runPipeline(ctx context.Context, post *mastodon.Post) error {
+	pc := &PostContext{
+		Post:        post,
+		Content:     post.Content,
+		ParentDepth: -1,
+	}
+
+	for _, stage := range b.stages {
+		if err := stage(ctx, pc); err != nil {
+			return err
+		}
+
+		if pc.SkipReason != "" {
+			log.Printf("Skipping post %s: %s", post.ID, pc.SkipReason)
+			b.stats.skip(pc.SkipKind)
+			return nil
+		}
+	}
+
+	if pc.ExistingHash != "" {
+		b.stats.edited++
+	} else {
+		b.stats.bridged++
+	}
+
+	return nil
+}
+
+// filterStage skips posts that shouldn't be bridged at all
+func (b *Bridge) filterStage(ctx context.Context, pc *PostContext) error {
+	post := pc.Post
+
+	d := b.evaluateRules(post, pc.Content)
+	if !d.Bridge {
+		pc.Skip(d.Rule, "%s", d.Reason)
+		return nil
+	}
+
+	if post.Visibility != "public" {
+		log.Printf("WARNING: Bridging %s reply %s publicly to keep the thread coherent",
+			post.Visibility, post.ID)
+	}
+
+	return nil
+}
+
+// hashStage skips posts whose content hasn't changed since they were bridged
+func (b *Bridge) hashStage(ctx context.Context, pc *PostContext) error {
+	pc.ContentHash = postHash(pc.Post.Content, pc.Post.SpoilerText, hashedMedia(b.config, pc.Post), b.config.EditSensitivity)
+
+	// Check if we've already processed this exact content
+	existingHash, err := b.db.GetContentHash(pc.Post.ID)
+	if err == nil && (existingHash == pc.ContentHash || b.upgradeLegacyHash(pc.Post, existingHash, pc.ContentHash)) {
+		pc.Skip("unchanged", "content unchanged (hash: %s)", pc.ContentHash[:8])
+		return nil
+	}
+
+	pc.ExistingHash = existingHash
+
+	// An accidental double post has the same hash as one posted moments
+	// before. Replies and posts whose media isn't hashed are left alone, as
+	// the same words can mean something else there. The window is measured
+	// between when the posts were made on Mastodon, so a post repeated on
+	// purpose isn't caught just because both were bridged in one catch-up,
+	// and edits never count since they already have a hash of their own.
+	if b.config.DedupWindow > 0 && existingHash == "" && pc.Post.InReplyToID == "" &&
+		!pc.Post.CreatedAt.IsZero() && (len(pc.Post.Media) == 0 || b.config.HashIncludesMedia) {
+		window := time.Duration(b.config.DedupWindow) * time.Second
+		duplicateOf, err := b.db.FindRecentHash(pc.ContentHash, pc.Post.CreatedAt, window, pc.Post.ID)
+		if err != nil {
+			log.Printf("Error checking post %s for duplicates: %v", pc.Post.ID, err)
+		} else if duplicateOf != "" {
+			pc.Skip("duplicate", "same content as post %s, posted within dedup_window", duplicateOf)
+		}
+	}
+
+	return nil
+}
+
+// altEditStage handles an edit that only changed alt text when
+// announce_alt_edits is set. Rather than reposting, it replies to the
+// bridged post to say the descriptions changed.
+func (b *Bridge) altEditStage(ctx context.Context, pc *PostContext) error {
+	post := pc.Post
+	if !b.config.AnnounceAltEdits || pc.ExistingHash == "" || len(post.Media) == 0 {
+		return nil
+	}
+
+	oldHash, err := b.db.GetMediaHash(post.ID)
+	if err != nil || oldHash == "" || oldHash != altlessHash(b.config, post) {
+		return nil
+	}
+
+	bskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(post.ID)
+	if err != nil || len(bskyIDs) == 0 {
+		return nil
+	}
+
+	tail := strings.Split(bskyIDs[len(bskyIDs)-1], "|")
+	if len(tail) != 2 {
+		return nil
+	}
+
+	if b.dryRun {
+		pc.Skip("alt_text_updated", "only the alt text changed, a note would be replied")
+		return nil
+	}
+
+	note := "(updated image descriptions)"
+	if post.URL != "" {
+		note += "\n" + post.URL
+	}
+
+	noteIDs, err := b.createThread(ctx, []string{note}, nil, tail[0], tail[1], bluesky.PostMeta{})
+	if err != nil {
+		return fmt.Errorf("posting alt text note: %w", err)
+	}
+
+	// The note is part of the post now, so it goes when the post does
+	bskyIDs = append(bskyIDs, noteIDs...)
+	if err := b.db.UpdatePostMapping(post.ID, bskyIDs); err != nil {
+		log.Printf("Error updating post mapping: %v", err)
+	}
+	if b.lastBridged != nil && b.lastBridged.mastodonID == post.ID {
+		b.lastBridged.blueskyIDs = bskyIDs
+	}
+	if err := b.db.SaveContentHash(post.ID, pc.ContentHash); err != nil {
+		log.Printf("Error saving content hash: %v", err)
+	}
+
+	pc.Skip("alt_text_updated", "only the alt text changed, replied with a note")
+	return nil
+}
+
+// warningStage carries the content warning over as a prefix, a self-label
+// or both, as cw_mode and cw_label say. When an edit only changed the
+// warning of a single-record post, that record is updated in place rather
+// than reposted.
+func (b *Bridge) warningStage(ctx context.Context, pc *PostContext) error {
+	post := pc.Post
+
+	content, labels := applyContentWarning(b.config, pc.Content, post.SpoilerText)
+	pc.Meta.Labels = labels
+
+	if pc.ExistingHash != "" {
+		oldSpoiler, err := b.db.GetSpoilerText(post.ID)
+		if err == nil && oldSpoiler != post.SpoilerText &&
+			postHash(post.Content, oldSpoiler, hashedMedia(b.config, post), b.config.EditSensitivity) == pc.ExistingHash {
+			if b.dryRun {
+				pc.Skip("warning_updated", "only the content warning changed, it would be updated in place")
+				return nil
+			}
+			if err := b.updateWarning(ctx, post, oldSpoiler, pc.Meta.Labels); err != nil {
+				log.Printf("Could not update content warning of post %s in place, reposting: %v", post.ID, err)
+			} else {
+				if err := b.db.SaveContentHash(post.ID, pc.ContentHash); err != nil {
+					log.Printf("Error saving content hash: %v", err)
+				}
+				if err := b.db.SaveSpoilerText(post.ID, post.SpoilerText); err != nil {
+					log.Printf("Error saving content warning: %v", err)
+				}
+				pc.Skip("warning_updated", "only the content warning changed, updated in place")
+				return nil
+			}
+		}
+	}
+
+	pc.Content = content
+	return nil
+}
+
+// updateWarning rewrites the content warning prefix and labels of a post
+// bridged as a single record. Threads are left alone, since changing a
+// record changes its CID and would break the replies that reference it.
+func (b *Bridge) updateWarning(ctx context.Context, post *mastodon.Post, oldSpoiler string, labels []string) error {
+	bskyIDs, err := b.db.GetBlueskyIDsForMastodonPost(post.ID)
+	if err != nil {
+		return fmt.Errorf("getting mapping: %w", err)
+	}
+
+	if len(bskyIDs) != 1 {
+		return fmt.Errorf("post was bridged as %d records", len(bskyIDs))
+	}
+
+	uri := strings.Split(bskyIDs[0], "|")[0]
+	record, _, err := b.bluesky.GetRecord(ctx, uri)
+	if err != nil {
+		return fmt.Errorf("getting record: %w", err)
+	}
+
+	text, _ := record["text"].(string)
+	oldPrefix, _ := applyContentWarning(b.config, "", oldSpoiler)
+	if !strings.HasPrefix(text, oldPrefix) {
+		return fmt.Errorf("record text doesn't start with the old content warning")
+	}
+
+	body := strings.TrimPrefix(text, oldPrefix)
+	text, _ = applyContentWarning(b.config, body, post.SpoilerText)
+	if graphemeLen(text) > 300 {
+		return fmt.Errorf("new content warning doesn't fit")
+	}
+
+	record["text"] = text
+	shiftFacets(record, len(oldPrefix), len(text)-len(body)-len(oldPrefix))
+	if len(labels) > 0 {
+		record["labels"] = bluesky.SelfLabels(labels)
+	} else {
+		delete(record, "labels")
+	}
+
+	result, err := b.bluesky.UpdatePost(ctx, uri, record)
+	if err != nil {
+		return fmt.Errorf("updating record: %w", &blueskyError{err})
+	}
+
+	// The record has a new CID, which the next post's reply has to use
+	if err := b.db.UpdatePostMapping(post.ID, []string{result}); err != nil {
+		log.Printf("Error updating post mapping: %v", err)
+	}
+	if b.lastBridged != nil && b.lastBridged.mastodonID == post.ID {
+		b.lastBridged.blueskyIDs = []string{result}
+	}
+
+	log.Printf("Updated content warning of post %s in place", post.ID)
+	return nil
+}
+
+// shiftFacets moves the facets of a record fetched from Bluesky by delta
+// bytes after its text before offset was replaced. Facets within the
+// replaced text are dropped.
+func shiftFacets(record map[string]interface{}, offset, delta int) {
+	facets, ok := record["facets"].([]interface{})
+	if !ok || delta == 0 && offset == 0 {
+		return
+	}
+
+	var kept []interface{}
+	for _, f := range facets {
+		facet, _ := f.(map[string]interface{})
+		index, _ := facet["index"].(map[string]interface{})
+		start, _ := index["byteStart"].(float64)
+		end, _ := index["byteEnd"].(float64)
+		if index == nil || int(start) < offset {
+			continue
+		}
+		index["byteStart"] = int(start) + delta
+		index["byteEnd"] = int(end) + delta
+		kept = append(kept, f)
+	}
+
+	if len(kept) == 0 {
+		delete(record, "facets")
+		return
+	}
+	record["facets"] = kept
+}
+
+// replaceStage deletes the records of an earlier version of an edited post.
+// It runs after every stage that can skip or fail the post, so an edit that
+// isn't reposted leaves the old records, and the mapping to them, in place.
+func (b *Bridge) replaceStage(ctx context.Context, pc *PostContext) error {
+	if pc.ExistingHash == "" {
+		return nil
+	}
+
+	log.Printf("Post %s content changed (hash: %s -> %s), reprocessing",
+		pc.Post.ID, pc.ExistingHash[:8], pc.ContentHash[:8])
+
+	// Keep the recreated post where the original was in timelines, rather
+	// than bumping it to the top for what may be a typo fix
+	if b.config.PreserveCreatedAtOnEdit {
+		pc.Meta.CreatedAt = pc.Post.CreatedAt
+	}
+
+	// Delete any existing posts for this ID
+	bskyIDs, err := bridgedRecords(b.db, pc.Post.ID)
+	if err == nil && len(bskyIDs) > 0 {
+		log.Printf("Found %d existing Bluesky posts to delete", len(bskyIDs))
+
+		// Delete all previous posts
+		for _, id := range bskyIDs {
+			if err := b.bluesky.DeletePost(ctx, id); err != nil {
+				log.Printf("Error deleting Bluesky post %s: %v", id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// replyStage finds the Bluesky post a reply should attach to
+func (b *Bridge) replyStage(ctx context.Context, pc *PostContext) error {
+	post := pc.Post
+	if post.InReplyToID == "" {
+		return nil
+	}
+
+	if b.config.SkipRepliesToUnfollowed && post.InReplyToAccountID != "" && post.InReplyToAccountID != b.accountID {
+		follows, err := b.follows(ctx, post.InReplyToAccountID)
+		if err != nil {
+			log.Printf("Error checking whether the author of %s is followed: %v", post.InReplyToID, err)
+		} else if !follows {
+			pc.Skip("skip_replies_to_unfollowed", "reply to account %s, which isn't followed", post.InReplyToAccountID)
+			return nil
+		}
+	}
+
+	if b.config.LeakGuard && post.Visibility == "public" {
+		parent, err := b.mastodon.GetPostWithEdits(ctx, post.InReplyToID)
+		switch {
+		case errors.Is(err, mastodon.ErrNotFound):
+			// A parent that can't be seen may be private, and one that was
+			// deleted will never say otherwise, so it isn't retried
+			pc.Skip("leak_guard", "public reply to post %s, whose visibility is unknown", post.InReplyToID)
+			return nil
+		case err != nil:
+			// Rather than risk the leak, leave the post to be tried again
+			return fmt.Errorf("checking visibility of parent %s for leak_guard: %w", post.InReplyToID, err)
+		}
+		if parent.Visibility == "private" || parent.Visibility == "direct" {
+			pc.Skip("leak_guard", "public reply to a %s post, which would reveal a private conversation", parent.Visibility)
+			return nil
+		}
+	}
+
+	// A self-thread replies to the post bridged just before it, which is
+	// already known without asking the database
+	var parentBskyIDs []string
+	var err error
+	depth := -1
+	if last := b.lastBridged; last != nil && last.mastodonID == post.InReplyToID {
+		parentBskyIDs = last.blueskyIDs
+		depth = last.depth
+	} else {
+		// Otherwise check if we've bridged the parent post ourselves
+		parentBskyIDs, err = b.db.GetBlueskyIDsForMastodonPost(post.InReplyToID)
+	}
+	if err != nil || len(parentBskyIDs) == 0 {
+		if b.deferForOwnParent(pc) {
+			return errParentPending
+		}
+	} else {
+		delete(b.parentWaits, post.ID)
+	}
+	if err == nil && len(parentBskyIDs) > 0 {
+		// We found the parent post, this is a reply to our own post
+		log.Printf("Post %s is a reply to our own bridged post %s", post.ID, post.InReplyToID)
+
+		// Get the last part of the parent thread
+		lastParentID := parentBskyIDs[len(parentBskyIDs)-1]
+		parts := strings.Split(lastParentID, "|")
+		if len(parts) != 2 {
+			pc.Skip("no_parent", "can't find the parent post to reply to")
+			return nil
+		}
+
+		// self_reply_mode decides whether a reply to an older post of
+		// ours is bridged as a reply at all
+		if b.config.SelfReplyMode != "thread" && !b.continuesThread(post) {
+			if b.config.SelfReplyMode == "quote" {
+				root := strings.Split(parentBskyIDs[0], "|")
+				if len(root) == 2 {
+					log.Printf("Post %s replies to our older post %s, quoting it", post.ID, post.InReplyToID)
+					pc.Meta.Quote = &bluesky.StrongRef{URI: root[0], CID: root[1]}
+					return nil
+				}
+			}
+
+			log.Printf("Post %s replies to our older post %s, posting it on its own", post.ID, post.InReplyToID)
+			return nil
+		}
+
+		if depth < 0 {
+			depth, err = b.db.GetReplyDepth(post.InReplyToID)
+			if err != nil {
+				log.Printf("Error getting reply depth of %s: %v", post.InReplyToID, err)
+			}
+		}
+
+		// Past max_reply_depth the thread continues in a new one that
+		// starts with a link back to where the previous one left off
+		if b.config.MaxReplyDepth > 0 && depth+1 > b.config.MaxReplyDepth {
+			link, err := bluesky.PostURL(parts[0])
+			if err != nil {
+				return fmt.Errorf("linking to previous thread: %w", err)
+			}
+
+			log.Printf("Post %s would be %d replies deep, starting a new thread", post.ID, depth+1)
+			pc.Content = "(continued from " + link + ")\n\n" + pc.Content
+			return nil
+		}
+
+		pc.ParentUri = parts[0]
+		pc.ParentCid = parts[1]
+		pc.ParentDepth = depth
+	} else if missed, ok := b.parentMisses[post.InReplyToID]; ok &&
+		time.Since(missed) < time.Duration(b.config.ParentLookupNegativeTTL)*time.Second {
+		b.orphanReply(ctx, pc, nil, "parent post %s wasn't found on Bluesky %s ago", post.InReplyToID,
+			time.Since(missed).Round(time.Second))
+		return nil
+	} else {
+		// We haven't bridged this post - try to find it on Mastodon
+		parentPost, err := b.mastodon.GetPostWithEdits(ctx, post.InReplyToID)
+		if err != nil {
+			log.Printf("Error getting parent post %s: %v", post.InReplyToID, err)
+		} else if parentPost.Username != "" && parentPost.Instance != "" {
+			// Look up this post on Bluesky via our more robust method
+			log.Printf("Looking for parent post %s by %s@%s (%s) on Bluesky",
+				post.InReplyToID, parentPost.Username, parentPost.Instance, parentPost.DisplayName)
+
+			pc.ParentUri, pc.ParentCid, err = b.bluesky.LookupBridgedMastodonPost(
+				ctx,
+				post.InReplyToID,
+				parentPost.Username,
+				parentPost.Instance,
+				parentPost.Content,
+				parentPost.DisplayName,
+				parentPost.CreatedAt)
+
+			if err != nil {
+				log.Printf("Could not find parent post on Bluesky: %v", err)
+				b.rememberParentMiss(post.InReplyToID)
+				b.orphanReply(ctx, pc, parentPost, "can't find the parent post on Bluesky")
+				return nil
+			}
+
+			log.Printf("Found parent post on Bluesky: %s", pc.ParentUri)
+
+			// The depth of someone else's thread isn't known, so count
+			// from the parent
+			pc.ParentDepth = 0
+		}
+	}
+
+	// If we still haven't found a parent, we should skip this post
+	if pc.ParentUri == "" {
+		pc.Skip("no_parent", "can't find the parent post to reply to")
+	}
+
+	return nil
+}
+
+// continuesThread reports whether a reply is to the post bridged most
+// recently, which makes it the next post of a self-thread
+func (b *Bridge) continuesThread(post *mastodon.Post) bool {
+	if b.lastBridged != nil {
+		return b.lastBridged.mastodonID == post.InReplyToID
+	}
+
+	recent, err := b.db.GetRecentPostsToCheckForEdits(1, time.Time{})
+	if err != nil {
+		log.Printf("Error getting the most recently bridged post: %v", err)
+		return true
+	}
+	return len(recent) > 0 && recent[0] == post.InReplyToID
+}
+
+// orphanReply handles a reply whose parent isn't on Bluesky. It is skipped
+// unless orphan_reply_mode is post_with_context, in which case it is posted
+// on its own, starting with who it replies to and a link to the parent.
+// parentPost is fetched if the caller doesn't have it.
+func (b *Bridge) orphanReply(ctx context.Context, pc *PostContext, parentPost *mastodon.Post,
+	format string, args ...interface{}) {
+	if b.config.OrphanReplyMode != "post_with_context" {
+		pc.Skip("no_parent", format, args...)
+		return
+	}
+
+	if parentPost == nil {
+		var err error
+		parentPost, err = b.mastodon.GetPostWithEdits(ctx, pc.Post.InReplyToID)
+		if err != nil {
+			log.Printf("Error getting parent post %s: %v", pc.Post.InReplyToID, err)
+			pc.Skip("no_parent", format, args...)
+			return
+		}
+	}
+
+	log.Printf("Posting reply %s on its own: %s", pc.Post.ID, fmt.Sprintf(format, args...))
+	pc.Orphan = true
+	pc.Content = replyContext(parentPost, b.config.ContextExcerptLength) + "\n\n" + pc.Content
+}
+
+// replyContext introduces a reply posted without its parent, quoting up to
+// excerptLength characters of the parent when that is set
+func replyContext(parent *mastodon.Post, excerptLength int) string {
+	intro := "Replying to"
+	if parent.Username != "" && parent.Instance != "" {
+		intro += " @" + parent.Username + "@" + parent.Instance
+	}
+
+	if excerptLength > 0 {
+		excerpt := strings.Join(strings.Fields(parent.Content), " ")
+		if runes := []rune(excerpt); len(runes) > excerptLength {
+			excerpt = strings.TrimSpace(string(runes[:excerptLength])) + "…"
+		}
+		if excerpt != "" {
+			intro += ": \"" + excerpt + "\""
+		}
+	}
+
+	if parent.URL != "" {
+		intro += "\n" + parent.URL
+	}
+
+	return intro
+}
+
+// errParentPending is returned for a reply left in the pending queue until
+// the post of ours it replies to is bridged
+var errParentPending = errors.New("waiting for the parent post to be bridged")
+
+// parentWait is how long a reply has been waiting for its parent
+type parentWait struct {
+	since    time.Time
+	attempts int
+}
+
+// deferForOwnParent queues a new reply to one of our own posts that isn't
+// bridged yet, in case that post is still on its way, and reports whether
+// it did. The reply is retried from the pending queue on later polls: with
+// reply_parent_retries that many times, otherwise for up to
+// reply_parent_wait. After that it falls back to looking the parent up.
+func (b *Bridge) deferForOwnParent(pc *PostContext) bool {
+	post := pc.Post
+	if b.config.ReplyParentWait == 0 && b.config.ReplyParentRetries == 0 {
+		return false
+	}
+	if pc.ExistingHash != "" || post.InReplyToAccountID != b.accountID {
+		return false
+	}
+
+	w, ok := b.parentWaits[post.ID]
+	if !ok {
+		w = parentWait{since: time.Now()}
+	}
+
+	waiting := time.Since(w.since) < time.Duration(b.config.ReplyParentWait)*time.Second
+	setting := "reply_parent_wait"
+	if b.config.ReplyParentRetries > 0 {
+		waiting = w.attempts < b.config.ReplyParentRetries
+		setting = "reply_parent_retries"
+	}
+	if !waiting {
+		log.Printf("Our own post %s wasn't bridged within %s", post.InReplyToID, setting)
+		delete(b.parentWaits, post.ID)
+		return false
+	}
+
+	if b.dryRun {
+		return true
+	}
+
+	log.Printf("Queueing reply %s until our own post %s is bridged", post.ID, post.InReplyToID)
+	w.attempts++
+	b.parentWaits[post.ID] = w
+	b.queuePost(post.ID)
+	return true
+}
+
+// rememberParentMiss records a failed parent lookup, dropping misses that
+// have expired so the cache doesn't grow for the life of the bridge
+func (b *Bridge) rememberParentMiss(id string) {
+	ttl := time.Duration(b.config.ParentLookupNegativeTTL) * time.Second
+	if ttl == 0 {
+		return
+	}
+
+	for missedID, missed := range b.parentMisses {
+		if time.Since(missed) >= ttl {
+			delete(b.parentMisses, missedID)
+		}
+	}
+
+	b.parentMisses[id] = time.Now()
+}
+
+// hashtagStage applies trailing_hashtag_mode to a block of hashtags at the
+// end of the post
+func (b *Bridge) hashtagStage(ctx context.Context, pc *PostContext) error {
+	if b.config.TrailingHashtagMode != "keep" {
+		body, tags := splitTrailingHashtags(pc.Content)
+		if tags != "" {
+			pc.Content = body
+			if b.config.TrailingHashtagMode == "reply" {
+				pc.HashtagReply = tags
+			}
+		}
+	}
+
+	// hashtag_reply lists every tag of the post, so it takes the place of
+	// a reply with just the trailing ones
+	if b.config.HashtagReply && len(pc.Post.Hashtags) > 0 {
+		pc.Meta.TagFacets = true
+		pc.HashtagReply = hashtagList(pc.Post.Hashtags)
+	}
+
+	return nil
+}
+
+// hashtagList joins tags into "#a #b" text, leaving out any that would take
+// it past a single post
+func hashtagList(tags []string) string {
+	var list []string
+	length := 0
+	for _, tag := range tags {
+		tag = "#" + tag
+		if length+graphemeLen(tag)+1 > 300 {
+			break
+		}
+		list = append(list, tag)
+		length += graphemeLen(tag) + 1
+	}
+	return strings.Join(list, " ")
+}
+
+// mediaStage uploads images, linking any that can't be attached. It fails
+// the post if an upload fails and media_upload_fallback is fail_post.
+func (b *Bridge) mediaStage(ctx context.Context, pc *PostContext) error {
+	var err error
+	pc.Content, pc.Attachments, err = b.prepareMedia(ctx, pc.Content, pc.Post.Media)
+	return err
+}
+
+// emptyStage skips a post that has nothing left to bridge, with no text,
+// no media and no quote, which Bluesky would reject. Stages before this one
+// can empty a post that started out with content, such as a reply that
+// was only mentions or text that was only invisible characters. It runs
+// before the prefix and signature are added, since a post of nothing but
+// those isn't worth bridging either.
+func (b *Bridge) emptyStage(ctx context.Context, pc *PostContext) error {
+	if strings.TrimSpace(pc.Content) == "" && len(pc.Attachments) == 0 && pc.Meta.Quote == nil {
+		pc.Skip("empty", "no text, media or embed left to post")
+	}
+	return nil
+}
+
+// splitStage splits the content into parts that fit in a Bluesky post
+func (b *Bridge) splitStage(ctx context.Context, pc *PostContext) error {
+	// Rather than threading a post that is only just too long, try to
+	// shorten it into a single post, leaving room for the signature and
+	// any link back, which end the last part together
+	signature := postSignature(b.config, pc.Post)
+	tail := signature
+	if pc.LinkBack != "" {
+		tail = strings.TrimSpace(pc.LinkBack + "\n\n" + signature)
+	}
+	maxLength := 300
+	if tail != "" {
+		maxLength -= graphemeLen("\n\n" + tail)
+	}
+	if overflow := graphemeLen(pc.Content) - maxLength; overflow > 0 && overflow <= b.config.SinglePostSlack {
+		if shortened, ok := shortenToFit(pc.Content, maxLength); ok {
+			log.Printf("Shortened post %s from %d to %d chars to avoid a thread",
+				pc.Post.ID, graphemeLen(pc.Content), graphemeLen(shortened))
+			pc.Content = shortened
+		}
+	}
+
+	pc.Parts = splitContent(pc.Content, tail, b.config.FirstIndicatorFormat, b.config.RestIndicatorFormat, b.config.RebalanceParts)
+
+	// Past thread_threshold, followers get the start of the post and a
+	// link to the rest instead of a long thread
+	if threshold := b.config.ThreadThreshold; threshold > 0 && len(pc.Parts) > threshold {
+		if pc.Post.URL == "" {
+			log.Printf("Post %s would be %d parts, over thread_threshold, but has no URL to link to; threading it",
+				pc.Post.ID, len(pc.Parts))
+			return nil
+		}
+
+		// This already links to the source, so any link back is left out
+		log.Printf("Post %s would be %d parts, over thread_threshold, posting the start with a link",
+			pc.Post.ID, len(pc.Parts))
+		pc.Parts = []string{truncateWithLink(pc.Content, pc.Post.URL, signature)}
+		return nil
+	}
+
+	if len(pc.Parts) > 1 {
+		log.Printf("Threading post %s in %d parts", pc.Post.ID, len(pc.Parts))
+	}
+	return nil
+}
+
+// attachStage decides which part each image goes on
+func (b *Bridge) attachStage(ctx context.Context, pc *PostContext) error {
+	pc.Parts, pc.PartAttachments = b.groupAttachments(pc.Parts, pc.Attachments)
+	return nil
+}
+
+// linkBackStage links the bridged post back to its Mastodon source when
+// link_back_mode is if_no_embed. A record has room for a single embed, so
+// the source is a link card only when nothing else is embedded, and
+// otherwise a link at the end of the text, ahead of the signature.
+func (b *Bridge) linkBackStage(ctx context.Context, pc *PostContext) error {
+	if b.config.LinkBackMode != "if_no_embed" || pc.Post.URL == "" {
+		return nil
+	}
+
+	hasEmbed := len(pc.Attachments) > 0 ||
+		(b.config.FetchLinkCards && linkOnlyURL(pc.Content) != "")
+
+	if !hasEmbed {
+		host := pc.Post.URL
+		if u, err := url.Parse(pc.Post.URL); err == nil {
+			host = u.Host
+		}
+
+		pc.Meta.External = &bluesky.External{
+			URI:   pc.Post.URL,
+			Title: "Original post on " + host,
+		}
+		return nil
+	}
+
+	// splitStage puts the link before the signature, so it is numbered
+	// along with the rest of the thread
+	pc.LinkBack = pc.Post.URL
+	if isRTL(pc.Content) {
+		pc.LinkBack = isolate(pc.LinkBack)
+	}
+
+	return nil
+}
+
+// postStage creates the Bluesky records
+func (b *Bridge) postStage(ctx context.Context, pc *PostContext) error {
+	// A post that is just a link gets a clickable link and maybe a card
+	if link := linkOnlyURL(pc.Content); link != "" && len(pc.Parts) == 1 && len(pc.Attachments) == 0 {
+		bskyID, err := b.postLink(ctx, pc.Parts[0], link, pc.ParentUri, pc.ParentCid, pc.Meta)
+		if err != nil {
+			return fmt.Errorf("creating link post: %w", &blueskyError{err})
+		}
+
+		pc.BlueskyIDs = []string{bskyID}
+	} else {
+		bskyIDs, err := b.createThread(ctx, pc.Parts, pc.PartAttachments, pc.ParentUri, pc.ParentCid, pc.Meta)
+		if err != nil {
+			return err
+		}
+
+		pc.BlueskyIDs = bskyIDs
+	}
+
+	// Replies to an out-of-context reply would only add to the confusion.
+	// Like the hashtag reply, the post stands without it.
+	if pc.Orphan && b.config.OrphanReplyGate != "off" && len(pc.BlueskyIDs) > 0 {
+		var allow []string
+		if b.config.OrphanReplyGate != "nobody" {
+			allow = []string{b.config.OrphanReplyGate}
+		}
+
+		root := strings.Split(pc.BlueskyIDs[0], "|")[0]
+		if err := b.bluesky.CreateThreadgate(ctx, root, allow); err != nil {
+			log.Printf("Error limiting replies to post %s: %v", pc.Post.ID, err)
+		}
+	}
+
+	// The main post made it, so a failed hashtag reply isn't worth failing
+	// the whole post over
+	if pc.HashtagReply != "" && len(pc.BlueskyIDs) > 0 {
+		tail := strings.Split(pc.BlueskyIDs[len(pc.BlueskyIDs)-1], "|")
+		if len(tail) == 2 {
+			meta := pc.Meta
+			meta.External = nil
+			meta.Quote = nil
+			replyIDs, err := b.createThread(ctx, []string{pc.HashtagReply}, nil, tail[0], tail[1], meta)
+			if err != nil {
+				log.Printf("Error posting hashtag reply for post %s: %v", pc.Post.ID, err)
+			} else if len(replyIDs) > 0 {
+				// Kept out of BlueskyIDs, so replies to this post continue
+				// from its content rather than from the hashtags
+				pc.HashtagReplyID = replyIDs[0]
+			}
+		}
+	}
+
+	return nil
+}
+
+// saveStage records the mapping and content hash for later edits and replies
+func (b *Bridge) saveStage(ctx context.Context, pc *PostContext) error {
+	b.status.posted()
+
+	// Store the mapping in the database
+	if err := b.db.SavePostMapping(pc.Post.ID, pc.BlueskyIDs, pc.Post.CreatedAt); err != nil {
+		log.Printf("Error saving post mapping: %v", err)
+	}
+
+	// Store the content hash
+	if err := b.db.SaveContentHash(pc.Post.ID, pc.ContentHash); err != nil {
+		log.Printf("Error saving content hash: %v", err)
+	}
+
+	// Saved even when empty, to forget the reply of a version of the post
+	// that had hashtags
+	if err := b.db.SaveHashtagReply(pc.Post.ID, pc.HashtagReplyID); err != nil {
+		log.Printf("Error saving hashtag reply: %v", err)
+	}
+
+	// Store how deep the thread now is, so max_reply_depth can be applied
+	// to replies to this post
+	if err := b.db.SaveReplyDepth(pc.Post.ID, pc.ParentDepth+len(pc.BlueskyIDs)); err != nil {
+		log.Printf("Error saving reply depth: %v", err)
+	}
+
+	// Store the content warning so a change to it alone can be recognised
+	if err := b.db.SaveSpoilerText(pc.Post.ID, pc.Post.SpoilerText); err != nil {
+		log.Printf("Error saving content warning: %v", err)
+	}
+
+	// Likewise the hash without alt text, for announce_alt_edits
+	if b.config.AnnounceAltEdits && len(pc.Post.Media) > 0 {
+		if err := b.db.SaveMediaHash(pc.Post.ID, altlessHash(b.config, pc.Post)); err != nil {
+			log.Printf("Error saving media hash: %v", err)
+		}
+	}
+
+	// A poll's results are announced once it closes, which may be long
+	// after it has dropped out of the posts checked for edits
+	if b.config.AnnouncePollResults && pc.Post.Poll != nil && !pc.Post.Poll.Expired && !pc.Post.Poll.ExpiresAt.IsZero() {
+		if err := b.db.TrackOpenPoll(pc.Post.ID, pc.Post.Poll.ExpiresAt); err != nil {
+			log.Printf("Error tracking poll: %v", err)
+		}
+	}
+
+	// Only a new post can be the next one's parent in a self-thread. An
+	// edit leaves lastBridged alone, unless it recreated that very post.
+	latest := &bridgedPost{
+		mastodonID: pc.Post.ID,
+		blueskyIDs: pc.BlueskyIDs,
+		depth:      pc.ParentDepth + len(pc.BlueskyIDs),
+	}
+	if pc.ExistingHash == "" || (b.lastBridged != nil && b.lastBridged.mastodonID == pc.Post.ID) {
+		b.lastBridged = latest
+	}
+
+	b.runPostHook(pc.Post.ID, pc.BlueskyIDs)
+
+	return nil
+}
+
+// matchesApp reports whether an application name matches any of the patterns
+func (b *Bridge) matchesApp(appName string, patterns []string) bool {
+	if appName == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if b.config.AppMatchMode == "substring" {
+			if strings.Contains(strings.ToLower(appName), strings.ToLower(pattern)) {
+				return true
+			}
+		} else if strings.EqualFold(appName, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
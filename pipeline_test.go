@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"truss/bluesky"
+	"truss/config"
+	"truss/mastodon"
+)
+
+// newTestBridge makes a bridge backed by an in-memory database, without
+// Mastodon or Bluesky clients
+func newTestBridge(t *testing.T, cfg *config.Config) *Bridge {
+	t.Helper()
+
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	b := &Bridge{
+		config:       cfg,
+		db:           newTestDatabase(t),
+		parentMisses: make(map[string]time.Time),
+		parentWaits:  make(map[string]parentWait),
+		stats:        newCycleStats(),
+		status:       newBridgeStatus(),
+
+		unsettledEdits: make(map[string]unsettledEdit),
+	}
+	b.stages = b.pipeline()
+	return b
+}
+
+// fakePDS serves the XRPC calls the bridge makes to Bluesky, keeping records
+// by rkey in memory
+type fakePDS struct {
+	records map[string]map[string]interface{}
+	writes  int
+
+	// created holds the records created, in order
+	created []map[string]interface{}
+
+	// failUploads is how many blob uploads fail before they succeed
+	failUploads int
+	uploads     int
+
+	// After limitAfter records are created, the next rateLimits creates
+	// are rate limited for retryAfter seconds
+	limitAfter int
+	rateLimits int
+	retryAfter int
+
+	// badFacets is how many creates of records with facets are rejected
+	// for an invalid facet
+	badFacets int
+}
+
+// newFakeMastodon serves statuses, as JSON by ID, and points the bridge's
+// Mastodon client at it
+func newFakeMastodon(t *testing.T, b *Bridge, statuses map[string]string) {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, ok := statuses[strings.TrimPrefix(r.URL.Path, "/api/v1/statuses/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "Record not found"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, status)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := mastodon.NewClient(mastodon.ClientConfig{Server: srv.URL, AccessToken: "token"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	b.mastodon = client
+}
+
+// newFakePDS starts a fake PDS and points the bridge's Bluesky client at it
+func newFakePDS(t *testing.T, b *Bridge) *fakePDS {
+	t.Helper()
+
+	pds := &fakePDS{records: make(map[string]map[string]interface{})}
+	srv := httptest.NewServer(http.HandlerFunc(pds.serve))
+	t.Cleanup(srv.Close)
+
+	client, err := bluesky.NewClient(bluesky.ClientConfig{PDS: srv.URL, Identifier: "me.example", Password: "password"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	b.bluesky = client
+	return pds
+}
+
+func (p *fakePDS) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/xrpc/com.atproto.server.createSession":
+		fmt.Fprint(w, `{"accessJwt": "access", "refreshJwt": "refresh", "did": "did:plc:me"}`)
+	case "/xrpc/com.atproto.repo.getRecord":
+		record, ok := p.records[r.URL.Query().Get("rkey")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "RecordNotFound"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"cid": "cid0", "value": record})
+	case "/xrpc/com.atproto.repo.uploadBlob":
+		p.uploads++
+		if p.failUploads > 0 {
+			p.failUploads--
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, `{"error": "UpstreamFailure"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"blob": {"$type": "blob", "ref": {"$link": "blob%d"}, "mimeType": "image/png", "size": 4}}`, p.uploads)
+	case "/xrpc/com.atproto.repo.createRecord":
+		var req struct {
+			Collection string                 `json:"collection"`
+			Record     map[string]interface{} `json:"record"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if _, ok := req.Record["facets"]; ok && p.badFacets > 0 {
+			p.badFacets--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "InvalidRequest", "message": "Invalid app.bsky.feed.post record: record/facets/0/index must be valid"}`)
+			return
+		}
+		if p.rateLimits > 0 && len(p.created) >= p.limitAfter {
+			p.rateLimits--
+			w.Header().Set("Retry-After", strconv.Itoa(p.retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error": "RateLimitExceeded"}`)
+			return
+		}
+		p.writes++
+		rkey := fmt.Sprintf("new%d", p.writes)
+		p.records[rkey] = req.Record
+		p.created = append(p.created, req.Record)
+		fmt.Fprintf(w, `{"uri": "at://did:plc:me/%s/%s", "cid": "cid%d"}`, req.Collection, rkey, p.writes)
+	case "/xrpc/com.atproto.repo.deleteRecord":
+		var req struct {
+			Rkey string `json:"rkey"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		delete(p.records, req.Rkey)
+		p.writes++
+		fmt.Fprint(w, `{}`)
+	case "/xrpc/com.atproto.repo.putRecord":
+		var req struct {
+			Collection string                 `json:"collection"`
+			Rkey       string                 `json:"rkey"`
+			Record     map[string]interface{} `json:"record"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		p.records[req.Rkey] = req.Record
+		p.writes++
+		fmt.Fprintf(w, `{"uri": "at://did:plc:me/%s/%s", "cid": "cid%d"}`, req.Collection, req.Rkey, p.writes)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestHashStageUpgradesLegacyHash(t *testing.T) {
+	b := newTestBridge(t, nil)
+	post := &mastodon.Post{ID: "1", Content: "spoilers ahead", SpoilerText: "movie"}
+
+	// Hashes saved before content warnings were hashed covered only the
+	// content
+	if err := b.db.SaveContentHash(post.ID, postHash(post.Content, "", nil, "")); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+
+	pc := &PostContext{Post: post, Content: post.Content}
+	if err := b.hashStage(context.Background(), pc); err != nil {
+		t.Fatalf("hashStage: %v", err)
+	}
+	if pc.SkipKind != "unchanged" {
+		t.Errorf("got skip kind %q, want unchanged", pc.SkipKind)
+	}
+
+	stored, err := b.db.GetContentHash(post.ID)
+	if err != nil {
+		t.Fatalf("getting hash: %v", err)
+	}
+	if want := postHash(post.Content, post.SpoilerText, nil, ""); stored != want {
+		t.Errorf("stored hash %s, want the upgraded %s", stored[:8], want[:8])
+	}
+
+	// A real edit of the content warning still counts as one
+	post.SpoilerText = "different movie"
+	pc = &PostContext{Post: post, Content: post.Content}
+	if err := b.hashStage(context.Background(), pc); err != nil {
+		t.Fatalf("hashStage: %v", err)
+	}
+	if pc.SkipKind != "" {
+		t.Errorf("got skip kind %q after an edit, want none", pc.SkipKind)
+	}
+}
+
+func TestLocalOnlyPostsAreSkipped(t *testing.T) {
+	b := newTestBridge(t, nil)
+
+	// The bridge has no Bluesky client, so getting past the filter would
+	// panic
+	posts := []*mastodon.Post{
+		{ID: "1", Content: "stays here 👁", Visibility: "public", LocalOnly: true},
+		{ID: "2", Content: "boost", Visibility: "public",
+			Reblog: &mastodon.Post{ID: "3", Content: "local", Visibility: "public", LocalOnly: true}},
+	}
+	for _, post := range posts {
+		if err := b.ProcessPost(context.Background(), post); err != nil {
+			t.Fatalf("post %s: %v", post.ID, err)
+		}
+		if b.isBridged(post.ID) {
+			t.Errorf("local-only post %s was bridged", post.ID)
+		}
+	}
+
+	if n := b.stats.skipped["local_only"]; n != 1 {
+		t.Errorf("got %d local_only skips, want 1", n)
+	}
+	if n := b.stats.skipped["reblog"]; n != 1 {
+		t.Errorf("got %d reblog skips, want 1", n)
+	}
+}
+
+func TestReplyWaitsForOwnParent(t *testing.T) {
+	b := newTestBridge(t, &config.Config{ReplyParentRetries: 3, SelfReplyMode: "thread"})
+	b.accountID = "me"
+
+	reply := &mastodon.Post{ID: "2", Content: "reply", Visibility: "public", InReplyToID: "1", InReplyToAccountID: "me"}
+
+	// The parent isn't bridged yet, so the reply goes to the pending queue
+	pc := &PostContext{Post: reply, Content: reply.Content}
+	if err := b.replyStage(context.Background(), pc); !errors.Is(err, errParentPending) {
+		t.Fatalf("got %v, want errParentPending", err)
+	}
+	pending, err := b.db.GetPendingPosts()
+	if err != nil {
+		t.Fatalf("getting pending posts: %v", err)
+	}
+	if len(pending) != 1 || pending[0] != reply.ID {
+		t.Fatalf("got pending posts %v, want the reply", pending)
+	}
+
+	// By the next poll the parent has been bridged
+	parent := "at://did:plc:me/app.bsky.feed.post/1|cid1"
+	if err := b.db.SavePostMapping("1", []string{parent}, time.Now()); err != nil {
+		t.Fatalf("saving parent mapping: %v", err)
+	}
+
+	pc = &PostContext{Post: reply, Content: reply.Content}
+	if err := b.replyStage(context.Background(), pc); err != nil {
+		t.Fatalf("replyStage: %v", err)
+	}
+	if pc.ParentUri+"|"+pc.ParentCid != parent {
+		t.Errorf("got parent %s|%s, want %s", pc.ParentUri, pc.ParentCid, parent)
+	}
+	if _, ok := b.parentWaits[reply.ID]; ok {
+		t.Errorf("reply is still recorded as waiting")
+	}
+}
+
+func TestReplyParentRetriesAreBounded(t *testing.T) {
+	b := newTestBridge(t, &config.Config{ReplyParentRetries: 2})
+	b.accountID = "me"
+
+	reply := &mastodon.Post{ID: "2", InReplyToID: "1", InReplyToAccountID: "me"}
+	for i := 0; i < 2; i++ {
+		if !b.deferForOwnParent(&PostContext{Post: reply}) {
+			t.Fatalf("retry %d wasn't deferred", i+1)
+		}
+	}
+	if b.deferForOwnParent(&PostContext{Post: reply}) {
+		t.Errorf("deferred past reply_parent_retries")
+	}
+
+	// Replies to other accounts and edits never wait
+	other := &mastodon.Post{ID: "3", InReplyToID: "1", InReplyToAccountID: "someone"}
+	if b.deferForOwnParent(&PostContext{Post: other}) {
+		t.Errorf("deferred a reply to another account")
+	}
+	if b.deferForOwnParent(&PostContext{Post: &mastodon.Post{ID: "4", InReplyToID: "1", InReplyToAccountID: "me"}, ExistingHash: "abc"}) {
+		t.Errorf("deferred an edit")
+	}
+}
+
+func TestSaveStageLastBridged(t *testing.T) {
+	b := newTestBridge(t, nil)
+	ctx := context.Background()
+
+	newPost := &PostContext{
+		Post:       &mastodon.Post{ID: "2"},
+		BlueskyIDs: []string{"at://did:plc:me/app.bsky.feed.post/2|cid2"},
+	}
+	if err := b.saveStage(ctx, newPost); err != nil {
+		t.Fatalf("saveStage: %v", err)
+	}
+	if b.lastBridged == nil || b.lastBridged.mastodonID != "2" {
+		t.Fatalf("lastBridged = %+v, want post 2", b.lastBridged)
+	}
+
+	// Reprocessing an edit of an older post doesn't make it the post the
+	// next self-reply chains onto
+	olderEdit := &PostContext{
+		Post:         &mastodon.Post{ID: "1"},
+		ExistingHash: "abc",
+		BlueskyIDs:   []string{"at://did:plc:me/app.bsky.feed.post/1b|cid1b"},
+	}
+	if err := b.saveStage(ctx, olderEdit); err != nil {
+		t.Fatalf("saveStage: %v", err)
+	}
+	if b.lastBridged.mastodonID != "2" {
+		t.Errorf("lastBridged moved to edited post %s", b.lastBridged.mastodonID)
+	}
+
+	// An edit of the latest post itself refreshes its records
+	latestEdit := &PostContext{
+		Post:         &mastodon.Post{ID: "2"},
+		ExistingHash: "def",
+		BlueskyIDs:   []string{"at://did:plc:me/app.bsky.feed.post/2b|cid2b"},
+	}
+	if err := b.saveStage(ctx, latestEdit); err != nil {
+		t.Fatalf("saveStage: %v", err)
+	}
+	if got := b.lastBridged.blueskyIDs[0]; got != latestEdit.BlueskyIDs[0] {
+		t.Errorf("lastBridged has %s, want the recreated %s", got, latestEdit.BlueskyIDs[0])
+	}
+}
+
+func TestUnchangedReblogIsHashedByBoostedContent(t *testing.T) {
+	b := newTestBridge(t, nil)
+
+	// The wrapper of a boost has no content of its own, so an edit check
+	// must compare what was boosted
+	post := &mastodon.Post{ID: "10", Visibility: "public",
+		Reblog: &mastodon.Post{ID: "20", Content: "Boosted words", Visibility: "public"}}
+	if err := b.db.SaveContentHash(post.ID, hashPostContent("20:Boosted words", "")); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+
+	if err := b.ProcessPost(context.Background(), post); err != nil {
+		t.Fatalf("ProcessPost: %v", err)
+	}
+	if n := b.stats.skipped["unchanged"]; n != 1 {
+		t.Errorf("got %d unchanged skips, want 1", n)
+	}
+}
+
+func TestLinkBackIsNumberedWithThread(t *testing.T) {
+	b := newTestBridge(t, &config.Config{
+		LinkBackMode:         "if_no_embed",
+		FirstIndicatorFormat: " ({n}/{total})",
+		RestIndicatorFormat:  " ({n}/{total})",
+	})
+	const link = "https://example.social/@me/1"
+
+	// With images the card can't be used, so the link goes in the text.
+	// The last part is nearly full, so the link needs a part of its own.
+	pc := &PostContext{
+		Post:        &mastodon.Post{ID: "1", URL: link},
+		Content:     strings.Repeat("word ", 59) + strings.Repeat("x", 280),
+		Attachments: []attachment{{}},
+	}
+	for _, stage := range []Stage{b.linkBackStage, b.splitStage} {
+		if err := stage(context.Background(), pc); err != nil {
+			t.Fatalf("stage: %v", err)
+		}
+	}
+
+	if pc.Meta.External != nil {
+		t.Errorf("got a link card alongside images")
+	}
+	for i, part := range pc.Parts {
+		if suffix := fmt.Sprintf(" (%d/%d)", i+1, len(pc.Parts)); !strings.HasSuffix(part, suffix) {
+			t.Errorf("part %d = %q, want it to end with %q", i+1, part, suffix)
+		}
+		if n := graphemeLen(part); n > 300 {
+			t.Errorf("part %d is %d graphemes", i+1, n)
+		}
+	}
+	if last := pc.Parts[len(pc.Parts)-1]; !strings.Contains(last, link) {
+		t.Errorf("last part %q doesn't link back", last)
+	}
+}
+
+func TestLinkBackCardWithoutEmbed(t *testing.T) {
+	b := newTestBridge(t, &config.Config{LinkBackMode: "if_no_embed"})
+
+	pc := &PostContext{Post: &mastodon.Post{ID: "1", URL: "https://example.social/@me/1"}, Content: "hello"}
+	if err := b.linkBackStage(context.Background(), pc); err != nil {
+		t.Fatalf("linkBackStage: %v", err)
+	}
+	if pc.Meta.External == nil || pc.Meta.External.URI != pc.Post.URL {
+		t.Errorf("got card %+v, want one for the source", pc.Meta.External)
+	}
+	if pc.LinkBack != "" {
+		t.Errorf("link added to the text as well as the card")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	posted := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		window   int
+		content  string
+		after    time.Duration
+		reply    bool
+		wantSkip bool
+	}{
+		{name: "double post", window: 60, content: "hello", after: 30 * time.Second, wantSkip: true},
+		{name: "posted just before", window: 60, content: "hello", after: -30 * time.Second, wantSkip: true},
+		{name: "outside the window", window: 60, content: "hello", after: 2 * time.Minute},
+		{name: "different text", window: 60, content: "hello again", after: 30 * time.Second},
+		{name: "reply", window: 60, content: "hello", after: 30 * time.Second, reply: true},
+		{name: "dedup off", window: 0, content: "hello", after: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{DedupWindow: tt.window})
+
+			first := postHash("hello", "", nil, "")
+			if err := b.db.SavePostMapping("1", []string{"at://did:plc:me/app.bsky.feed.post/1|cid1"}, posted); err != nil {
+				t.Fatalf("saving mapping: %v", err)
+			}
+			if err := b.db.SaveContentHash("1", first); err != nil {
+				t.Fatalf("saving hash: %v", err)
+			}
+
+			post := &mastodon.Post{ID: "2", Content: tt.content, CreatedAt: posted.Add(tt.after)}
+			if tt.reply {
+				post.InReplyToID = "99"
+			}
+
+			pc := &PostContext{Post: post, Content: post.Content}
+			if err := b.hashStage(context.Background(), pc); err != nil {
+				t.Fatalf("hashStage: %v", err)
+			}
+			if got := pc.SkipKind == "duplicate"; got != tt.wantSkip {
+				t.Errorf("got skip kind %q, want duplicate: %v", pc.SkipKind, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestDedupIgnoresTheSamePost(t *testing.T) {
+	b := newTestBridge(t, &config.Config{DedupWindow: 60})
+	posted := time.Now()
+
+	if err := b.db.SavePostMapping("1", []string{"at://did:plc:me/app.bsky.feed.post/1|cid1"}, posted); err != nil {
+		t.Fatalf("saving mapping: %v", err)
+	}
+	if err := b.db.SaveContentHash("1", "abc"); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+
+	if got, err := b.db.FindRecentHash("abc", posted, time.Minute, "1"); err != nil || got != "" {
+		t.Errorf("got %q, %v, want the post not to match itself", got, err)
+	}
+	if got, err := b.db.FindRecentHash("abc", posted, time.Minute, "2"); err != nil || got != "1" {
+		t.Errorf("got %q, %v, want 1", got, err)
+	}
+}
+
+func TestWarningUpdatedInPlace(t *testing.T) {
+	const uri = "at://did:plc:me/app.bsky.feed.post/1"
+
+	tests := []struct {
+		name       string
+		cfg        config.Config
+		oldSpoiler string
+		newSpoiler string
+		body       string
+		wantText   string
+		wantLabels string
+		wantSkip   bool
+	}{
+		{
+			name:       "prefix",
+			cfg:        config.Config{CWMode: "prefix"},
+			oldSpoiler: "movie",
+			newSpoiler: "film",
+			body:       "see https://example.com",
+			wantText:   "[CW: film]\n\nsee https://example.com",
+			wantSkip:   true,
+		},
+		{
+			name:       "prefix with cw_label",
+			cfg:        config.Config{CWMode: "prefix", CWLabel: "graphic-media"},
+			oldSpoiler: "movie",
+			newSpoiler: "film",
+			body:       "see https://example.com",
+			wantText:   "[CW: film]\n\nsee https://example.com",
+			wantLabels: "graphic-media",
+			wantSkip:   true,
+		},
+		{
+			name:       "label to label",
+			cfg:        config.Config{CWMode: "label"},
+			oldSpoiler: "nsfw",
+			newSpoiler: "gore",
+			body:       "see https://example.com",
+			wantText:   "see https://example.com",
+			wantLabels: "graphic-media",
+			wantSkip:   true,
+		},
+		{
+			name:       "label to prefix",
+			cfg:        config.Config{CWMode: "label"},
+			oldSpoiler: "nudity",
+			newSpoiler: "spoilers",
+			body:       "see https://example.com",
+			wantText:   "[CW: spoilers]\n\nsee https://example.com",
+			wantSkip:   true,
+		},
+		{
+			name:       "counted in graphemes",
+			cfg:        config.Config{CWMode: "prefix"},
+			oldSpoiler: "a",
+			newSpoiler: "b",
+			body:       strings.Repeat("é", 285),
+			wantText:   "[CW: b]\n\n" + strings.Repeat("é", 285),
+			wantSkip:   true,
+		},
+		{
+			name:       "doesn't fit",
+			cfg:        config.Config{CWMode: "prefix"},
+			oldSpoiler: "a",
+			newSpoiler: "a much longer warning",
+			body:       strings.Repeat("é", 285),
+			wantText:   "[CW: a]\n\n" + strings.Repeat("é", 285),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &tt.cfg)
+			pds := newFakePDS(t, b)
+
+			oldText, _ := applyContentWarning(&tt.cfg, tt.body, tt.oldSpoiler)
+			record := map[string]interface{}{"$type": "app.bsky.feed.post", "text": oldText}
+			if link := strings.Index(oldText, "https://"); link >= 0 {
+				record["facets"] = []interface{}{map[string]interface{}{
+					"index":    map[string]interface{}{"byteStart": float64(link), "byteEnd": float64(len(oldText))},
+					"features": []interface{}{map[string]interface{}{"$type": "app.bsky.richtext.facet#link", "uri": "https://example.com"}},
+				}}
+			}
+			pds.records["1"] = record
+
+			post := &mastodon.Post{ID: "1", Content: tt.body, SpoilerText: tt.oldSpoiler}
+			if err := b.db.SavePostMapping(post.ID, []string{uri + "|cid0"}, time.Now()); err != nil {
+				t.Fatalf("saving mapping: %v", err)
+			}
+			if err := b.db.SaveSpoilerText(post.ID, tt.oldSpoiler); err != nil {
+				t.Fatalf("saving warning: %v", err)
+			}
+			b.lastBridged = &bridgedPost{mastodonID: post.ID, blueskyIDs: []string{uri + "|cid0"}}
+
+			existing := postHash(post.Content, post.SpoilerText, nil, "")
+			post.SpoilerText = tt.newSpoiler
+			pc := &PostContext{
+				Post:         post,
+				Content:      post.Content,
+				ExistingHash: existing,
+				ContentHash:  postHash(post.Content, post.SpoilerText, nil, ""),
+			}
+			if err := b.warningStage(context.Background(), pc); err != nil {
+				t.Fatalf("warningStage: %v", err)
+			}
+
+			if got := pc.SkipKind == "warning_updated"; got != tt.wantSkip {
+				t.Fatalf("got skip kind %q, want warning_updated: %v", pc.SkipKind, tt.wantSkip)
+			}
+
+			got := pds.records["1"]
+			if text := got["text"]; text != tt.wantText {
+				t.Errorf("got text %q, want %q", text, tt.wantText)
+			}
+			var labels []string
+			if l, ok := got["labels"].(map[string]interface{}); ok {
+				for _, v := range l["values"].([]interface{}) {
+					labels = append(labels, v.(map[string]interface{})["val"].(string))
+				}
+			}
+			if strings.Join(labels, ",") != tt.wantLabels {
+				t.Errorf("got labels %q, want %q", labels, tt.wantLabels)
+			}
+
+			// The link facet still covers the link
+			if facets, ok := got["facets"].([]interface{}); ok {
+				index := facets[0].(map[string]interface{})["index"].(map[string]interface{})
+				text := got["text"].(string)
+				start, end := int(index["byteStart"].(float64)), int(index["byteEnd"].(float64))
+				if start < 0 || end > len(text) || text[start:end] != "https://example.com" {
+					t.Errorf("got link facet at bytes %d-%d of %q", start, end, text)
+				}
+			}
+
+			if !tt.wantSkip {
+				return
+			}
+
+			// The next post replies to the record's new CID
+			want := uri + "|cid1"
+			if ids, _ := b.db.GetBlueskyIDsForMastodonPost(post.ID); len(ids) != 1 || ids[0] != want {
+				t.Errorf("got mapping %v, want %s", ids, want)
+			}
+			if ids := b.lastBridged.blueskyIDs; len(ids) != 1 || ids[0] != want {
+				t.Errorf("got last bridged %v, want %s", ids, want)
+			}
+		})
+	}
+}
+
+func TestPollResultsAnnouncedOnceClosed(t *testing.T) {
+	b := newTestBridge(t, &config.Config{AnnouncePollResults: true})
+	pds := newFakePDS(t, b)
+
+	closes := time.Now().Add(-time.Minute)
+	poll := func(expired bool) string {
+		return fmt.Sprintf(`{"id": "1", "content": "<p>Tea or coffee?</p>", "visibility": "public",
+			"account": {"id": "1", "username": "me", "acct": "me"},
+			"poll": {"id": "1", "expired": %v, "expires_at": %q, "options": [
+				{"title": "Tea", "votes_count": 3}, {"title": "Coffee", "votes_count": 1}]}}`,
+			expired, closes.Format(time.RFC3339))
+	}
+	statuses := map[string]string{"1": poll(false)}
+	newFakeMastodon(t, b, statuses)
+
+	// The poll is bridged while open
+	post := &mastodon.Post{ID: "1", Content: "Tea or coffee?", Poll: &mastodon.Poll{
+		Options: []string{"Tea", "Coffee"}, ExpiresAt: closes,
+	}}
+	pc := &PostContext{Post: post, BlueskyIDs: []string{"at://did:plc:me/app.bsky.feed.post/1|cid0"}}
+	if err := b.saveStage(context.Background(), pc); err != nil {
+		t.Fatalf("saveStage: %v", err)
+	}
+
+	// Many posts later, it is no longer checked for edits but is still
+	// tracked, and nothing is posted until Mastodon says it has closed
+	b.checkOpenPolls(context.Background())
+	if len(pds.created) != 0 {
+		t.Fatalf("posted %d records for a poll that hasn't closed", len(pds.created))
+	}
+
+	statuses["1"] = poll(true)
+	b.checkOpenPolls(context.Background())
+	if len(pds.created) != 1 {
+		t.Fatalf("posted %d records once the poll closed, want 1", len(pds.created))
+	}
+	if text, _ := pds.created[0]["text"].(string); !strings.HasPrefix(text, "Poll results: Tea 75%, Coffee 25% (4 votes)") {
+		t.Errorf("got results %q", text)
+	}
+
+	// Announced polls are no longer tracked
+	if polls, err := b.db.GetOpenPolls(); err != nil || len(polls) != 0 {
+		t.Errorf("got open polls %v, %v, want none", polls, err)
+	}
+	b.checkOpenPolls(context.Background())
+	if len(pds.created) != 1 {
+		t.Errorf("posted the results again")
+	}
+}
+
+func TestOpenPollsGiveUp(t *testing.T) {
+	b := newTestBridge(t, &config.Config{AnnouncePollResults: true})
+	newFakeMastodon(t, b, nil)
+
+	if err := b.db.TrackOpenPoll("1", time.Now().Add(-2*pollGiveUp)); err != nil {
+		t.Fatalf("tracking poll: %v", err)
+	}
+	if err := b.db.TrackOpenPoll("2", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("tracking poll: %v", err)
+	}
+
+	// Long closed polls are dropped, and a poll whose post can't be fetched
+	// is tried again later
+	b.checkOpenPolls(context.Background())
+	polls, err := b.db.GetOpenPolls()
+	if err != nil {
+		t.Fatalf("getting open polls: %v", err)
+	}
+	if _, ok := polls["1"]; ok {
+		t.Error("poll closed long ago is still tracked")
+	}
+	if _, ok := polls["2"]; !ok {
+		t.Error("poll that just closed is no longer tracked")
+	}
+}
+
+func TestEmptyPostIsNotPosted(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		prefix   string
+		wantSkip string
+	}{
+		// Caught by the filter rules before anything else runs
+		{name: "no content", content: "", wantSkip: "content"},
+		{name: "only whitespace", content: " \n\n ", wantSkip: "empty"},
+		// Left empty once strip_control_chars has removed them
+		{name: "only invisible characters", content: "\u2068\u200b\u2069", wantSkip: "empty"},
+		{name: "only invisible characters and a prefix", content: "\u2068\u200b\u2069", prefix: "🤖", wantSkip: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{
+				StripControlChars: true,
+				PrefixByType:      config.PrefixByType{Original: tt.prefix},
+			})
+			pds := newFakePDS(t, b)
+
+			post := &mastodon.Post{ID: "1", Content: tt.content, Visibility: "public"}
+			if err := b.runPipeline(context.Background(), post); err != nil {
+				t.Fatalf("runPipeline: %v", err)
+			}
+
+			if pds.writes != 0 {
+				t.Errorf("made %d Bluesky writes for an empty post, want none", pds.writes)
+			}
+			if b.stats.skipped[tt.wantSkip] != 1 {
+				t.Errorf("got skips %v, want it skipped as %s", b.stats.skipped, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestEmptyStageKeepsMediaAndQuotes(t *testing.T) {
+	tests := []struct {
+		name string
+		pc   *PostContext
+		want string
+	}{
+		{name: "empty", pc: &PostContext{}, want: "empty"},
+		{name: "text", pc: &PostContext{Content: "hi"}},
+		{name: "media", pc: &PostContext{Attachments: []attachment{{}}}},
+		{name: "quote", pc: &PostContext{Meta: bluesky.PostMeta{Quote: &bluesky.StrongRef{URI: "at://did:plc:x/app.bsky.feed.post/1", CID: "cid"}}}},
+	}
+
+	b := newTestBridge(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.pc.Post = &mastodon.Post{ID: "1"}
+			if err := b.emptyStage(context.Background(), tt.pc); err != nil {
+				t.Fatalf("emptyStage: %v", err)
+			}
+			if tt.pc.SkipKind != tt.want {
+				t.Errorf("got skip kind %q, want %q", tt.pc.SkipKind, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditDebounceCoalescesEdits(t *testing.T) {
+	b := newTestBridge(t, &config.Config{EditDebounce: 60})
+	pds := newFakePDS(t, b)
+
+	status := func(content string, editedAt time.Time) string {
+		return fmt.Sprintf(`{"id": "1", "content": "<p>%s</p>", "visibility": "public", "created_at": %q, "edited_at": %q,
+			"account": {"id": "1", "username": "me", "acct": "me"}}`,
+			content, time.Now().Add(-time.Hour).Format(time.RFC3339), editedAt.Format(time.RFC3339))
+	}
+	statuses := map[string]string{}
+	newFakeMastodon(t, b, statuses)
+
+	pds.records["1"] = map[string]interface{}{"text": "first"}
+	if err := b.db.SavePostMapping("1", []string{"at://did:plc:me/app.bsky.feed.post/1|cid0"}, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("saving mapping: %v", err)
+	}
+	if err := b.db.SaveContentHash("1", postHash("first", "", nil, "")); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+
+	// Two edits in quick succession are both left to settle
+	statuses["1"] = status("second", time.Now())
+	b.checkEdits(context.Background())
+	statuses["1"] = status("third", time.Now())
+	b.checkEdits(context.Background())
+	if pds.writes != 0 {
+		t.Fatalf("made %d Bluesky writes while the post was still being edited", pds.writes)
+	}
+
+	// Once the last edit has settled, the post is reposted once, as it is
+	// now
+	statuses["1"] = status("third", time.Now().Add(-2*time.Minute))
+	b.checkEdits(context.Background())
+	b.checkEdits(context.Background())
+
+	if len(pds.created) != 1 {
+		t.Fatalf("reposted %d times, want once", len(pds.created))
+	}
+	if text, _ := pds.created[0]["text"].(string); text != "third" {
+		t.Errorf("reposted %q, want the latest version", text)
+	}
+	if _, ok := pds.records["1"]; ok {
+		t.Error("the original record wasn't deleted")
+	}
+}
+
+func TestLeakGuard(t *testing.T) {
+	parent := func(visibility string) string {
+		return fmt.Sprintf(`{"id": "2", "content": "<p>parent</p>", "visibility": %q,
+			"account": {"id": "9", "username": "friend", "acct": "friend@other.example"}}`, visibility)
+	}
+
+	tests := []struct {
+		name     string
+		parent   string
+		wantSkip bool
+	}{
+		{name: "public parent", parent: parent("public")},
+		{name: "unlisted parent", parent: parent("unlisted")},
+		{name: "followers-only parent", parent: parent("private"), wantSkip: true},
+		{name: "direct parent", parent: parent("direct"), wantSkip: true},
+		{name: "parent not found", wantSkip: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{LeakGuard: true})
+			pds := newFakePDS(t, b)
+			statuses := map[string]string{}
+			if tt.parent != "" {
+				statuses["2"] = tt.parent
+			}
+			newFakeMastodon(t, b, statuses)
+
+			// The parent was bridged, so a reply to it would otherwise go
+			// ahead
+			pds.records["2"] = map[string]interface{}{"text": "parent"}
+			b.lastBridged = &bridgedPost{mastodonID: "2", blueskyIDs: []string{"at://did:plc:me/app.bsky.feed.post/2|cid0"}}
+
+			post := &mastodon.Post{ID: "3", Content: "reply", Visibility: "public", InReplyToID: "2"}
+			pc := &PostContext{Post: post, Content: post.Content, ParentDepth: -1}
+			if err := b.replyStage(context.Background(), pc); err != nil {
+				t.Fatalf("replyStage: %v", err)
+			}
+			if got := pc.SkipKind == "leak_guard"; got != tt.wantSkip {
+				t.Errorf("got skip kind %q (%s), want leak_guard: %v", pc.SkipKind, pc.SkipReason, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestLeakGuardRetriesTransientErrors(t *testing.T) {
+	b := newTestBridge(t, &config.Config{LeakGuard: true})
+
+	// Mastodon is down, so the parent's visibility can't be checked
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client, err := mastodon.NewClient(mastodon.ClientConfig{Server: srv.URL, AccessToken: "token"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	b.mastodon = client
+
+	post := &mastodon.Post{ID: "3", Content: "reply", Visibility: "public", InReplyToID: "2"}
+	pc := &PostContext{Post: post, Content: post.Content, ParentDepth: -1}
+	if err := b.replyStage(context.Background(), pc); err == nil {
+		t.Errorf("got skip kind %q and no error, want an error so the post is retried", pc.SkipKind)
+	}
+}
+
+// bridgeEdited sets post 3 up as bridged with different content, so running
+// it through the pipeline is an edit
+func bridgeEdited(t *testing.T, b *Bridge, pds *fakePDS) {
+	t.Helper()
+
+	pds.records["3"] = map[string]interface{}{"text": "old reply"}
+	if err := b.db.SavePostMapping("3", []string{"at://did:plc:me/app.bsky.feed.post/3|cid0"}, time.Now()); err != nil {
+		t.Fatalf("saving mapping: %v", err)
+	}
+	if err := b.db.SaveContentHash("3", postHash("old reply", "", nil, "")); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+}
+
+func TestLeakGuardLeavesEditedPostAlone(t *testing.T) {
+	tests := []struct {
+		name   string
+		parent string
+	}{
+		{name: "private parent", parent: `{"id": "2", "content": "<p>parent</p>", "visibility": "private",
+			"account": {"id": "9", "username": "friend", "acct": "friend@other.example"}}`},
+		{name: "parent not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{LeakGuard: true})
+			pds := newFakePDS(t, b)
+			statuses := map[string]string{}
+			if tt.parent != "" {
+				statuses["2"] = tt.parent
+			}
+			newFakeMastodon(t, b, statuses)
+			bridgeEdited(t, b, pds)
+
+			post := &mastodon.Post{ID: "3", Content: "new reply", Visibility: "public", InReplyToID: "2"}
+			if err := b.runPipeline(context.Background(), post); err != nil {
+				t.Fatalf("runPipeline: %v", err)
+			}
+
+			if b.stats.skipped["leak_guard"] != 1 {
+				t.Errorf("got skips %v, want it skipped by leak_guard", b.stats.skipped)
+			}
+			if _, ok := pds.records["3"]; !ok || pds.writes != 0 {
+				t.Errorf("made %d Bluesky writes, want the bridged record left alone", pds.writes)
+			}
+			ids, err := b.db.GetBlueskyIDsForMastodonPost("3")
+			if err != nil || len(ids) != 1 {
+				t.Errorf("got mapping %v (%v), want the original record", ids, err)
+			}
+		})
+	}
+}
+
+func TestUnfollowedReplyLeavesEditedPostAlone(t *testing.T) {
+	b := newTestBridge(t, &config.Config{SkipRepliesToUnfollowed: true})
+	pds := newFakePDS(t, b)
+	bridgeEdited(t, b, pds)
+
+	// The account replied to was unfollowed since the reply was bridged
+	b.accountID = "1"
+	b.following = map[string]bool{}
+	b.followingFetched = time.Now()
+
+	post := &mastodon.Post{ID: "3", Content: "new reply", Visibility: "public", InReplyToID: "2", InReplyToAccountID: "9"}
+	if err := b.runPipeline(context.Background(), post); err != nil {
+		t.Fatalf("runPipeline: %v", err)
+	}
+
+	if b.stats.skipped["skip_replies_to_unfollowed"] != 1 {
+		t.Errorf("got skips %v, want it skipped by skip_replies_to_unfollowed", b.stats.skipped)
+	}
+	if _, ok := pds.records["3"]; !ok || pds.writes != 0 {
+		t.Errorf("made %d Bluesky writes, want the bridged record left alone", pds.writes)
+	}
+}
+
+func TestThreadRateLimitedPartway(t *testing.T) {
+	parts := []string{"one (1/3)", "two (2/3)", "three (3/3)"}
+
+	tests := []struct {
+		mode      string
+		wantErr   bool
+		wantParts int
+	}{
+		// The post fails and is queued, leaving nothing half posted
+		{mode: "fail", wantErr: true, wantParts: 0},
+		{mode: "wait", wantParts: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{ThreadRateLimitMode: tt.mode})
+			pds := newFakePDS(t, b)
+			pds.limitAfter, pds.rateLimits, pds.retryAfter = 1, 1, 1
+
+			ids, err := b.createThread(context.Background(), parts, nil, "", "", bluesky.PostMeta{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+
+			var rateErr *bluesky.RateLimitError
+			if err != nil && !errors.As(err, &rateErr) {
+				t.Errorf("got error %v, want a rate limit", err)
+			}
+			if err != nil && !isBlueskyError(err) {
+				t.Errorf("got error %v, want it counted as a Bluesky failure", err)
+			}
+
+			if len(ids) != tt.wantParts {
+				t.Errorf("got %d parts, want %d", len(ids), tt.wantParts)
+			}
+
+			// Anything posted before the limit is cleaned up on failure
+			var left []string
+			for rkey := range pds.records {
+				left = append(left, rkey)
+			}
+			if len(left) != tt.wantParts {
+				t.Errorf("got records %v left on Bluesky, want %d", left, tt.wantParts)
+			}
+		})
+	}
+}
+
+func TestFacetFallbackWaitsOutRateLimit(t *testing.T) {
+	b := newTestBridge(t, &config.Config{ThreadRateLimitMode: "wait"})
+	pds := newFakePDS(t, b)
+
+	// The part is rejected for its facet, and the retry without facets is
+	// rate limited
+	pds.badFacets = 1
+	pds.rateLimits, pds.retryAfter = 1, 1
+
+	ids, err := b.createThread(context.Background(), []string{"see https://example.com"}, nil, "", "", bluesky.PostMeta{})
+	if err != nil {
+		t.Fatalf("createThread: %v", err)
+	}
+	if len(ids) != 1 || len(pds.created) != 1 {
+		t.Fatalf("got %d parts and %d records, want 1", len(ids), len(pds.created))
+	}
+	if _, ok := pds.created[0]["facets"]; ok {
+		t.Error("posted the part with its facets, want it posted as plain text")
+	}
+}
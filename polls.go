@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"truss/mastodon"
+)
+
+// pollGiveUp is how long after a poll closes its results are still tried
+// for, in case its post can't be fetched or the results can't be posted
+const pollGiveUp = 24 * time.Hour
+
+// checkOpenPolls announces the results of tracked polls that have closed.
+// Unlike edits, which are only looked for on the most recent posts, a poll
+// is tracked from when it is bridged until its results are posted.
+func (b *Bridge) checkOpenPolls(ctx context.Context) {
+	polls, err := b.db.GetOpenPolls()
+	if err != nil {
+		log.Printf("Error getting open polls: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for id, expiresAt := range polls {
+		if now.Before(expiresAt) {
+			continue
+		}
+
+		if now.Sub(expiresAt) > pollGiveUp {
+			log.Printf("Giving up on posting the results of poll %s, which closed at %s", id, expiresAt.Format(time.RFC3339))
+			if err := b.db.ForgetOpenPoll(id); err != nil {
+				log.Printf("Error forgetting poll %s: %v", id, err)
+			}
+			continue
+		}
+
+		post, err := b.mastodon.GetPostWithEdits(ctx, id)
+		if err != nil {
+			log.Printf("Error fetching closed poll %s: %v", id, err)
+			continue
+		}
+
+		// The poll was edited away
+		if post.Poll == nil {
+			if err := b.db.ForgetOpenPoll(id); err != nil {
+				log.Printf("Error forgetting poll %s: %v", id, err)
+			}
+			continue
+		}
+
+		if post.Poll.Expired {
+			b.announcePollResults(ctx, post)
+		}
+	}
+}
+
+// announcePollResults replies to a bridged poll with its results, once
+func (b *Bridge) announcePollResults(ctx context.Context, post *mastodon.Post) {
+	announced, err := b.db.IsPollAnnounced(post.ID)
+	if err != nil {
+		log.Printf("Error checking whether the results of poll %s were posted: %v", post.ID, err)
+		return
+	}
+	if announced {
+		return
+	}
+
+	log.Printf("Poll %s has closed, posting its results", post.ID)
+
+	if err := b.appendNote(ctx, post, pollResults(post.Poll)); err != nil {
+		log.Printf("Error posting results of poll %s: %v", post.ID, err)
+		return
+	}
+
+	if err := b.db.MarkPollAnnounced(post.ID); err != nil {
+		log.Printf("Error recording that the results of poll %s were posted: %v", post.ID, err)
+	}
+}
+
+// pollResults describes a closed poll's results, such as
+// "Poll results: Yes 62%, No 38% (50 votes)"
+func pollResults(poll *mastodon.Poll) string {
+	var total int64
+	for _, votes := range poll.Votes {
+		total += votes
+	}
+
+	var results []string
+	for i, option := range poll.Options {
+		var votes int64
+		if i < len(poll.Votes) {
+			votes = poll.Votes[i]
+		}
+
+		percent := int64(0)
+		if total > 0 {
+			percent = (votes*100 + total/2) / total
+		}
+		results = append(results, fmt.Sprintf("%s %d%%", option, percent))
+	}
+
+	noun := "votes"
+	if total == 1 {
+		noun = "vote"
+	}
+	return fmt.Sprintf("Poll results: %s (%d %s)", strings.Join(results, ", "), total, noun)
+}
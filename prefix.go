@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	"truss/mastodon"
+)
+
+// prefixStage puts the prefix_by_type marker for the post's type in front
+// of its content. The content hash is taken before this stage, so changing
+// a prefix doesn't make every post look edited, and the marker is counted
+// when the content is split like any other text.
+func (b *Bridge) prefixStage(ctx context.Context, pc *PostContext) error {
+	prefix := b.typePrefix(pc.Post)
+	if prefix == "" {
+		return nil
+	}
+
+	if pc.Content == "" {
+		pc.Content = prefix
+	} else {
+		pc.Content = prefix + " " + pc.Content
+	}
+	return nil
+}
+
+// typePrefix returns the configured prefix for an original post or a reply
+func (b *Bridge) typePrefix(post *mastodon.Post) string {
+	if post.InReplyToID != "" {
+		return b.config.PrefixByType.Reply
+	}
+	return b.config.PrefixByType.Original
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"truss/config"
+	"truss/mastodon"
+)
+
+func TestPrefixStage(t *testing.T) {
+	prefixes := config.PrefixByType{Original: "📝", Reply: "↩️"}
+
+	tests := []struct {
+		name     string
+		prefixes config.PrefixByType
+		post     *mastodon.Post
+		want     string
+	}{
+		{name: "original", prefixes: prefixes, post: &mastodon.Post{Content: "hello"}, want: "📝 hello"},
+		{name: "reply", prefixes: prefixes, post: &mastodon.Post{Content: "hello", InReplyToID: "1"}, want: "↩️ hello"},
+		{name: "empty content", prefixes: prefixes, post: &mastodon.Post{Content: ""}, want: "📝"},
+		{name: "replies only", prefixes: config.PrefixByType{Reply: "↩️"}, post: &mastodon.Post{Content: "hello"}, want: "hello"},
+		{name: "none", post: &mastodon.Post{Content: "hello", InReplyToID: "1"}, want: "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{PrefixByType: tt.prefixes})
+			pc := &PostContext{Post: tt.post, Content: tt.post.Content}
+			if err := b.prefixStage(context.Background(), pc); err != nil {
+				t.Fatalf("prefixStage: %v", err)
+			}
+			if pc.Content != tt.want {
+				t.Errorf("got %q, want %q", pc.Content, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixNotHashed(t *testing.T) {
+	b := newTestBridge(t, &config.Config{PrefixByType: config.PrefixByType{Reply: "↩️"}})
+	post := &mastodon.Post{ID: "1", Content: "hello", InReplyToID: "2"}
+
+	pc := &PostContext{Post: post, Content: post.Content}
+	if err := b.hashStage(context.Background(), pc); err != nil {
+		t.Fatalf("hashStage: %v", err)
+	}
+	if err := b.prefixStage(context.Background(), pc); err != nil {
+		t.Fatalf("prefixStage: %v", err)
+	}
+	if err := b.db.SaveContentHash(post.ID, pc.ContentHash); err != nil {
+		t.Fatalf("saving hash: %v", err)
+	}
+
+	// Changing the prefix doesn't make the post look edited
+	b.config.PrefixByType.Reply = "💬"
+	pc = &PostContext{Post: post, Content: post.Content}
+	if err := b.hashStage(context.Background(), pc); err != nil {
+		t.Fatalf("hashStage: %v", err)
+	}
+	if pc.SkipKind != "unchanged" {
+		t.Errorf("got skip kind %q after changing the prefix, want unchanged", pc.SkipKind)
+	}
+}
+
+func TestPrefixCountedWhenSplitting(t *testing.T) {
+	b := newTestBridge(t, &config.Config{PrefixByType: config.PrefixByType{Original: "📝"}})
+
+	// 299 graphemes fit on their own, but not with the prefix
+	content := strings.Repeat("x", 299)
+	pc := &PostContext{Post: &mastodon.Post{Content: content}, Content: content}
+	if err := b.prefixStage(context.Background(), pc); err != nil {
+		t.Fatalf("prefixStage: %v", err)
+	}
+
+	parts := splitContent(pc.Content, "", " ({n}/{total})", " ({n}/{total})", false)
+	if len(parts) != 2 {
+		t.Errorf("got %d parts, want the prefix to push the post into 2", len(parts))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"truss/mastodon"
+)
+
+// RuleResult is the outcome of one bridging rule for a post
+type RuleResult struct {
+	Rule string
+
+	// Blocked is set when the rule on its own would stop the post
+	Blocked bool
+
+	Detail string
+}
+
+// Decision is the final bridge/skip decision for a post together with
+// every rule that was evaluated to reach it
+type Decision struct {
+	Bridge bool
+
+	// Rule and Reason are the name and detail of the rule that decided a
+	// skip
+	Rule   string
+	Reason string
+
+	Trace []RuleResult
+}
+
+// evaluateRules decides whether a post should be bridged. Rules are
+// evaluated in this order of precedence, and the first one that blocks the
+// post decides the outcome:
+//
+//  1. local-only posts, which are never bridged whatever else is set
+//  2. visibility (with reply_visibility_policy)
+//  3. bridge_polls
+//  4. empty content
+//  5. require_media
+//  6. allowed_apps
+//  7. blocked_apps
+//  8. filter_hashtag
+//  9. routes
+//
+// Every rule is still evaluated so the trace shows all of the ones that
+// would have blocked the post.
+func (b *Bridge) evaluateRules(post *mastodon.Post, content string) *Decision {
+	d := &Decision{Bridge: true}
+
+	add := func(rule string, blocked bool, format string, args ...interface{}) {
+		detail := fmt.Sprintf(format, args...)
+		d.Trace = append(d.Trace, RuleResult{Rule: rule, Blocked: blocked, Detail: detail})
+
+		if blocked && d.Bridge {
+			d.Bridge = false
+			d.Rule = rule
+			d.Reason = detail
+		}
+	}
+
+	// Bridging would defeat the point of a post that mustn't federate
+	add("local_only", post.LocalOnly, "local-only: %t", post.LocalOnly)
+
+	switch {
+	case post.Visibility == "public":
+		add("visibility", false, "public")
+	case b.allowNonPublicReply(post):
+		add("visibility", false, "%s reply to a bridged post (reply_visibility_policy is follow_thread)", post.Visibility)
+	default:
+		add("visibility", true, "non-public (visibility: %s)", post.Visibility)
+	}
+
+	// Poll options can't be represented on Bluesky, so the question alone
+	// would be a confusing fragment
+	if post.Poll != nil {
+		add("bridge_polls", !b.config.BridgePolls, "poll post (bridge_polls is %t)", b.config.BridgePolls)
+	}
+
+	add("content", content == "", "%d chars of content", len(content))
+
+	// For photo-only mirrors
+	if b.config.RequireMedia {
+		add("require_media", len(post.Media) == 0, "%d media attachments (require_media is set)", len(post.Media))
+	}
+
+	// Filter on the application the post was made from
+	if len(b.config.AllowedApps) > 0 {
+		if b.matchesApp(post.AppName, b.config.AllowedApps) {
+			add("allowed_apps", false, "posted from %q, which is in allowed_apps", post.AppName)
+		} else {
+			add("allowed_apps", true, "posted from %q, which is not in allowed_apps", post.AppName)
+		}
+	}
+
+	if len(b.config.BlockedApps) > 0 {
+		if b.matchesApp(post.AppName, b.config.BlockedApps) {
+			add("blocked_apps", true, "posted from %q, which is in blocked_apps", post.AppName)
+		} else {
+			add("blocked_apps", false, "posted from %q, which is not in blocked_apps", post.AppName)
+		}
+	}
+
+	if b.config.FilterHashtag != "" {
+		hasFilterTag := false
+		for _, tag := range post.Hashtags {
+			if strings.EqualFold(tag, b.config.FilterHashtag) {
+				hasFilterTag = true
+				break
+			}
+		}
+
+		if hasFilterTag {
+			add("filter_hashtag", false, "has required hashtag #%s", b.config.FilterHashtag)
+		} else {
+			add("filter_hashtag", true, "missing required hashtag #%s", b.config.FilterHashtag)
+		}
+	}
+
+	// Another bridge may be the one to post this
+	if len(b.config.Routes) > 0 {
+		dest, tag := b.route(post)
+		own := b.config.Bluesky.Identifier
+		switch {
+		case dest == "":
+			add("routes", false, "no route matches, so every bridge posts it")
+		case tag == "":
+			add("routes", !strings.EqualFold(dest, own), "no route matches, so it goes to %s (route_default)", dest)
+		default:
+			add("routes", !strings.EqualFold(dest, own), "routed to %s by #%s", dest, tag)
+		}
+	}
+
+	return d
+}
+
+// route returns the Bluesky identifier a post is routed to, and the hashtag
+// that routed it, taking the first matching route. A post no route matches
+// goes to route_default with no tag.
+func (b *Bridge) route(post *mastodon.Post) (string, string) {
+	for _, route := range b.config.Routes {
+		for _, tag := range route.Tags {
+			for _, postTag := range post.Hashtags {
+				if strings.EqualFold(tag, postTag) {
+					return route.Bluesky, tag
+				}
+			}
+		}
+	}
+	return b.config.RouteDefault, ""
+}
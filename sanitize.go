@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// sanitizeStage removes invisible and control characters that break
+// rendering or throw facet offsets off, when strip_control_chars is set.
+// It runs after everything that adds to the post's own content, and before
+// the check for an empty post, which a post of nothing but such characters
+// is. The prefix added after it comes from the configuration.
+func (b *Bridge) sanitizeStage(ctx context.Context, pc *PostContext) error {
+	if b.config.StripControlChars {
+		pc.Content = stripControlChars(pc.Content)
+	}
+	return nil
+}
+
+// stripControlChars removes zero-width spaces, byte order marks, bidi
+// embeddings, overrides and isolates, and control characters other than
+// newlines and tabs. Line endings and separators become plain newlines.
+// Combining marks, variation selectors and the joiners inside emoji and
+// words are kept.
+func stripControlChars(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	runes := []rune(text)
+
+	var sb strings.Builder
+	sb.Grow(len(text))
+
+	for i, r := range runes {
+		switch {
+		case r == '\n' || r == '\t':
+		case r == '\r' || r == '\u2028' || r == '\u2029':
+			r = '\n'
+		case r == '\u200d':
+			// A joiner only means something between two characters, as
+			// in emoji sequences
+			if i == 0 || i == len(runes)-1 || unicode.IsSpace(runes[i-1]) || unicode.IsSpace(runes[i+1]) {
+				continue
+			}
+		case isStrippedControl(r):
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+// isStrippedControl reports whether r is an invisible or control character
+// that stripControlChars removes
+func isStrippedControl(r rune) bool {
+	switch {
+	case unicode.IsControl(r):
+		return true
+	case r == '\u200b', r == '\u2060', r == '\ufeff', r == '\u180e':
+		// Zero-width spaces, word joiner, byte order mark
+		return true
+	case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+		// Bidi embeddings, overrides and isolates
+		return true
+	case r >= '\ufff9' && r <= '\ufffb':
+		// Interlinear annotations
+		return true
+	}
+	return false
+}
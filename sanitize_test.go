@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"truss/config"
+	"truss/mastodon"
+)
+
+func TestStripControlChars(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "ZWJ family emoji kept", input: "family \U0001F468\u200d\U0001F469\u200d\U0001F467 photo", want: "family \U0001F468\u200d\U0001F469\u200d\U0001F467 photo"},
+		{name: "ZWJ profession emoji kept", input: "\U0001F469\u200d\U0001F4BB at work", want: "\U0001F469\u200d\U0001F4BB at work"},
+		{name: "stray joiner removed", input: "\u200dhello \u200dworld\u200d", want: "hello world"},
+		{name: "skin tone and variation selector kept", input: "\U0001F44D\U0001F3FD \u2764\ufe0f", want: "\U0001F44D\U0001F3FD \u2764\ufe0f"},
+		{name: "combining accent kept", input: "cafe\u0301", want: "cafe\u0301"},
+		{name: "bidi override removed", input: "invoice\u202egpj.exe", want: "invoicegpj.exe"},
+		{name: "bidi isolates removed", input: "a\u2066b\u2069c", want: "abc"},
+		{name: "zero-width space and BOM removed", input: "\ufeffzero\u200bwidth", want: "zerowidth"},
+		{name: "line endings normalized", input: "one\r\ntwo\rthree\u2028four", want: "one\ntwo\nthree\nfour"},
+		{name: "tabs and newlines kept", input: "a\tb\nc", want: "a\tb\nc"},
+		{name: "other controls removed", input: "bell\x07 null\x00", want: "bell null"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripControlChars(tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizedPostIsPosted(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip bool
+		want  string
+	}{
+		{name: "stripped", strip: true, want: "🤖 invoicegpj.exe is zerowidth"},
+		{name: "kept", strip: false, want: "🤖 invoice\u202egpj.exe is zero\u200bwidth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBridge(t, &config.Config{
+				StripControlChars: tt.strip,
+				PrefixByType:      config.PrefixByType{Original: "🤖"},
+			})
+			pds := newFakePDS(t, b)
+
+			post := &mastodon.Post{ID: "1", Content: "invoice\u202egpj.exe is zero\u200bwidth", Visibility: "public"}
+			if err := b.runPipeline(context.Background(), post); err != nil {
+				t.Fatalf("runPipeline: %v", err)
+			}
+
+			if len(pds.created) != 1 {
+				t.Fatalf("created %d records, want 1", len(pds.created))
+			}
+			if text, _ := pds.created[0]["text"].(string); text != tt.want {
+				t.Errorf("posted %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// cycleStats counts what happened to posts during one poll cycle, for the
+// log_cycle_summary line
+type cycleStats struct {
+	found   int
+	bridged int
+	edited  int
+	deleted int
+	errors  int
+
+	// skipped is keyed by what stopped the post, such as a rule name
+	skipped map[string]int
+}
+
+func newCycleStats() *cycleStats {
+	return &cycleStats{skipped: make(map[string]int)}
+}
+
+func (s *cycleStats) skip(kind string) {
+	s.skipped[kind]++
+}
+
+// summary formats the counts as a single key=value line
+func (s *cycleStats) summary() string {
+	total := 0
+	var kinds []string
+	for kind, n := range s.skipped {
+		total += n
+		kinds = append(kinds, fmt.Sprintf("%s=%d", kind, n))
+	}
+	sort.Strings(kinds)
+
+	line := fmt.Sprintf("found=%d bridged=%d edited=%d deleted=%d errors=%d skipped=%d",
+		s.found, s.bridged, s.edited, s.deleted, s.errors, total)
+	if len(kinds) > 0 {
+		line += " (" + strings.Join(kinds, " ") + ")"
+	}
+	return line
+}
+
+// endCycle logs the summary of the cycle that just finished, if
+// log_cycle_summary is set, and starts counting the next one
+func (b *Bridge) endCycle() {
+	if b.config.LogCycleSummary {
+		log.Printf("Cycle summary: %s", b.stats.summary())
+	}
+	b.stats = newCycleStats()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"truss/bluesky"
+	"truss/mastodon"
+)
+
+// statusShutdownTimeout is how long open /status requests get to finish
+// when the bridge stops
+const statusShutdownTimeout = 5 * time.Second
+
+// bridgeStatus is what the bridge loop reports for /status. Both clients
+// were checked at startup, so credentials count as valid until one is
+// rejected.
+type bridgeStatus struct {
+	mu sync.Mutex
+
+	lastPoll    time.Time
+	lastError   string
+	lastErrorAt time.Time
+
+	mastodonAuth bool
+	blueskyAuth  bool
+}
+
+func newBridgeStatus() *bridgeStatus {
+	return &bridgeStatus{mastodonAuth: true, blueskyAuth: true}
+}
+
+// polled records a successful poll of Mastodon
+func (s *bridgeStatus) polled() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPoll = time.Now()
+	s.mastodonAuth = true
+}
+
+// posted records a post made on Bluesky
+func (s *bridgeStatus) posted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blueskyAuth = true
+}
+
+// failed records an error, noting which credentials it shows are invalid
+func (s *bridgeStatus) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+	if errors.Is(err, mastodon.ErrUnauthorized) {
+		s.mastodonAuth = false
+	}
+	if errors.Is(err, bluesky.ErrUnauthorized) {
+		s.blueskyAuth = false
+	}
+}
+
+// statusSnapshot is the /status response
+type statusSnapshot struct {
+	LastPoll    *time.Time `json:"last_poll"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+
+	Auth struct {
+		Mastodon bool `json:"mastodon"`
+		Bluesky  bool `json:"bluesky"`
+	} `json:"auth"`
+
+	Posts struct {
+		Bridged int `json:"bridged"`
+		LastDay int `json:"last_day"`
+		Pending int `json:"pending"`
+	} `json:"posts"`
+
+	Config map[string]interface{} `json:"config"`
+}
+
+// serveStatus serves /status on status_addr until ctx is done
+func (b *Bridge) serveStatus(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", b.handleStatus)
+	server := &http.Server{Addr: b.config.StatusAddr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving status on %s", b.config.StatusAddr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Error serving status: %v", err)
+	}
+}
+
+func (b *Bridge) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	want := "Bearer " + b.config.AdminToken
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	snapshot, err := b.statusSnapshot()
+	if err != nil {
+		log.Printf("Error building status: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// statusSnapshot gathers the bridge's state. Nothing secret is included,
+// and a password in database_url is masked.
+func (b *Bridge) statusSnapshot() (*statusSnapshot, error) {
+	snapshot := &statusSnapshot{}
+
+	b.status.mu.Lock()
+	if !b.status.lastPoll.IsZero() {
+		lastPoll := b.status.lastPoll
+		snapshot.LastPoll = &lastPoll
+	}
+	if b.status.lastError != "" {
+		lastErrorAt := b.status.lastErrorAt
+		snapshot.LastError = b.status.lastError
+		snapshot.LastErrorAt = &lastErrorAt
+	}
+	snapshot.Auth.Mastodon = b.status.mastodonAuth
+	snapshot.Auth.Bluesky = b.status.blueskyAuth
+	b.status.mu.Unlock()
+
+	var err error
+	if snapshot.Posts.Bridged, err = b.db.CountPostMappings(time.Time{}); err != nil {
+		return nil, err
+	}
+	if snapshot.Posts.LastDay, err = b.db.CountPostMappings(time.Now().Add(-24 * time.Hour)); err != nil {
+		return nil, err
+	}
+	pending, err := b.db.GetPendingPosts()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Posts.Pending = len(pending)
+
+	database := redactDatabaseURL(b.config.DatabaseURL)
+	if database == "" {
+		database = b.config.DatabasePath
+	}
+
+	snapshot.Config = map[string]interface{}{
+		"mastodon_server":        b.config.Mastodon.Server,
+		"bluesky_pds":            b.config.Bluesky.PDS,
+		"bluesky_identifier":     b.config.Bluesky.Identifier,
+		"database":               database,
+		"poll_interval":          b.config.PollInterval,
+		"media_mode":             b.config.MediaMode,
+		"boost_attribution_mode": b.config.BoostAttributionMode,
+		"filter_hashtag":         b.config.FilterHashtag,
+	}
+
+	return snapshot, nil
+}
+
+// redactDatabaseURL masks the password in a database URL, whether it is
+// given with the user or, as Postgres also allows, as a query parameter.
+// A URL that can't be parsed is shown as a placeholder rather than risk it.
+func redactDatabaseURL(database string) string {
+	if database == "" {
+		return ""
+	}
+
+	u, err := url.Parse(database)
+	if err != nil {
+		return "(unparseable)"
+	}
+
+	if query := u.Query(); query.Has("password") {
+		query.Set("password", "xxxxx")
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// slowWriteWait is how long a write can wait for the database before it is
+// logged
+const slowWriteWait = time.Second
+
+// writeLockKey is the Postgres advisory lock that writes from every bridge
+// sharing a database take turns under
+const writeLockKey = 0x7472757373 // "truss"
+
+// writeGate lets one write at a time through to a database, roughly in the
+// order they arrived, so within this process a busy goroutine can't starve
+// the others. Only the writer at the front of the gate then waits for the
+// database's write lock against other processes.
+type writeGate struct {
+	// slot holds a token while a write is in progress. The runtime wakes
+	// goroutines blocked sending on a channel first come first served,
+	// which keeps it fair, though the language doesn't promise it.
+	slot chan struct{}
+
+	mu        sync.Mutex
+	writes    int64
+	totalWait time.Duration
+}
+
+var (
+	writeGatesMu sync.Mutex
+	writeGates   = make(map[string]*writeGate)
+)
+
+// writeGateFor returns the gate shared by every Database opened on name
+func writeGateFor(name string) *writeGate {
+	writeGatesMu.Lock()
+	defer writeGatesMu.Unlock()
+
+	gate, ok := writeGates[name]
+	if !ok {
+		gate = &writeGate{slot: make(chan struct{}, 1)}
+		writeGates[name] = gate
+	}
+	return gate
+}
+
+// enter waits up to timeout for the write slot and returns the function
+// that frees it
+func (g *writeGate) enter(timeout time.Duration) (func(), error) {
+	start := time.Now()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case g.slot <- struct{}{}:
+	case <-timer.C:
+		return nil, fmt.Errorf("waiting for database write: timed out after %s", timeout)
+	}
+
+	wait := time.Since(start)
+
+	g.mu.Lock()
+	g.writes++
+	g.totalWait += wait
+	average := g.totalWait / time.Duration(g.writes)
+	g.mu.Unlock()
+
+	if wait >= slowWriteWait {
+		log.Printf("WARNING: Database write waited %s for its turn (average %s over %d writes)",
+			wait.Round(time.Millisecond), average.Round(time.Microsecond), g.writes)
+	}
+
+	return func() { <-g.slot }, nil
+}
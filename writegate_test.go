@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteGateStress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "truss.db")
+
+	// Two bridges in one process, sharing a database file
+	var dbs []*Database
+	for i := 0; i < 2; i++ {
+		db, err := NewDatabase(path, 5*time.Second)
+		if err != nil {
+			t.Fatalf("opening database: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		dbs = append(dbs, db)
+	}
+
+	const writers, writes = 16, 25
+	errs := make(chan error, writers*writes)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			db := dbs[w%len(dbs)]
+			for i := 0; i < writes; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				if err := db.SaveContentHash(id, "hash"); err != nil {
+					errs <- err
+				}
+				if err := db.QueuePendingPost(id); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("write failed: %v", err)
+	}
+
+	pending, err := dbs[0].GetPendingPosts()
+	if err != nil {
+		t.Fatalf("getting pending posts: %v", err)
+	}
+	if len(pending) != writers*writes {
+		t.Errorf("got %d pending posts, want %d", len(pending), writers*writes)
+	}
+}
+
+func TestWriteGateTimeout(t *testing.T) {
+	gate := &writeGate{slot: make(chan struct{}, 1)}
+
+	leave, err := gate.enter(time.Second)
+	if err != nil {
+		t.Fatalf("entering an empty gate: %v", err)
+	}
+
+	if _, err := gate.enter(10 * time.Millisecond); err == nil {
+		t.Error("entered a gate that was held, want a timeout")
+	}
+
+	leave()
+	if leave, err := gate.enter(time.Second); err != nil {
+		t.Errorf("entering a freed gate: %v", err)
+	} else {
+		leave()
+	}
+}
+
+func TestWriteLockAcrossProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "truss.db")
+	stores := map[string]func(t *testing.T, timeout time.Duration) *Database{
+		"sqlite": func(t *testing.T, timeout time.Duration) *Database {
+			db, err := NewDatabase(path, timeout)
+			if err != nil {
+				t.Fatalf("opening database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+	}
+
+	// Postgres is only tested against a database set aside for it
+	if url := os.Getenv("TRUSS_TEST_POSTGRES_URL"); url != "" {
+		stores["postgres"] = func(t *testing.T, timeout time.Duration) *Database {
+			db, err := NewPostgresDatabase(url, timeout)
+			if err != nil {
+				t.Fatalf("opening database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		}
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			holder := open(t, 5*time.Second)
+
+			// A bridge in another process has a gate of its own, so only
+			// the database's lock stands between it and holder
+			otherProcess := func(timeout time.Duration) *Database {
+				db := open(t, timeout)
+				db.writes = &writeGate{slot: make(chan struct{}, 1)}
+				return db
+			}
+			waiter, impatient := otherProcess(5*time.Second), otherProcess(100*time.Millisecond)
+
+			tx, err := holder.db.Begin()
+			if err != nil {
+				t.Fatalf("taking the write lock: %v", err)
+			}
+			if holder.postgres {
+				if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", writeLockKey); err != nil {
+					t.Fatalf("taking the write lock: %v", err)
+				}
+			}
+
+			if err := impatient.SaveContentHash("1", "hash"); err == nil {
+				t.Error("wrote while another process held the lock, want a timeout")
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- waiter.SaveContentHash("2", "hash") }()
+
+			select {
+			case err := <-done:
+				t.Fatalf("wrote while another process held the lock (error: %v), want it to wait", err)
+			case <-time.After(200 * time.Millisecond):
+			}
+
+			tx.Commit()
+			if err := <-done; err != nil {
+				t.Errorf("writing once the lock was released: %v", err)
+			}
+		})
+	}
+}